@@ -0,0 +1,239 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Attachment is a file carried by the message, either as a regular
+// attachment or embedded inline (e.g. an image referenced by the HTML part)
+type Attachment struct {
+	// Filename as supplied by the sender, decoded but not sanitized
+	Filename string
+
+	// MediaType is the Content-Type of the attachment, without parameters
+	MediaType string
+
+	// ContentID is the Content-ID of the part, without the angle brackets
+	ContentID string
+
+	// Disposition is either "attachment" or "inline"
+	Disposition string
+
+	// Size of the decoded content, in bytes
+	Size int
+
+	data []byte
+}
+
+// Inline is true when the attachment is meant to be displayed as part of the message
+func (a *Attachment) Inline() bool {
+	return a.Disposition == "inline"
+}
+
+// Open returns a reader over the decoded content of the attachment
+func (a *Attachment) Open() io.Reader {
+	return bytes.NewReader(a.data)
+}
+
+// Header returns the MIME headers of the part
+func (p *Part) Header() textproto.MIMEHeader {
+	return p.part.Header
+}
+
+// Attachments lists every attachment in the message, descending into nested multipart parts.
+// A message that isn't multipart can be an attachment itself, e.g. a lone PDF
+func (m *Message) Attachments() ([]*Attachment, error) {
+	var attachments []*Attachment
+
+	if mediaType, _ := m.ContentType(); !strings.HasPrefix(mediaType, "multipart/") {
+		return findAttachments(textproto.MIMEHeader(m.header), m.RawBody)
+	}
+
+	for _, p := range m.Body {
+		found, err := findAttachments(p.part.Header, p.Body)
+		if err != nil {
+			return attachments, err
+		}
+		attachments = append(attachments, found...)
+	}
+
+	return attachments, nil
+}
+
+// SaveAttachments writes every attachment into dir, returning the paths of the created files.
+// Filenames are sanitized so they can't escape dir, and existing files are never overwritten
+func (m *Message) SaveAttachments(dir string) ([]string, error) {
+	var paths []string
+
+	attachments, err := m.Attachments()
+	if err != nil {
+		return paths, err
+	}
+
+	for i, a := range attachments {
+		f, err := createUnique(dir, safeFilename(a.Filename, a.MediaType, i+1))
+		if err != nil {
+			return paths, err
+		}
+
+		_, err = io.Copy(f, a.Open())
+		f.Close()
+		if err != nil {
+			return paths, err
+		}
+
+		paths = append(paths, f.Name())
+	}
+
+	return paths, nil
+}
+
+// findAttachments inspects a single MIME part, recursing into it if it is itself multipart
+func findAttachments(header textproto.MIMEHeader, body []byte) ([]*Attachment, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var attachments []*Attachment
+
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return attachments, fmt.Errorf("MIME error: %v", err)
+			}
+
+			slurp, err := ioutil.ReadAll(p)
+			if err != nil {
+				return attachments, fmt.Errorf("MIME error: %v", err)
+			}
+
+			found, err := findAttachments(p.Header, slurp)
+			if err != nil {
+				return attachments, err
+			}
+			attachments = append(attachments, found...)
+		}
+		return attachments, nil
+	}
+
+	disposition, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil {
+		disposition = ""
+	}
+
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	filename = decodeHeaderWord(filename)
+
+	contentID := strings.Trim(header.Get("Content-ID"), " <>")
+
+	switch {
+	case disposition == "attachment":
+	case disposition == "inline" && (filename != "" || contentID != ""):
+	case disposition == "" && filename != "":
+		disposition = "attachment"
+	case disposition == "" && contentID != "" && !strings.HasPrefix(mediaType, "text/"):
+		disposition = "inline"
+	default:
+		// regular body content
+		return nil, nil
+	}
+
+	data, err := decodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode attachment %q: %v", filename, err)
+	}
+
+	return []*Attachment{{
+		Filename:    filename,
+		MediaType:   mediaType,
+		ContentID:   contentID,
+		Disposition: disposition,
+		Size:        len(data),
+		data:        data,
+	}}, nil
+}
+
+// decodeTransfer undoes the Content-Transfer-Encoding of a part body
+func decodeTransfer(encoding string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body)))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	return body, nil
+}
+
+// decodeHeaderWord decodes RFC 2047 encoded-words, leaving the value as-is if it can't be decoded
+func decodeHeaderWord(value string) string {
+	dec := new(mime.WordDecoder)
+	if decoded, err := dec.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// safeFilename reduces a sender-supplied filename to a single, harmless path component
+func safeFilename(name, mediaType string, n int) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = filepath.Base(name)
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '/' || r == ':' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+
+	if name == "" {
+		name = fmt.Sprintf("attachment-%d", n)
+		if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+
+	if len(name) > 200 {
+		ext := filepath.Ext(name)
+		if len(ext) > 20 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:200-len(ext)], "") + ext
+	}
+
+	return name
+}
+
+// createUnique creates name in dir, adding a numeric suffix if the name is already taken
+func createUnique(dir, name string) (*os.File, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return f, err
+		}
+		candidate = fmt.Sprintf("%v-%d%v", base, i, ext)
+	}
+}
@@ -0,0 +1,66 @@
+package email
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AuthResult is the outcome of a single message authentication check (DKIM, SPF, ...),
+// modelled on the Authentication-Results header, see https://tools.ietf.org/html/rfc8601
+type AuthResult struct {
+	// Method is the authentication method, e.g. "dkim" or "spf"
+	Method string
+
+	// Result is the method's verdict, e.g. "pass", "fail", "temperror"
+	Result string
+
+	// Reason is an optional human readable explanation of the result
+	Reason string
+
+	// Properties describe what was checked, keyed by ptype.property (e.g. "header.d")
+	Properties map[string]string
+}
+
+// String formats the result as a resinfo clause of an Authentication-Results header
+func (r *AuthResult) String() string {
+	parts := []string{r.Method + "=" + r.Result}
+
+	if r.Reason != "" {
+		parts = append(parts, fmt.Sprintf("reason=%q", r.Reason))
+	}
+
+	var keys []string
+	for k := range r.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		parts = append(parts, k+"="+authResultValue(r.Properties[k]))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// AuthenticationResults builds the value of an Authentication-Results header for the
+// given results, authServID identifies the server that performed the checks
+func AuthenticationResults(authServID string, results []*AuthResult) string {
+	if len(results) == 0 {
+		return authServID + "; none"
+	}
+
+	clauses := []string{authServID}
+	for _, r := range results {
+		clauses = append(clauses, r.String())
+	}
+	return strings.Join(clauses, ";\n\t")
+}
+
+// authResultValue quotes property values that aren't a plain token or an address
+func authResultValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\"();,<>[]\\") {
+		return fmt.Sprintf("%q", v)
+	}
+	return v
+}
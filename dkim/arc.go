@@ -0,0 +1,468 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+// MaxARCInstances is the longest ARC chain allowed, see https://tools.ietf.org/html/rfc8617#section-4.2.1
+const MaxARCInstances = 50
+
+// ARC header field names, see https://tools.ietf.org/html/rfc8617#section-4.1
+const (
+	arcAuthenticationResults = "ARC-Authentication-Results"
+	arcMessageSignature      = "ARC-Message-Signature"
+	arcSeal                  = "ARC-Seal"
+)
+
+// ARCVerification is the outcome of validating the ARC chain of a message
+type ARCVerification struct {
+	// Instance is the number of ARC sets on the message
+	Instance int
+
+	// Result is one of Pass, Fail or None, with Err explaining a Fail
+	Result string
+	Err    error
+
+	// OldestPass is the lowest instance whose ARC-Message-Signature still verifies,
+	// zero when they all do, see https://tools.ietf.org/html/rfc8617#section-5.2
+	OldestPass int
+
+	// Domain & Selector of the latest ARC-Seal
+	Domain   string
+	Selector string
+}
+
+// AuthResult converts the verification into an Authentication-Results entry,
+// see https://tools.ietf.org/html/rfc8617#section-10.1
+func (v *ARCVerification) AuthResult() *email.AuthResult {
+	r := &email.AuthResult{
+		Method:     "arc",
+		Result:     v.Result,
+		Properties: make(map[string]string),
+	}
+	if v.Err != nil {
+		r.Reason = v.Err.Error()
+	}
+	if v.Result == Pass {
+		r.Properties["header.oldest-pass"] = strconv.Itoa(v.OldestPass)
+	}
+	return r
+}
+
+// arcSet is one instance of the three ARC header fields
+type arcSet struct {
+	results   field
+	signature field
+	seal      field
+
+	signatureTags map[string]string
+	sealTags      map[string]string
+}
+
+// VerifyARC validates the ARC sets of a full message, see https://tools.ietf.org/html/rfc8617#section-5.2.
+// An invalid chain is reported as a Fail in the verification, only read errors are returned
+func (v *Verifier) VerifyARC(r io.Reader) (*ARCVerification, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, body := splitMessage(data)
+
+	result := &ARCVerification{Result: Fail}
+
+	sets, err := parseARCSets(fields)
+	if err != nil {
+		result.Err = err
+		return result, nil
+	} else if len(sets) == 0 {
+		result.Result = None
+		return result, nil
+	}
+
+	result.Instance = len(sets)
+	latest := sets[len(sets)-1]
+	result.Domain = latest.sealTags["d"]
+	result.Selector = latest.sealTags["s"]
+
+	for i, set := range sets {
+		cv := set.sealTags["cv"]
+		if cv == Fail {
+			result.Err = fmt.Errorf("Chain was marked as failed at i=%v", i+1)
+			return result, nil
+		} else if (i == 0 && cv != None) || (i > 0 && cv != Pass) {
+			result.Err = fmt.Errorf("Invalid cv=%v at i=%v", cv, i+1)
+			return result, nil
+		}
+	}
+
+	if err := v.verifyARCSignature(latest, fields, body); err != nil {
+		result.Err = fmt.Errorf("ARC-Message-Signature i=%v did not verify: %v", len(sets), err)
+		return result, nil
+	}
+
+	for i := len(sets) - 1; i > 0; i-- {
+		if v.verifyARCSignature(sets[i-1], fields, body) != nil {
+			result.OldestPass = i + 1
+			break
+		}
+	}
+
+	for i := len(sets); i > 0; i-- {
+		if err := v.verifyARCSeal(sets[:i]); err != nil {
+			result.Err = fmt.Errorf("ARC-Seal i=%v did not verify: %v", i, err)
+			return result, nil
+		}
+	}
+
+	result.Result = Pass
+	return result, nil
+}
+
+// verifyARCSignature checks an ARC-Message-Signature, which works like a DKIM-Signature
+// without the version, identity & expiry tags, see https://tools.ietf.org/html/rfc8617#section-4.1.2
+func (v *Verifier) verifyARCSignature(set *arcSet, fields []field, body []byte) error {
+	tags := set.signatureTags
+	for _, required := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return fmt.Errorf("Missing required tag %v=", required)
+		}
+	}
+
+	signed := strings.Split(stripWSP(tags["h"]), ":")
+	if containsFold(signed, arcSeal) {
+		return fmt.Errorf("ARC-Seal must not be signed")
+	}
+
+	headerCanon, bodyCanon := Simple, Simple
+	if c, ok := tags["c"]; ok {
+		canon := strings.SplitN(c, "/", 2)
+		headerCanon = canon[0]
+		if len(canon) == 2 {
+			bodyCanon = canon[1]
+		}
+		if !validCanonicalization(headerCanon) || !validCanonicalization(bodyCanon) {
+			return fmt.Errorf("Unsupported canonicalization %q", c)
+		}
+	}
+
+	key, signature, err := v.arcKey(tags)
+	if err != nil {
+		return err
+	}
+
+	body = canonicalBody(body, bodyCanon)
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.Atoi(l)
+		if err != nil || length < 0 || length > len(body) {
+			return fmt.Errorf("Invalid l= tag")
+		}
+		body = body[:length]
+	}
+
+	if !bodyHashMatches(body, tags["bh"]) {
+		return fmt.Errorf("Body hash did not verify")
+	}
+
+	return verifySignature(key, headerHash(fields, signed, stripSignature(set.signature.raw), headerCanon), signature)
+}
+
+// verifyARCSeal checks the ARC-Seal of the last set, which covers every set up to it
+func (v *Verifier) verifyARCSeal(sets []*arcSet) error {
+	tags := sets[len(sets)-1].sealTags
+	for _, required := range []string{"a", "b", "cv", "d", "s"} {
+		if _, ok := tags[required]; !ok {
+			return fmt.Errorf("Missing required tag %v=", required)
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		return fmt.Errorf("ARC-Seal must not have an h= tag")
+	}
+
+	key, signature, err := v.arcKey(tags)
+	if err != nil {
+		return err
+	}
+
+	return verifySignature(key, sealHash(sets, stripSignature(sets[len(sets)-1].seal.raw)), signature)
+}
+
+// arcKey fetches the public key for an ARC signature or seal, and decodes its b= value
+func (v *Verifier) arcKey(tags map[string]string) (crypto.PublicKey, []byte, error) {
+	keyType, err := algorithmKeyType(tags["a"])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Malformed b= tag")
+	}
+
+	key, _, err := v.lookupKey(tags["s"], tags["d"], keyType)
+	return key, signature, err
+}
+
+// sealHash computes the hash an ARC-Seal signs: every ARC set in instance order, with the
+// final seal's b= value empty, see https://tools.ietf.org/html/rfc8617#section-5.1.1
+func sealHash(sets []*arcSet, seal string) []byte {
+	h := sha256.New()
+
+	for i, set := range sets {
+		io.WriteString(h, canonicalHeader(set.results.raw, Relaxed))
+		io.WriteString(h, canonicalHeader(set.signature.raw, Relaxed))
+		if i < len(sets)-1 {
+			io.WriteString(h, canonicalHeader(set.seal.raw, Relaxed))
+		}
+	}
+
+	io.WriteString(h, strings.TrimSuffix(canonicalHeader(seal, Relaxed), "\r\n"))
+
+	return h.Sum(nil)
+}
+
+// parseARCSets groups the ARC header fields of a message by instance, making sure
+// every instance from 1 up has exactly one of each
+func parseARCSets(fields []field) ([]*arcSet, error) {
+	byInstance := make(map[int]*arcSet)
+	highest := 0
+
+	for _, f := range fields {
+		var name string
+		for _, n := range []string{arcAuthenticationResults, arcMessageSignature, arcSeal} {
+			if strings.EqualFold(f.name, n) {
+				name = n
+			}
+		}
+		if name == "" {
+			continue
+		}
+
+		value := f.raw[strings.Index(f.raw, ":")+1:]
+
+		var tags map[string]string
+		var err error
+		if name == arcAuthenticationResults {
+			// only the leading i= is a tag, the rest is Authentication-Results content
+			tags, err = parseTags(strings.SplitN(value, ";", 2)[0])
+		} else {
+			tags, err = parseTags(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Malformed %v: %v", name, err)
+		}
+
+		instance, err := strconv.Atoi(tags["i"])
+		if err != nil || instance < 1 || instance > MaxARCInstances {
+			return nil, fmt.Errorf("Invalid instance in %v", name)
+		}
+		if instance > highest {
+			highest = instance
+		}
+
+		set, ok := byInstance[instance]
+		if !ok {
+			set = &arcSet{}
+			byInstance[instance] = set
+		}
+
+		var slot *field
+		switch name {
+		case arcAuthenticationResults:
+			slot = &set.results
+		case arcMessageSignature:
+			slot = &set.signature
+			set.signatureTags = tags
+		case arcSeal:
+			slot = &set.seal
+			set.sealTags = tags
+		}
+		if slot.raw != "" {
+			return nil, fmt.Errorf("Duplicate %v for i=%v", name, instance)
+		}
+		*slot = f
+	}
+
+	var sets []*arcSet
+	for i := 1; i <= highest; i++ {
+		set, ok := byInstance[i]
+		if !ok || set.results.raw == "" || set.signature.raw == "" || set.seal.raw == "" {
+			return nil, fmt.Errorf("Incomplete ARC set for i=%v", i)
+		}
+		sets = append(sets, set)
+	}
+
+	return sets, nil
+}
+
+// Sealer adds ARC sets to messages that are modified and passed on,
+// see https://tools.ietf.org/html/rfc8617#section-5.1
+type Sealer struct {
+	// Domain (d=) and Selector (s=) locate the public key at <Selector>._domainkey.<Domain>
+	Domain   string
+	Selector string
+
+	// Key is either an *rsa.PrivateKey or an ed25519.PrivateKey
+	Key crypto.Signer
+
+	// AuthServID identifies this server in the ARC-Authentication-Results
+	AuthServID string
+
+	// Headers covered by the ARC-Message-Signature, defaults to DefaultHeaders
+	Headers []string
+}
+
+// ARCSet holds the header values of a single ARC set
+type ARCSet struct {
+	Instance              int
+	AuthenticationResults string
+	MessageSignature      string
+	Seal                  string
+}
+
+// Seal reads a full message and returns the next ARC set for it. results are the
+// authentication checks done on receipt, chain is the outcome of validating the
+// message's existing ARC sets (None if there aren't any)
+func (s *Sealer) Seal(r io.Reader, results []*email.AuthResult, chain string) (*ARCSet, error) {
+	if s.Domain == "" || s.Selector == "" {
+		return nil, fmt.Errorf("ARC sealing requires a domain and a selector")
+	}
+
+	algorithm, err := keyAlgorithm(s.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, body := splitMessage(data)
+
+	sets, err := parseARCSets(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	instance := len(sets) + 1
+	switch {
+	case instance > MaxARCInstances:
+		return nil, fmt.Errorf("ARC chain is already %v sets long", len(sets))
+	case len(sets) > 0 && sets[len(sets)-1].sealTags["cv"] == Fail:
+		return nil, fmt.Errorf("ARC chain has already failed")
+	case instance == 1 && chain != None:
+		return nil, fmt.Errorf("A new ARC chain must be sealed with cv=none")
+	case instance > 1 && chain != Pass && chain != Fail:
+		return nil, fmt.Errorf("ARC chain must be validated before it can be extended")
+	}
+
+	authServID := s.AuthServID
+	if authServID == "" {
+		authServID = s.Domain
+	}
+
+	set := &ARCSet{
+		Instance:              instance,
+		AuthenticationResults: string(toCRLF([]byte(fmt.Sprintf("i=%v; %v", instance, email.AuthenticationResults(authServID, results))))),
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// the message signature covers the message as-is, with relaxed canonicalization
+	body = canonicalBody(body, Relaxed)
+	bodyHash := sha256.Sum256(body)
+
+	signer := &Signer{Headers: s.Headers}
+	signed := signer.signedHeaders(fields)
+
+	value := foldTags([]string{
+		"i=" + strconv.Itoa(instance),
+		"a=" + algorithm,
+		"c=" + Relaxed + "/" + Relaxed,
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		"t=" + now,
+		"h=" + strings.Join(signed, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	})
+	signature, err := sign(s.Key, headerHash(fields, signed, arcMessageSignature+": "+value, Relaxed))
+	if err != nil {
+		return nil, err
+	}
+	set.MessageSignature = value + foldBase64(base64.StdEncoding.EncodeToString(signature))
+
+	// the seal covers every ARC set, including the new one
+	sets = append(sets, &arcSet{
+		results:   field{arcAuthenticationResults, arcAuthenticationResults + ": " + set.AuthenticationResults + "\r\n"},
+		signature: field{arcMessageSignature, arcMessageSignature + ": " + set.MessageSignature + "\r\n"},
+	})
+
+	value = foldTags([]string{
+		"i=" + strconv.Itoa(instance),
+		"a=" + algorithm,
+		"t=" + now,
+		"cv=" + chain,
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+		"b=",
+	})
+	signature, err = sign(s.Key, sealHash(sets, arcSeal+": "+value))
+	if err != nil {
+		return nil, err
+	}
+	set.Seal = value + foldBase64(base64.StdEncoding.EncodeToString(signature))
+
+	return set, nil
+}
+
+// SealMessage adds an ARC set to the raw message, using its AuthResults for the
+// ARC-Authentication-Results. The message's arc result (see Verifier.VerifyARC) is
+// used as the chain validation status, so a message that already has ARC sets has
+// to have been verified first
+func (s *Sealer) SealMessage(m *email.Message) error {
+	if len(m.Raw) == 0 {
+		return fmt.Errorf("ARC sealing requires the raw message")
+	}
+
+	chain := None
+	for _, r := range m.AuthResults {
+		if r.Method == "arc" {
+			chain = r.Result
+		}
+	}
+
+	set, err := s.Seal(strings.NewReader(string(m.Raw)), m.AuthResults, chain)
+	if err != nil {
+		return err
+	}
+
+	m.Prepend(arcAuthenticationResults, set.AuthenticationResults)
+	m.Prepend(arcMessageSignature, set.MessageSignature)
+	m.Prepend(arcSeal, set.Seal)
+	return nil
+}
+
+// Wrap returns a message handler that seals each message before handing it off to next,
+// for relays that modify messages (e.g. mailing lists) before forwarding them. The seal
+// covers the message as it is at that point, so Wrap has to be the last step before the
+// message is relayed: make changes in the handlers (or smtpd middleware) around it, as
+// anything next changes breaks the signature
+func (s *Sealer) Wrap(next func(*email.Message) error) func(*email.Message) error {
+	return func(m *email.Message) error {
+		if err := s.SealMessage(m); err != nil {
+			return err
+		}
+		return next(m)
+	}
+}
@@ -0,0 +1,129 @@
+package dkim
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email"
+)
+
+func TestARCRoundTrip(t *testing.T) {
+	key := rfc8463Key()
+	resolver := fakeResolver{
+		"arc._domainkey.lists.example.org": "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		"arc._domainkey.relay.example.net": "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}
+	verifier := NewVerifier(resolver)
+
+	v, err := verifier.VerifyARC(strings.NewReader(rfc8463Message))
+	if err != nil || v.Result != None {
+		t.Fatalf("Message without ARC sets should be arc=none, got: %+v (%v)", v, err)
+	}
+
+	m, err := email.NewLenientMessage([]byte(rfc8463Message))
+	if err != nil {
+		t.Fatalf("Couldn't parse message: %v", err)
+	}
+	m.AuthResults = []*email.AuthResult{{Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "joe@football.example.com"}}}
+
+	lists := &Sealer{Domain: "lists.example.org", Selector: "arc", Key: key, AuthServID: "mx.lists.example.org"}
+	if err := lists.SealMessage(m); err != nil {
+		t.Fatalf("Couldn't seal message: %v", err)
+	}
+
+	if !strings.HasPrefix(string(m.Raw), "ARC-Seal: i=1; a=ed25519-sha256; ") || !strings.Contains(string(m.Raw), "cv=none") {
+		t.Errorf("New chain should start with a cv=none seal, got: %v", string(m.Raw))
+	}
+	if !strings.Contains(string(m.Raw), "ARC-Authentication-Results: i=1; mx.lists.example.org;\r\n\tspf=pass") {
+		t.Errorf("Missing ARC-Authentication-Results, got: %v", string(m.Raw))
+	}
+
+	v, _ = verifier.VerifyARC(strings.NewReader(string(m.Raw)))
+	if v.Result != Pass || v.Instance != 1 || v.OldestPass != 0 {
+		t.Fatalf("Sealed message should pass, got: %+v", v)
+	}
+
+	// the list modifies the subject, then the next hop checks & extends the chain
+	m.Raw = []byte(strings.Replace(string(m.Raw), "Subject: Is dinner ready?", "Subject: [list] Is dinner ready?", 1))
+	v, _ = verifier.VerifyARC(strings.NewReader(string(m.Raw)))
+	if v.Result != Fail {
+		t.Fatalf("Modified message should fail the latest signature, got: %+v", v)
+	}
+
+	if err := (&Sealer{Domain: "relay.example.net", Selector: "arc", Key: key}).SealMessage(m); err == nil {
+		t.Errorf("Existing chain shouldn't be extended before it's been verified")
+	}
+
+	m.AuthResults = append(m.AuthResults, &email.AuthResult{Method: "arc", Result: Pass})
+	relay := &Sealer{Domain: "relay.example.net", Selector: "arc", Key: key}
+	if err := relay.SealMessage(m); err != nil {
+		t.Fatalf("Couldn't seal message: %v", err)
+	}
+
+	v, _ = verifier.VerifyARC(strings.NewReader(string(m.Raw)))
+	if v.Result != Pass || v.Instance != 2 || v.OldestPass != 2 || v.Domain != "relay.example.net" {
+		t.Fatalf("Extended chain should pass with the first signature broken, got: %+v", v)
+	}
+
+	want := "arc=pass header.oldest-pass=2"
+	if got := v.AuthResult().String(); got != want {
+		t.Errorf("Wrong Authentication-Results entry, want: %v, got: %v", want, got)
+	}
+
+	// tampering with an earlier set breaks its seal
+	tampered := strings.Replace(string(m.Raw), "i=1; mx.lists.example.org", "i=1; mx.evil.example", 1)
+	v, _ = verifier.VerifyARC(strings.NewReader(tampered))
+	if v.Result != Fail || !strings.Contains(v.Err.Error(), "ARC-Seal i=") {
+		t.Errorf("Tampered ARC set should fail its seal, got: %+v", v)
+	}
+}
+
+func TestSealerWrap(t *testing.T) {
+	key := rfc8463Key()
+	verifier := NewVerifier(fakeResolver{
+		"arc._domainkey.lists.example.org": "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	})
+	sealer := &Sealer{Domain: "lists.example.org", Selector: "arc", Key: key}
+
+	var relayed *ARCVerification
+	relay := func(m *email.Message) error {
+		relayed, _ = verifier.VerifyARC(strings.NewReader(string(m.Raw)))
+		return nil
+	}
+
+	// the list's changes come before the seal, the relay gets the message as sealed
+	list := func(next func(*email.Message) error) func(*email.Message) error {
+		return func(m *email.Message) error {
+			m.Prepend("List-Id", "<dinner.lists.example.org>")
+			return next(m)
+		}
+	}
+
+	m, err := email.NewLenientMessage([]byte(rfc8463Message))
+	if err != nil {
+		t.Fatalf("Couldn't parse message: %v", err)
+	}
+	if err := list(sealer.Wrap(relay))(m); err != nil {
+		t.Fatalf("Couldn't seal message: %v", err)
+	}
+	if relayed == nil || relayed.Result != Pass {
+		t.Errorf("The relayed message should pass, got: %+v", relayed)
+	}
+}
+
+func TestParseARCSets(t *testing.T) {
+	for _, headers := range []string{
+		"ARC-Seal: i=1; cv=none\r\nARC-Message-Signature: i=1\r\n",
+		"ARC-Seal: i=2; cv=none\r\nARC-Message-Signature: i=2\r\nARC-Authentication-Results: i=2; example.org; none\r\n",
+		"ARC-Seal: i=1\r\nARC-Seal: i=1\r\nARC-Message-Signature: i=1\r\nARC-Authentication-Results: i=1; example.org; none\r\n",
+		"ARC-Seal: i=x\r\n",
+		"ARC-Seal: i=51\r\n",
+	} {
+		fields, _ := splitMessage([]byte(headers + rfc8463Message))
+		if _, err := parseARCSets(fields); err == nil {
+			t.Errorf("Invalid ARC sets should be refused: %q", headers)
+		}
+	}
+}
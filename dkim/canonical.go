@@ -0,0 +1,126 @@
+package dkim
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Canonicalization algorithms, see https://tools.ietf.org/html/rfc6376#section-3.4
+const (
+	Simple  = "simple"
+	Relaxed = "relaxed"
+)
+
+// field is a single header field, exactly as it appears in the message (folding and CRLF included)
+type field struct {
+	name string
+	raw  string
+}
+
+// splitMessage normalizes line endings to CRLF and splits the message into its header fields and body
+func splitMessage(data []byte) ([]field, []byte) {
+	data = toCRLF(data)
+
+	var head, body []byte
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		head, body = nil, data[2:]
+	} else if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		head, body = data[:i+2], data[i+4:]
+	} else {
+		head = data
+	}
+
+	var fields []field
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name := line
+		if i := strings.Index(line, ":"); i >= 0 {
+			name = line[:i]
+		}
+		fields = append(fields, field{strings.TrimRight(name, " \t"), line})
+	}
+
+	return fields, body
+}
+
+// toCRLF converts bare LF line endings (as used by maildir & friends) to CRLF
+func toCRLF(data []byte) []byte {
+	if !bytes.Contains(data, []byte("\n")) || bytes.Count(data, []byte("\n")) == bytes.Count(data, []byte("\r\n")) {
+		return data
+	}
+
+	var buf bytes.Buffer
+	for i, b := range data {
+		if b == '\n' && (i == 0 || data[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(b)
+	}
+	return buf.Bytes()
+}
+
+// canonicalHeader canonicalizes a raw header field
+func canonicalHeader(raw, canonicalization string) string {
+	if canonicalization == Simple {
+		return raw
+	}
+
+	i := strings.Index(raw, ":")
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(raw)) + ":\r\n"
+	}
+
+	name := strings.ToLower(strings.TrimRight(raw[:i], " \t"))
+	value := strings.Replace(raw[i+1:], "\r\n", "", -1)
+	value = strings.TrimSpace(collapseWSP(value))
+
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBody canonicalizes the message body
+func canonicalBody(body []byte, canonicalization string) []byte {
+	if canonicalization == Simple {
+		for bytes.HasSuffix(body, []byte("\r\n")) {
+			body = body[:len(body)-2]
+		}
+		return append(body[:len(body):len(body)], '\r', '\n')
+	}
+
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWSP(line), " ")
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// collapseWSP reduces each run of spaces & tabs to a single space
+func collapseWSP(s string) string {
+	var b strings.Builder
+	wsp := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			if !wsp {
+				b.WriteByte(' ')
+			}
+			wsp = true
+			continue
+		}
+		wsp = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,256 @@
+// Package dkim implements DomainKeys Identified Mail signatures as defined in
+// RFC 6376, with the Ed25519 algorithm from RFC 8463.
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+// DefaultHeaders are signed when a Signer doesn't specify its own list,
+// see https://tools.ietf.org/html/rfc6376#section-5.4.1
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// Signer adds DKIM signatures to outgoing messages
+type Signer struct {
+	// Domain (d=) and Selector (s=) locate the public key at <Selector>._domainkey.<Domain>
+	Domain   string
+	Selector string
+
+	// Key is either an *rsa.PrivateKey or an ed25519.PrivateKey
+	Key crypto.Signer
+
+	// Identity (i=) is the optional agent or user the message is signed on behalf of
+	Identity string
+
+	// HeaderCanonicalization & BodyCanonicalization are Simple or Relaxed, defaulting to Relaxed
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+
+	// Headers to sign, defaults to DefaultHeaders. Headers missing from the message are skipped
+	Headers []string
+
+	// Oversign lists headers that are signed one extra time, so that additional
+	// instances can't be added without breaking the signature
+	Oversign []string
+
+	// BodyLength adds an l= tag with the length of the signed body
+	BodyLength bool
+
+	// Expiration adds an x= tag this far past the signing time, zero for none
+	Expiration time.Duration
+}
+
+// Sign reads a full message and returns the value of the DKIM-Signature header for it
+func (s *Signer) Sign(r io.Reader) (string, error) {
+	if s.Domain == "" || s.Selector == "" {
+		return "", fmt.Errorf("DKIM signing requires a domain and a selector")
+	}
+
+	algorithm, err := keyAlgorithm(s.Key)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	headerCanon := canonicalizationOrDefault(s.HeaderCanonicalization)
+	bodyCanon := canonicalizationOrDefault(s.BodyCanonicalization)
+
+	fields, body := splitMessage(data)
+	body = canonicalBody(body, bodyCanon)
+	bodyHash := sha256.Sum256(body)
+
+	signed := s.signedHeaders(fields)
+
+	now := time.Now()
+	tags := []string{
+		"v=1",
+		"a=" + algorithm,
+		"c=" + headerCanon + "/" + bodyCanon,
+		"d=" + s.Domain,
+		"s=" + s.Selector,
+	}
+	if s.Identity != "" {
+		tags = append(tags, "i="+s.Identity)
+	}
+	tags = append(tags, "t="+strconv.FormatInt(now.Unix(), 10))
+	if s.Expiration > 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(s.Expiration).Unix(), 10))
+	}
+	if s.BodyLength {
+		tags = append(tags, "l="+strconv.Itoa(len(body)))
+	}
+	tags = append(tags,
+		"h="+strings.Join(signed, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	)
+
+	value := foldTags(tags)
+
+	signature, err := sign(s.Key, headerHash(fields, signed, "DKIM-Signature: "+value, headerCanon))
+	if err != nil {
+		return "", err
+	}
+
+	return value + foldBase64(base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// SignMessage signs the raw message and prepends the DKIM-Signature header to it
+func (s *Signer) SignMessage(m *email.Message) error {
+	if len(m.Raw) == 0 {
+		return fmt.Errorf("DKIM signing requires the raw message")
+	}
+
+	value, err := s.Sign(strings.NewReader(string(m.Raw)))
+	if err != nil {
+		return err
+	}
+
+	m.Prepend("DKIM-Signature", value)
+	return nil
+}
+
+// Wrap returns a message handler that signs each message before handing it off to next,
+// so that a Signer can be used in front of an outbound path or an smtpd.MessageHandler
+func (s *Signer) Wrap(next func(*email.Message) error) func(*email.Message) error {
+	return func(m *email.Message) error {
+		if err := s.SignMessage(m); err != nil {
+			return err
+		}
+		return next(m)
+	}
+}
+
+// signedHeaders builds the h= list, keeping one entry per instance of each header
+// present in the message plus the oversigned extras
+func (s *Signer) signedHeaders(fields []field) []string {
+	headers := s.Headers
+	if len(headers) == 0 {
+		headers = DefaultHeaders
+	}
+
+	count := make(map[string]int)
+	for _, f := range fields {
+		count[strings.ToLower(f.name)]++
+	}
+
+	var signed []string
+	for _, h := range headers {
+		for i := 0; i < count[strings.ToLower(h)]; i++ {
+			signed = append(signed, h)
+		}
+		// only sign each name once, even if listed twice
+		count[strings.ToLower(h)] = 0
+	}
+
+	for _, h := range s.Oversign {
+		signed = append(signed, h)
+	}
+
+	return signed
+}
+
+// headerHash computes the hash of the signed header fields followed by the signature
+// header itself (with an empty b= value), see https://tools.ietf.org/html/rfc6376#section-3.7
+func headerHash(fields []field, signed []string, signature, canonicalization string) []byte {
+	h := sha256.New()
+
+	// each h= entry consumes the last unused instance of that header
+	used := make(map[int]bool)
+	for _, name := range signed {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				io.WriteString(h, canonicalHeader(fields[i].raw, canonicalization))
+				break
+			}
+		}
+	}
+
+	io.WriteString(h, strings.TrimSuffix(canonicalHeader(signature, canonicalization), "\r\n"))
+
+	return h.Sum(nil)
+}
+
+// sign produces the b= signature for a header hash
+func sign(key crypto.Signer, hash []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		// Ed25519 signs the SHA-256 hash itself, see https://tools.ietf.org/html/rfc8463#section-3
+		return key.Sign(rand.Reader, hash, crypto.Hash(0))
+	}
+	return key.Sign(rand.Reader, hash, crypto.SHA256)
+}
+
+func keyAlgorithm(key crypto.Signer) (string, error) {
+	if key == nil {
+		return "", fmt.Errorf("DKIM signing requires a key")
+	}
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", fmt.Errorf("Unsupported DKIM key type %T", key)
+}
+
+func canonicalizationOrDefault(c string) string {
+	if strings.ToLower(c) == Simple {
+		return Simple
+	}
+	return Relaxed
+}
+
+// foldTags joins the tags into a header value, folding lines before they get too long
+func foldTags(tags []string) string {
+	var b strings.Builder
+	lineLen := len("DKIM-Signature: ")
+
+	for i, tag := range tags {
+		if i > 0 {
+			if lineLen+len(tag)+2 > 76 {
+				b.WriteString(";\r\n ")
+				lineLen = 1
+			} else {
+				b.WriteString("; ")
+				lineLen += 2
+			}
+		}
+		b.WriteString(tag)
+		lineLen += len(tag)
+	}
+
+	return b.String()
+}
+
+// foldBase64 splits the signature over several lines, whitespace in b= is ignored by verifiers
+func foldBase64(value string) string {
+	var chunks []string
+	for len(value) > 72 {
+		chunks = append(chunks, value[:72])
+		value = value[72:]
+	}
+	chunks = append(chunks, value)
+	return strings.Join(chunks, "\r\n ")
+}
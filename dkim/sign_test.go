@@ -0,0 +1,199 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+// the example message from https://tools.ietf.org/html/rfc8463#appendix-A
+var rfc8463Message = strings.Replace(`From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`, "\n", "\r\n", -1)
+
+func rfc8463Key() ed25519.PrivateKey {
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+var tagValue = regexp.MustCompile(`(?:^|;)\s*([a-z]+)=([^;]*)`)
+
+// checkSignature verifies a freshly made signature the long way round
+func checkSignature(t *testing.T, message, value string, verify func(hash, sig []byte) bool) {
+	tags := make(map[string]string)
+	for _, m := range tagValue.FindAllStringSubmatch(value, -1) {
+		tags[m[1]] = strings.Join(strings.Fields(m[2]), "")
+	}
+
+	fields, _ := splitMessage([]byte(message))
+	unsigned := value[:strings.LastIndex(value, "b=")+2]
+	canon := strings.Split(tags["c"], "/")[0]
+
+	hash := headerHash(fields, strings.Split(tags["h"], ":"), "DKIM-Signature: "+unsigned, canon)
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatalf("Signature isn't valid base64: %v", err)
+	}
+
+	if !verify(hash, sig) {
+		t.Errorf("Signature doesn't verify: %v", value)
+	}
+}
+
+func TestBodyHash(t *testing.T) {
+	signer := &Signer{Domain: "football.example.com", Selector: "brisbane", Key: rfc8463Key()}
+
+	value, err := signer.Sign(strings.NewReader(rfc8463Message))
+	if err != nil {
+		t.Fatalf("Couldn't sign message: %v", err)
+	}
+
+	if !strings.Contains(value, "bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=") {
+		t.Errorf("Body hash doesn't match RFC 8463, got: %v", value)
+	}
+
+	if !strings.Contains(value, "a=ed25519-sha256") {
+		t.Errorf("Wrong algorithm, got: %v", value)
+	}
+}
+
+func TestSignEd25519(t *testing.T) {
+	key := rfc8463Key()
+	signer := &Signer{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Key:      key,
+		Oversign: []string{"From"},
+	}
+
+	value, err := signer.Sign(strings.NewReader(rfc8463Message))
+	if err != nil {
+		t.Fatalf("Couldn't sign message: %v", err)
+	}
+
+	if !strings.Contains(value, "h=From:Subject:Date:To:Message-ID:From;") {
+		t.Errorf("Wrong signed headers, got: %v", value)
+	}
+
+	checkSignature(t, rfc8463Message, value, func(hash, sig []byte) bool {
+		return ed25519.Verify(key.Public().(ed25519.PublicKey), hash, sig)
+	})
+}
+
+func TestSignRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+
+	for _, canon := range []string{Simple, Relaxed} {
+		signer := &Signer{
+			Domain:                 "example.com",
+			Selector:               "test",
+			Key:                    key,
+			HeaderCanonicalization: canon,
+			BodyCanonicalization:   canon,
+			BodyLength:             true,
+			Expiration:             time.Hour,
+		}
+
+		value, err := signer.Sign(strings.NewReader(rfc8463Message))
+		if err != nil {
+			t.Fatalf("Couldn't sign message: %v", err)
+		}
+
+		for _, tag := range []string{"a=rsa-sha256", "c=" + canon + "/" + canon, "l=", "x="} {
+			if !strings.Contains(value, tag) {
+				t.Errorf("Signature should contain %v, got: %v", tag, value)
+			}
+		}
+
+		checkSignature(t, rfc8463Message, value, func(hash, sig []byte) bool {
+			return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash, sig) == nil
+		})
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	m, err := email.NewLenientMessage([]byte(rfc8463Message))
+	if err != nil {
+		t.Fatalf("Example message unparseable: %v", err)
+	}
+
+	signer := &Signer{Domain: "football.example.com", Selector: "brisbane", Key: rfc8463Key()}
+
+	var handled *email.Message
+	handler := signer.Wrap(func(m *email.Message) error {
+		handled = m
+		return nil
+	})
+
+	if err := handler(m); err != nil {
+		t.Fatalf("Couldn't sign message: %v", err)
+	}
+
+	if handled == nil || !strings.HasPrefix(string(handled.Raw), "DKIM-Signature: v=1; a=ed25519-sha256;") {
+		t.Errorf("Signature should have been prepended, got: %q", m.Raw)
+	}
+
+	if !strings.HasSuffix(string(handled.Raw), rfc8463Message) {
+		t.Errorf("The rest of the message should be untouched")
+	}
+}
+
+func TestCanonicalization(t *testing.T) {
+	raw := "A: X\r\nB : Y\t\r\n\tZ  \r\n"
+	fields, _ := splitMessage([]byte(raw + "\r\n"))
+
+	if len(fields) != 2 {
+		t.Fatalf("Wrong number of fields, got: %v", fields)
+	}
+
+	if got := canonicalHeader(fields[1].raw, Relaxed); got != "b:Y Z\r\n" {
+		t.Errorf("Wrong relaxed header, got: %q", got)
+	}
+
+	if got := canonicalHeader(fields[1].raw, Simple); got != "B : Y\t\r\n\tZ  \r\n" {
+		t.Errorf("Wrong simple header, got: %q", got)
+	}
+
+	body := []byte(" C \r\nD \t E\r\n\r\n\r\n")
+	if got := string(canonicalBody(body, Relaxed)); got != " C\r\nD E\r\n" {
+		t.Errorf("Wrong relaxed body, got: %q", got)
+	}
+
+	if got := string(canonicalBody(body, Simple)); got != " C \r\nD \t E\r\n" {
+		t.Errorf("Wrong simple body, got: %q", got)
+	}
+
+	if got := string(canonicalBody(nil, Simple)); got != "\r\n" {
+		t.Errorf("Empty simple body should be a single CRLF, got: %q", got)
+	}
+
+	if got := string(canonicalBody(nil, Relaxed)); got != "" {
+		t.Errorf("Empty relaxed body should be empty, got: %q", got)
+	}
+
+	if got := sha256.Sum256(canonicalBody(nil, Simple)); base64.StdEncoding.EncodeToString(got[:]) != "frcCV1k9oG9oKj3dpUqdJg1PxRT2RSN/XKdLCPjaYaY=" {
+		t.Errorf("Wrong hash for an empty simple body")
+	}
+}
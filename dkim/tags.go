@@ -0,0 +1,47 @@
+package dkim
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseTags parses a tag=value list, as used by signatures & key records,
+// see https://tools.ietf.org/html/rfc6376#section-3.2
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			// a trailing ; is allowed
+			continue
+		}
+
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Malformed tag %q", strings.TrimSpace(spec))
+		}
+
+		name := strings.TrimSpace(kv[0])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("Duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(unfold(kv[1]))
+	}
+
+	return tags, nil
+}
+
+// unfold removes the line breaks from folded header content
+func unfold(s string) string {
+	return strings.Replace(strings.Replace(s, "\r", "", -1), "\n", "", -1)
+}
+
+// stripWSP removes all whitespace, for base64 values that may have been folded anywhere
+func stripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
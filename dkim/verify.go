@@ -0,0 +1,389 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+// Verification results, see https://tools.ietf.org/html/rfc8601#section-2.7.1
+const (
+	Pass      = "pass"
+	Fail      = "fail"
+	Neutral   = "neutral"
+	None      = "none"
+	TempError = "temperror"
+	PermError = "permerror"
+)
+
+// Verification is the outcome of checking a single DKIM-Signature
+type Verification struct {
+	Domain    string
+	Selector  string
+	Identity  string
+	Algorithm string
+
+	// Signature is the b= value, used to tell signatures apart in reports
+	Signature string
+
+	// Result is one of Pass, Fail, Neutral, TempError or PermError, with Err explaining anything but a Pass
+	Result string
+	Err    error
+}
+
+// AuthResult converts the verification into an Authentication-Results entry
+func (v *Verification) AuthResult() *email.AuthResult {
+	r := &email.AuthResult{
+		Method:     "dkim",
+		Result:     v.Result,
+		Properties: make(map[string]string),
+	}
+	if v.Err != nil {
+		r.Reason = v.Err.Error()
+	}
+	if v.Domain != "" {
+		r.Properties["header.d"] = v.Domain
+	}
+	if v.Selector != "" {
+		r.Properties["header.s"] = v.Selector
+	}
+	if v.Identity != "" {
+		r.Properties["header.i"] = v.Identity
+	}
+	if v.Algorithm != "" {
+		r.Properties["header.a"] = v.Algorithm
+	}
+	if len(v.Signature) >= 8 {
+		// https://tools.ietf.org/html/rfc6008
+		r.Properties["header.b"] = v.Signature[:8]
+	}
+	return r
+}
+
+// AuthResults converts a set of verifications into Authentication-Results entries,
+// reporting dkim=none for unsigned messages
+func AuthResults(verifications []*Verification) []*email.AuthResult {
+	if len(verifications) == 0 {
+		return []*email.AuthResult{{Method: "dkim", Result: None}}
+	}
+
+	var results []*email.AuthResult
+	for _, v := range verifications {
+		results = append(results, v.AuthResult())
+	}
+	return results
+}
+
+// Verifier checks the DKIM signatures of inbound messages
+type Verifier struct {
+	// Resolver fetches the public keys from DNS
+	Resolver email.Resolver
+
+	// MinRSABits is the shortest RSA key accepted, see https://tools.ietf.org/html/rfc8301#section-3.2
+	MinRSABits int
+
+	// MaxSignatures caps the number of signatures checked per message
+	MaxSignatures int
+}
+
+// NewVerifier creates a verifier with the default settings
+func NewVerifier(resolver email.Resolver) *Verifier {
+	return &Verifier{
+		Resolver:      resolver,
+		MinRSABits:    1024,
+		MaxSignatures: 10,
+	}
+}
+
+// Verify checks every DKIM-Signature header of a full message, in the order they appear
+func (v *Verifier) Verify(r io.Reader) ([]*Verification, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, body := splitMessage(data)
+
+	var verifications []*Verification
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		if v.MaxSignatures > 0 && len(verifications) >= v.MaxSignatures {
+			break
+		}
+		verifications = append(verifications, v.verify(f, fields, body))
+	}
+
+	return verifications, nil
+}
+
+// verify checks a single signature field
+func (v *Verifier) verify(sig field, fields []field, body []byte) *Verification {
+	result := &Verification{Result: PermError}
+
+	tags, err := parseTags(sig.raw[strings.Index(sig.raw, ":")+1:])
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Domain = tags["d"]
+	result.Selector = tags["s"]
+	result.Identity = tags["i"]
+	result.Algorithm = tags["a"]
+	result.Signature = stripWSP(tags["b"])
+
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			result.Err = fmt.Errorf("Missing required tag %v=", required)
+			return result
+		}
+	}
+
+	if tags["v"] != "1" {
+		result.Err = fmt.Errorf("Unsupported version %q", tags["v"])
+		return result
+	}
+
+	if result.Identity != "" && !isSubdomain(identityDomain(result.Identity), result.Domain) {
+		result.Err = fmt.Errorf("Identity %v is not within %v", result.Identity, result.Domain)
+		return result
+	}
+
+	signed := strings.Split(stripWSP(tags["h"]), ":")
+	if !containsFold(signed, "From") {
+		result.Err = fmt.Errorf("From header is not signed")
+		return result
+	}
+
+	if x, ok := tags["x"]; ok {
+		expiry, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			result.Err = fmt.Errorf("Malformed x= tag")
+			return result
+		} else if time.Now().Unix() > expiry {
+			result.Result = Fail
+			result.Err = fmt.Errorf("Signature expired")
+			return result
+		}
+	}
+
+	headerCanon, bodyCanon := Simple, Simple
+	if c, ok := tags["c"]; ok {
+		canon := strings.SplitN(c, "/", 2)
+		headerCanon = canon[0]
+		if len(canon) == 2 {
+			bodyCanon = canon[1]
+		}
+		if !validCanonicalization(headerCanon) || !validCanonicalization(bodyCanon) {
+			result.Err = fmt.Errorf("Unsupported canonicalization %q", c)
+			return result
+		}
+	}
+
+	keyType, err := algorithmKeyType(result.Algorithm)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(result.Signature)
+	if err != nil {
+		result.Err = fmt.Errorf("Malformed b= tag")
+		return result
+	}
+
+	key, status, err := v.lookupKey(result.Selector, result.Domain, keyType)
+	if err != nil {
+		result.Result = status
+		result.Err = err
+		return result
+	}
+
+	// body hash, see https://tools.ietf.org/html/rfc6376#section-3.7
+	body = canonicalBody(body, bodyCanon)
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.Atoi(l)
+		if err != nil || length < 0 {
+			result.Err = fmt.Errorf("Malformed l= tag")
+			return result
+		} else if length > len(body) {
+			result.Result = Fail
+			result.Err = fmt.Errorf("Body is shorter than l=%v", length)
+			return result
+		}
+		body = body[:length]
+	}
+
+	if !bodyHashMatches(body, tags["bh"]) {
+		result.Result = Fail
+		result.Err = fmt.Errorf("Body hash did not verify")
+		return result
+	}
+
+	hash := headerHash(fields, signed, stripSignature(sig.raw), headerCanon)
+
+	if err := verifySignature(key, hash, signature); err != nil {
+		result.Result = Fail
+		result.Err = fmt.Errorf("Signature did not verify")
+		return result
+	}
+
+	result.Result = Pass
+	return result
+}
+
+// algorithmKeyType maps an a= value to the k= key type it needs
+func algorithmKeyType(algorithm string) (string, error) {
+	switch algorithm {
+	case "rsa-sha256":
+		return "rsa", nil
+	case "ed25519-sha256":
+		return "ed25519", nil
+	}
+	return "", fmt.Errorf("Unsupported algorithm %q", algorithm)
+}
+
+// bodyHashMatches compares the hash of a canonicalized body with a bh= value
+func bodyHashMatches(body []byte, bh string) bool {
+	bodyHash := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(bodyHash[:]) == stripWSP(bh)
+}
+
+// verifySignature checks a b= signature over a header hash
+func verifySignature(key crypto.PublicKey, hash, signature []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hash, signature) {
+			return fmt.Errorf("ed25519: verification error")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported key type %T", key)
+}
+
+// lookupKey fetches and parses the public key record, returning the result to
+// report if it can't be used, see https://tools.ietf.org/html/rfc6376#section-3.6
+func (v *Verifier) lookupKey(selector, domain, keyType string) (crypto.PublicKey, string, error) {
+	name := selector + "._domainkey." + domain
+
+	records, err := v.Resolver.LookupTXT(name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && (dnsErr.IsNotFound || !dnsErr.Temporary()) {
+			return nil, PermError, fmt.Errorf("No key for signature at %v", name)
+		}
+		return nil, TempError, fmt.Errorf("Key lookup failed: %v", err)
+	} else if len(records) == 0 {
+		return nil, PermError, fmt.Errorf("No key for signature at %v", name)
+	}
+
+	// multiple strings of a single record are already joined by the resolver
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, PermError, fmt.Errorf("Malformed key record: %v", err)
+	}
+
+	if version, ok := tags["v"]; ok && version != "DKIM1" {
+		return nil, PermError, fmt.Errorf("Unsupported key version %q", version)
+	}
+
+	if k, ok := tags["k"]; ok && k != keyType {
+		return nil, PermError, fmt.Errorf("Key type %q doesn't match the signature", k)
+	} else if !ok && keyType != "rsa" {
+		return nil, PermError, fmt.Errorf("Key type rsa doesn't match the signature")
+	}
+
+	if h, ok := tags["h"]; ok && !containsFold(strings.Split(stripWSP(h), ":"), "sha256") {
+		return nil, PermError, fmt.Errorf("Key doesn't allow sha256")
+	}
+
+	p := stripWSP(tags["p"])
+	if p == "" {
+		return nil, PermError, fmt.Errorf("Key has been revoked")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, PermError, fmt.Errorf("Malformed key data")
+	}
+
+	if keyType == "ed25519" {
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, PermError, fmt.Errorf("Malformed ed25519 key")
+		}
+		return ed25519.PublicKey(raw), "", nil
+	}
+
+	var key *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(raw); err == nil {
+		key, _ = parsed.(*rsa.PublicKey)
+	} else if parsed, err := x509.ParsePKCS1PublicKey(raw); err == nil {
+		key = parsed
+	}
+
+	if key == nil {
+		return nil, PermError, fmt.Errorf("Malformed rsa key")
+	} else if key.N.BitLen() < v.MinRSABits {
+		return nil, PermError, fmt.Errorf("RSA key is too short (%v bits)", key.N.BitLen())
+	}
+
+	return key, "", nil
+}
+
+// stripSignature removes the b= value from a raw DKIM-Signature field, leaving everything else as-is
+func stripSignature(raw string) string {
+	pos := strings.Index(raw, ":") + 1
+	for pos < len(raw) {
+		end := strings.IndexByte(raw[pos:], ';')
+		if end < 0 {
+			end = len(raw) - pos
+		}
+
+		tag := raw[pos : pos+end]
+		if eq := strings.IndexByte(tag, '='); eq >= 0 && strings.TrimSpace(tag[:eq]) == "b" {
+			return raw[:pos+eq+1] + raw[pos+end:]
+		}
+
+		pos += end + 1
+	}
+	return raw
+}
+
+func validCanonicalization(c string) bool {
+	return c == Simple || c == Relaxed
+}
+
+// identityDomain is the domain part of an i= value
+func identityDomain(identity string) string {
+	return identity[strings.LastIndex(identity, "@")+1:]
+}
+
+// isSubdomain checks whether child is the same domain as parent, or a subdomain of it
+func isSubdomain(child, parent string) bool {
+	child, parent = strings.ToLower(child), strings.ToLower(parent)
+	return child == parent || strings.HasSuffix(child, "."+parent)
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package dkim
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeResolver serves TXT records from a map
+type fakeResolver map[string]string
+
+func (r fakeResolver) LookupAddr(addr string) ([]string, error) { return nil, r.notFound(addr) }
+func (r fakeResolver) LookupIP(host string) ([]net.IP, error)   { return nil, r.notFound(host) }
+func (r fakeResolver) LookupMX(name string) ([]*net.MX, error)  { return nil, r.notFound(name) }
+
+func (r fakeResolver) LookupTXT(name string) ([]string, error) {
+	if txt, ok := r[name]; ok {
+		return []string{txt}, nil
+	}
+	return nil, r.notFound(name)
+}
+
+func (r fakeResolver) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	edKey := rfc8463Key()
+
+	resolver := fakeResolver{
+		"rsa._domainkey.football.example.com": "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub),
+		"ed._domainkey.football.example.com":  "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey)),
+	}
+
+	message := rfc8463Message
+	for _, signer := range []*Signer{
+		{Domain: "football.example.com", Selector: "rsa", Key: rsaKey, HeaderCanonicalization: Simple, BodyCanonicalization: Simple},
+		{Domain: "football.example.com", Selector: "ed", Key: edKey, Identity: "joe@football.example.com", Oversign: []string{"From"}},
+	} {
+		value, err := signer.Sign(strings.NewReader(message))
+		if err != nil {
+			t.Fatalf("Couldn't sign message: %v", err)
+		}
+		message = "DKIM-Signature: " + value + "\r\n" + message
+	}
+
+	verifications, err := NewVerifier(resolver).Verify(strings.NewReader(message))
+	if err != nil {
+		t.Fatalf("Couldn't verify message: %v", err)
+	}
+
+	if len(verifications) != 2 {
+		t.Fatalf("Expected two verifications, got: %v", len(verifications))
+	}
+
+	for _, v := range verifications {
+		if v.Result != Pass {
+			t.Errorf("Signature by %v should pass, got: %v (%v)", v.Selector, v.Result, v.Err)
+		}
+	}
+
+	// any change to the signed content has to break both signatures
+	tampered := strings.Replace(message, "hungry", "thirsty", 1)
+	verifications, _ = NewVerifier(resolver).Verify(strings.NewReader(tampered))
+	for _, v := range verifications {
+		if v.Result != Fail {
+			t.Errorf("Tampered body should fail, got: %v (%v)", v.Result, v.Err)
+		}
+	}
+
+	tampered = strings.Replace(message, "Subject: Is dinner ready?", "Subject: Is lunch ready?", 1)
+	verifications, _ = NewVerifier(resolver).Verify(strings.NewReader(tampered))
+	for _, v := range verifications {
+		if v.Result != Fail {
+			t.Errorf("Tampered header should fail, got: %v (%v)", v.Result, v.Err)
+		}
+	}
+
+	// the oversigned From can't be added to
+	tampered = "From: someone@else.example\r\n" + message
+	verifications, _ = NewVerifier(resolver).Verify(strings.NewReader(tampered))
+	if verifications[0].Result != Fail {
+		t.Errorf("Extra From header should break the oversigned signature, got: %v", verifications[0].Result)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	signer := &Signer{Domain: "football.example.com", Selector: "missing", Key: rfc8463Key()}
+	value, err := signer.Sign(strings.NewReader(rfc8463Message))
+	if err != nil {
+		t.Fatalf("Couldn't sign message: %v", err)
+	}
+
+	for _, test := range []struct {
+		header string
+		result string
+	}{
+		{"DKIM-Signature: " + value, PermError},
+		{"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=x; h=to; bh=; b=", PermError},
+		{"DKIM-Signature: v=1; a=rsa-sha256; a=rsa-sha256", PermError},
+	} {
+		verifications, _ := NewVerifier(fakeResolver{}).Verify(strings.NewReader(test.header + "\r\n" + rfc8463Message))
+		if len(verifications) != 1 || verifications[0].Result != test.result {
+			t.Errorf("Expected %v for %q, got: %+v", test.result, test.header, verifications[0])
+		}
+	}
+
+	results := AuthResults(nil)
+	if len(results) != 1 || results[0].String() != "dkim=none" {
+		t.Errorf("Unsigned messages should be reported as dkim=none, got: %v", results)
+	}
+}
+
+func TestStripSignature(t *testing.T) {
+	raw := "DKIM-Signature: v=1; bh=abc;\r\n b=def\r\n ghi; d=example.com\r\n"
+	if got := stripSignature(raw); got != "DKIM-Signature: v=1; bh=abc;\r\n b=; d=example.com\r\n" {
+		t.Errorf("Wrong stripped signature, got: %q", got)
+	}
+}
+
+// the signed example from https://tools.ietf.org/html/rfc8463#appendix-A.3
+func TestVerifyRFC8463(t *testing.T) {
+	signature := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n"
+
+	resolver := fakeResolver{
+		"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+	}
+
+	verifications, err := NewVerifier(resolver).Verify(strings.NewReader(signature + rfc8463Message))
+	if err != nil {
+		t.Fatalf("Couldn't verify message: %v", err)
+	}
+
+	if len(verifications) != 1 || verifications[0].Result != Pass {
+		t.Fatalf("RFC 8463 example should verify, got: %+v", verifications[0])
+	}
+
+	want := `dkim=pass header.a=ed25519-sha256 header.b=/gCrinpc header.d=football.example.com header.i=@football.example.com header.s=brisbane`
+	if got := verifications[0].AuthResult().String(); got != want {
+		t.Errorf("Wrong Authentication-Results entry, want: %v, got: %v", want, got)
+	}
+}
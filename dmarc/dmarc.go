@@ -0,0 +1,337 @@
+// Package dmarc evaluates Domain-based Message Authentication, Reporting and Conformance
+// policies as defined in RFC 7489, on top of the results of SPF and DKIM checks.
+package dmarc
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hownowstephen/email"
+)
+
+// Results of an evaluation, see https://tools.ietf.org/html/rfc7489#section-11.2
+const (
+	Pass      = "pass"
+	Fail      = "fail"
+	None      = "none"
+	TempError = "temperror"
+	PermError = "permerror"
+)
+
+// Policies a domain can request for mail that fails, see https://tools.ietf.org/html/rfc7489#section-6.3
+const (
+	PolicyNone       = "none"
+	PolicyQuarantine = "quarantine"
+	PolicyReject     = "reject"
+)
+
+// Alignment modes for the adkim & aspf tags
+const (
+	Relaxed = "r"
+	Strict  = "s"
+)
+
+// Record is a parsed DMARC policy record
+type Record struct {
+	// Policy applies to the domain itself, SubdomainPolicy to its subdomains when
+	// the record was found at the organizational domain
+	Policy          string
+	SubdomainPolicy string
+
+	// Percent of failing messages the policy applies to, the rest get the next weaker policy
+	Percent int
+
+	// DKIMAlignment & SPFAlignment are either Relaxed or Strict
+	DKIMAlignment string
+	SPFAlignment  string
+}
+
+// ParseRecord parses the text of a _dmarc TXT record, see https://tools.ietf.org/html/rfc7489#section-6.4
+func ParseRecord(txt string) (*Record, error) {
+	record := &Record{
+		Percent:       100,
+		DKIMAlignment: Relaxed,
+		SPFAlignment:  Relaxed,
+	}
+
+	tags := strings.Split(txt, ";")
+	if version := strings.Fields(strings.Replace(tags[0], "=", " ", 1)); len(version) != 2 || version[0] != "v" || version[1] != "DMARC1" {
+		return nil, fmt.Errorf("Not a DMARC1 record")
+	}
+
+	for _, tag := range tags[1:] {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+
+		eq := strings.IndexByte(tag, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("Malformed tag %q", tag)
+		}
+		name, value := strings.TrimSpace(tag[:eq]), strings.TrimSpace(tag[eq+1:])
+
+		switch name {
+		case "p", "sp":
+			value = strings.ToLower(value)
+			if value != PolicyNone && value != PolicyQuarantine && value != PolicyReject {
+				return nil, fmt.Errorf("Unknown policy %q", value)
+			}
+			if name == "p" {
+				record.Policy = value
+			} else {
+				record.SubdomainPolicy = value
+			}
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, fmt.Errorf("Invalid pct=%v", value)
+			}
+			record.Percent = pct
+		case "adkim", "aspf":
+			value = strings.ToLower(value)
+			if value != Relaxed && value != Strict {
+				return nil, fmt.Errorf("Invalid %v=%v", name, value)
+			}
+			if name == "adkim" {
+				record.DKIMAlignment = value
+			} else {
+				record.SPFAlignment = value
+			}
+		}
+		// reporting tags (rua, ruf, fo, rf, ri) aren't used when evaluating
+	}
+
+	if record.Policy == "" {
+		return nil, fmt.Errorf("Missing required tag p=")
+	}
+	if record.SubdomainPolicy == "" {
+		record.SubdomainPolicy = record.Policy
+	}
+
+	return record, nil
+}
+
+// Evaluation is the outcome of checking a message against its author domain's policy
+type Evaluation struct {
+	// Domain is the RFC5322.From domain the policy was looked up for
+	Domain string
+
+	// Result is one of Pass, Fail, None, TempError or PermError, with Err explaining anything but a Pass
+	Result string
+	Err    error
+
+	// Record is the policy that was found, if any
+	Record *Record
+
+	// Disposition is the policy to apply to the message after pct sampling,
+	// PolicyNone unless the message failed
+	Disposition string
+}
+
+// AuthResult converts the evaluation into an Authentication-Results entry,
+// see https://tools.ietf.org/html/rfc7489#section-11.2
+func (e *Evaluation) AuthResult() *email.AuthResult {
+	r := &email.AuthResult{
+		Method:     "dmarc",
+		Result:     e.Result,
+		Properties: make(map[string]string),
+	}
+	if e.Err != nil && e.Result != Pass {
+		r.Reason = e.Err.Error()
+	}
+	if e.Domain != "" {
+		r.Properties["header.from"] = e.Domain
+	}
+	if e.Record != nil {
+		r.Properties["policy.dmarc"] = e.Disposition
+	}
+	return r
+}
+
+// Checker evaluates DMARC policies
+type Checker struct {
+	// Resolver looks up the policy records
+	Resolver email.Resolver
+
+	// Sample decides whether a failing message falls within a policy's pct=,
+	// the default picks at random
+	Sample func(percent int) bool
+}
+
+// NewChecker creates a checker that samples pct= at random
+func NewChecker(resolver email.Resolver) *Checker {
+	return &Checker{Resolver: resolver}
+}
+
+// CheckMessage evaluates the policy for the author of m, using the SPF and DKIM
+// results already recorded in m.AuthResults
+func (c *Checker) CheckMessage(m *email.Message) *Evaluation {
+	if m.From == nil {
+		return &Evaluation{Result: PermError, Err: fmt.Errorf("Message has no From address"), Disposition: PolicyNone}
+	}
+	return c.Check(m.From.Address, m.AuthResults)
+}
+
+// Check evaluates the policy for the author address from, given the results of SPF and
+// DKIM checks, see https://tools.ietf.org/html/rfc7489#section-6.6
+func (c *Checker) Check(from string, results []*email.AuthResult) *Evaluation {
+	domain := strings.ToLower(strings.TrimSuffix(from[strings.LastIndex(from, "@")+1:], "."))
+	e := &Evaluation{Domain: domain, Result: None, Disposition: PolicyNone}
+
+	if domain == "" || !strings.Contains(from, "@") {
+		e.Result = PermError
+		e.Err = fmt.Errorf("Invalid author address %q", from)
+		return e
+	}
+
+	record, subdomain, err := c.lookupPolicy(domain)
+	if err != nil {
+		e.Result = TempError
+		e.Err = err
+		return e
+	} else if record == nil {
+		e.Err = fmt.Errorf("No policy for %v", domain)
+		return e
+	}
+	e.Record = record
+
+	if alignedPass(domain, record, results) {
+		e.Result = Pass
+		return e
+	}
+
+	e.Result = Fail
+	e.Err = fmt.Errorf("No aligned SPF or DKIM pass for %v", domain)
+
+	policy := record.Policy
+	if subdomain {
+		policy = record.SubdomainPolicy
+	}
+	e.Disposition = c.sample(policy, record.Percent)
+
+	return e
+}
+
+// lookupPolicy finds the record for domain, falling back to its organizational domain,
+// see https://tools.ietf.org/html/rfc7489#section-6.6.3. subdomain is true when the
+// record came from the organizational domain
+func (c *Checker) lookupPolicy(domain string) (*Record, bool, error) {
+	record, err := c.lookupRecord(domain)
+	if record != nil || err != nil {
+		return record, false, err
+	}
+
+	org := OrganizationalDomain(domain)
+	if org == domain {
+		return nil, false, nil
+	}
+
+	record, err = c.lookupRecord(org)
+	return record, true, err
+}
+
+// lookupRecord fetches the record at _dmarc.domain, records that don't parse are ignored
+func (c *Checker) lookupRecord(domain string) (*Record, error) {
+	txts, err := c.Resolver.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && (dnsErr.IsNotFound || !dnsErr.Temporary()) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Policy lookup failed: %v", err)
+	}
+
+	var found *Record
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=DMARC1") {
+			continue
+		}
+		if found != nil {
+			// more than one record means there is no usable policy
+			return nil, nil
+		}
+		if record, err := ParseRecord(txt); err == nil {
+			found = record
+		}
+	}
+	return found, nil
+}
+
+// sample applies pct=, messages outside the sample get the next weaker policy,
+// see https://tools.ietf.org/html/rfc7489#section-6.6.4
+func (c *Checker) sample(policy string, percent int) string {
+	if percent >= 100 || policy == PolicyNone {
+		return policy
+	}
+
+	sampled := false
+	if c.Sample != nil {
+		sampled = c.Sample(percent)
+	} else {
+		sampled = rand.Intn(100) < percent
+	}
+	if sampled {
+		return policy
+	}
+
+	if policy == PolicyReject {
+		return PolicyQuarantine
+	}
+	return PolicyNone
+}
+
+// alignedPass looks for an SPF or DKIM pass whose domain aligns with the author domain
+func alignedPass(domain string, record *Record, results []*email.AuthResult) bool {
+	for _, r := range results {
+		if r.Result != Pass {
+			continue
+		}
+
+		switch r.Method {
+		case "dkim":
+			if Aligned(domain, r.Properties["header.d"], record.DKIMAlignment) {
+				return true
+			}
+		case "spf":
+			identity := r.Properties["smtp.mailfrom"]
+			if identity == "" {
+				identity = r.Properties["smtp.helo"]
+			}
+			if Aligned(domain, identity[strings.LastIndex(identity, "@")+1:], record.SPFAlignment) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Aligned checks whether an authenticated domain matches the author domain, exactly in
+// Strict mode or by organizational domain in Relaxed mode, see https://tools.ietf.org/html/rfc7489#section-3.1
+func Aligned(author, authenticated, mode string) bool {
+	author = strings.ToLower(strings.TrimSuffix(author, "."))
+	authenticated = strings.ToLower(strings.TrimSuffix(authenticated, "."))
+
+	if authenticated == "" {
+		return false
+	}
+	if mode == Strict {
+		return author == authenticated
+	}
+	return OrganizationalDomain(author) == OrganizationalDomain(authenticated)
+}
+
+// Disposition is the policy a handler should apply to a message that was checked by
+// smtpd, one of PolicyNone, PolicyQuarantine or PolicyReject
+func Disposition(m *email.Message) string {
+	for _, r := range m.AuthResults {
+		if r.Method == "dmarc" && r.Result == Fail {
+			if policy, ok := r.Properties["policy.dmarc"]; ok {
+				return policy
+			}
+		}
+	}
+	return PolicyNone
+}
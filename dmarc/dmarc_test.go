@@ -0,0 +1,147 @@
+package dmarc
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email"
+)
+
+// fakeResolver serves TXT records from a map
+type fakeResolver map[string]string
+
+func (r fakeResolver) LookupAddr(addr string) ([]string, error) { return nil, r.notFound(addr) }
+func (r fakeResolver) LookupIP(host string) ([]net.IP, error)   { return nil, r.notFound(host) }
+func (r fakeResolver) LookupMX(name string) ([]*net.MX, error)  { return nil, r.notFound(name) }
+
+func (r fakeResolver) LookupTXT(name string) ([]string, error) {
+	if txt, ok := r[name]; ok {
+		if txt == "timeout" {
+			return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+		}
+		return []string{txt}, nil
+	}
+	return nil, r.notFound(name)
+}
+
+func (r fakeResolver) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	for domain, want := range map[string]string{
+		"example.com":                "example.com",
+		"mail.example.com":           "example.com",
+		"a.b.example.co.uk":          "example.co.uk",
+		"co.uk":                      "co.uk",
+		"Mail.Example.COM.":          "example.com",
+		"foo.bar.example.ck":         "bar.example.ck",
+		"www.ck":                     "www.ck",
+		"a.www.ck":                   "www.ck",
+		"project.github.io":          "project.github.io",
+		"mail.example.unlisted":      "example.unlisted",
+		"localhost":                  "localhost",
+		"victim.com.tr":              "victim.com.tr",
+		"mail.victim.com.tr":         "victim.com.tr",
+		"com.tr":                     "com.tr",
+		"mail.example.com.ar":        "example.com.ar",
+		"mail.example.co.il":         "example.co.il",
+		"mail.example.xn--55qx5d.cn": "example.xn--55qx5d.cn",
+	} {
+		if got := OrganizationalDomain(domain); got != want {
+			t.Errorf("Wrong organizational domain for %v, want: %v, got: %v", domain, want, got)
+		}
+	}
+}
+
+func TestLoadPublicSuffixList(t *testing.T) {
+	defer LoadPublicSuffixList(strings.NewReader(bundledSuffixes))
+
+	if err := LoadPublicSuffixList(strings.NewReader("// test\ncom\nexample.com\n")); err != nil {
+		t.Fatalf("Couldn't load list: %v", err)
+	}
+	if got := OrganizationalDomain("a.b.example.com"); got != "b.example.com" {
+		t.Errorf("Loaded list should be used, got: %v", got)
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	record, err := ParseRecord("v=DMARC1; p=reject; sp=none; pct=20; adkim=s; rua=mailto:dmarc@example.com")
+	if err != nil {
+		t.Fatalf("Couldn't parse record: %v", err)
+	}
+	if *record != (Record{Policy: PolicyReject, SubdomainPolicy: PolicyNone, Percent: 20, DKIMAlignment: Strict, SPFAlignment: Relaxed}) {
+		t.Errorf("Wrong record, got: %+v", record)
+	}
+
+	for _, txt := range []string{"", "v=DMARC2; p=none", "p=none; v=DMARC1", "v=DMARC1", "v=DMARC1; p=maybe", "v=DMARC1; p=none; pct=101"} {
+		if _, err := ParseRecord(txt); err == nil {
+			t.Errorf("Record %q should be refused", txt)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	resolver := fakeResolver{
+		"_dmarc.example.com":     "v=DMARC1; p=reject; sp=quarantine",
+		"_dmarc.strict.example":  "v=DMARC1; p=quarantine; adkim=s; aspf=s",
+		"_dmarc.sampled.example": "v=DMARC1; p=reject; pct=0",
+		"_dmarc.broken.example":  "timeout",
+	}
+	checker := NewChecker(resolver)
+
+	dkimPass := func(d string) *email.AuthResult {
+		return &email.AuthResult{Method: "dkim", Result: Pass, Properties: map[string]string{"header.d": d}}
+	}
+	spfPass := func(sender string) *email.AuthResult {
+		return &email.AuthResult{Method: "spf", Result: Pass, Properties: map[string]string{"smtp.mailfrom": sender}}
+	}
+
+	for _, test := range []struct {
+		from        string
+		results     []*email.AuthResult
+		result      string
+		disposition string
+	}{
+		{"joe@example.com", []*email.AuthResult{dkimPass("example.com")}, Pass, PolicyNone},
+		{"joe@example.com", []*email.AuthResult{dkimPass("mail.example.com")}, Pass, PolicyNone},
+		{"joe@example.com", []*email.AuthResult{spfPass("bounce@bounces.example.com")}, Pass, PolicyNone},
+		{"joe@example.com", []*email.AuthResult{dkimPass("example.net"), spfPass("bounce@example.net")}, Fail, PolicyReject},
+		{"joe@example.com", []*email.AuthResult{{Method: "dkim", Result: Fail, Properties: map[string]string{"header.d": "example.com"}}}, Fail, PolicyReject},
+		{"joe@mail.example.com", nil, Fail, PolicyQuarantine},
+		{"joe@strict.example", []*email.AuthResult{dkimPass("strict.example")}, Pass, PolicyNone},
+		{"joe@strict.example", []*email.AuthResult{dkimPass("mail.strict.example"), spfPass("x@mail.strict.example")}, Fail, PolicyQuarantine},
+		{"joe@sampled.example", nil, Fail, PolicyQuarantine},
+		{"joe@nopolicy.example", nil, None, PolicyNone},
+		{"joe@broken.example", nil, TempError, PolicyNone},
+		{"nobody", nil, PermError, PolicyNone},
+	} {
+		e := checker.Check(test.from, test.results)
+		if e.Result != test.result || e.Disposition != test.disposition {
+			t.Errorf("Wrong verdict for %v %v, want: %v/%v, got: %v/%v (%v)",
+				test.from, test.results, test.result, test.disposition, e.Result, e.Disposition, e.Err)
+		}
+	}
+}
+
+func TestDisposition(t *testing.T) {
+	checker := NewChecker(fakeResolver{"_dmarc.example.com": "v=DMARC1; p=quarantine"})
+
+	m := &email.Message{}
+	if Disposition(m) != PolicyNone {
+		t.Errorf("Unchecked messages should have no disposition")
+	}
+
+	e := checker.Check("joe@example.com", nil)
+	m.AuthResults = append(m.AuthResults, e.AuthResult())
+
+	if got := Disposition(m); got != PolicyQuarantine {
+		t.Errorf("Expected the message to be quarantined, got: %v", got)
+	}
+
+	want := `dmarc=fail reason="No aligned SPF or DKIM pass for example.com" header.from=example.com policy.dmarc=quarantine`
+	if got := e.AuthResult().String(); got != want {
+		t.Errorf("Wrong Authentication-Results entry, want: %v, got: %v", want, got)
+	}
+}
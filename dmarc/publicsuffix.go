@@ -0,0 +1,116 @@
+package dmarc
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/hownowstephen/email"
+)
+
+// bundledSuffixes is a copy of https://publicsuffix.org/list/public_suffix_list.dat, call
+// LoadPublicSuffixList to replace it with a newer version
+//
+//go:embed public_suffix_list.dat
+var bundledSuffixes string
+
+// suffixList holds the parsed rules, see https://github.com/publicsuffix/list/wiki/Format
+type suffixList struct {
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+var (
+	suffixes     *suffixList
+	suffixesLock sync.RWMutex
+)
+
+func init() {
+	suffixes, _ = parseSuffixList(strings.NewReader(bundledSuffixes))
+}
+
+// LoadPublicSuffixList replaces the bundled public suffix list, r should
+// supply the contents of public_suffix_list.dat
+func LoadPublicSuffixList(r io.Reader) error {
+	list, err := parseSuffixList(r)
+	if err != nil {
+		return err
+	}
+
+	suffixesLock.Lock()
+	defer suffixesLock.Unlock()
+	suffixes = list
+	return nil
+}
+
+func parseSuffixList(r io.Reader) (*suffixList, error) {
+	list := &suffixList{
+		rules:      make(map[string]bool),
+		wildcards:  make(map[string]bool),
+		exceptions: make(map[string]bool),
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+
+		rule, kind := fields[0], list.rules
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			rule, kind = rule[1:], list.exceptions
+		case strings.HasPrefix(rule, "*."):
+			rule, kind = rule[2:], list.wildcards
+		}
+
+		// internationalized rules are listed as U-labels, domains reach us as A-labels
+		rule, err := email.ToASCII(rule)
+		if err != nil {
+			continue
+		}
+		kind[rule] = true
+	}
+
+	return list, scanner.Err()
+}
+
+// publicSuffix finds the longest public suffix of domain, unlisted TLDs count as public suffixes
+func (l *suffixList) publicSuffix(domain string) string {
+	labels := strings.Split(domain, ".")
+
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		parent := strings.Join(labels[i+1:], ".")
+
+		if l.exceptions[candidate] {
+			return parent
+		}
+		if l.rules[candidate] || (i+1 < len(labels) && l.wildcards[parent]) {
+			return candidate
+		}
+	}
+
+	return labels[len(labels)-1]
+}
+
+// OrganizationalDomain returns the registered domain that domain belongs to (the public
+// suffix plus one label), see https://tools.ietf.org/html/rfc7489#section-3.2
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	suffixesLock.RLock()
+	suffix := suffixes.publicSuffix(domain)
+	suffixesLock.RUnlock()
+
+	if suffix == domain {
+		return domain
+	}
+
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	return rest[strings.LastIndex(rest, ".")+1:] + "." + suffix
+}
@@ -0,0 +1,292 @@
+// Package dnsbl looks up clients in DNS blocklists & allowlists, by their IP address
+// (like zen.spamhaus.org or list.dnswl.org) or domain names (like dbl.spamhaus.org),
+// see https://tools.ietf.org/html/rfc5782
+package dnsbl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+// DefaultCacheTTL is how long answers are cached by NewChecker, the resolver doesn't
+// tell the record TTLs
+const DefaultCacheTTL = 5 * time.Minute
+
+// maxReason is how much of a list's TXT record is kept as the reason
+const maxReason = 200
+
+// List is a DNS blocklist or allowlist
+type List struct {
+	// Zone is the list's DNS zone, e.g. "zen.spamhaus.org"
+	Zone string
+
+	// Weight is added to the score when a client is listed. Give allowlists a negative weight
+	Weight float64
+
+	// Domains is set for lists of domain names, which are queried with the HELO & sender
+	// domains rather than the client address
+	Domains bool
+
+	// Codes are the answers that count as listed, e.g. 127.0.0.2 for spam sources. Empty
+	// counts any answer in 127.0.0.0/8, except the 127.255.255.0/24 errors some lists
+	// return to resolvers they refuse to serve
+	Codes []net.IP
+}
+
+// counts reports whether an answer of the list means the name is listed
+func (l *List) counts(answer net.IP) bool {
+	if len(l.Codes) > 0 {
+		for _, code := range l.Codes {
+			if code.Equal(answer) {
+				return true
+			}
+		}
+		return false
+	}
+	answer = answer.To4()
+	return answer != nil && answer[0] == 127 && !(answer[1] == 255 && answer[2] == 255)
+}
+
+// Listing is a client address or domain found in a list
+type Listing struct {
+	List *List
+
+	// Name is what was listed, the address or domain
+	Name string
+
+	// Codes are the list's answers, which say why on some lists
+	Codes []net.IP
+
+	// Reason is the explanation the list gives in its TXT record, if any, cut down to
+	// printable ASCII & 200 characters
+	Reason string
+}
+
+// Result is the outcome of looking a client up in all the lists
+type Result struct {
+	// Score is the sum of the weights of the lists the client is in
+	Score float64
+
+	// Listings are the lists the client is in, in the order of Checker.Lists
+	Listings []*Listing
+}
+
+// Zones lists the zones of the lists the client is in
+func (r *Result) Zones() []string {
+	var zones []string
+	for _, l := range r.Listings {
+		zones = append(zones, l.List.Zone)
+	}
+	return zones
+}
+
+// Merge adds the listings of other to the result
+func (r *Result) Merge(other *Result) {
+	r.Score += other.Score
+	r.Listings = append(r.Listings, other.Listings...)
+}
+
+// Checker looks clients up in a set of lists
+type Checker struct {
+	Resolver email.Resolver
+	Lists    []*List
+
+	// CacheTTL is how long answers are cached, zero disables the cache
+	CacheTTL time.Duration
+
+	// Now tells the time, time.Now if nil
+	Now func() time.Time
+
+	lock  sync.Mutex
+	cache map[string]*answer
+}
+
+// answer is a cached lookup, ips is empty when the name isn't in the zone. The lists
+// sharing a zone count different answers, so they're all kept
+type answer struct {
+	ips     []net.IP
+	reason  string
+	expires time.Time
+}
+
+// NewChecker creates a checker for the given lists, with the default cache
+func NewChecker(resolver email.Resolver, lists ...*List) *Checker {
+	return &Checker{
+		Resolver: resolver,
+		Lists:    lists,
+		CacheTTL: DefaultCacheTTL,
+	}
+}
+
+func (c *Checker) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// ReverseIP is the name an address is looked up as in a list: the octets of an IPv4
+// address, or the nibbles of an IPv6 one, in reverse order
+func ReverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%v.%v.%v.%v", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hex[ip16[i]&0xf]), string(hex[ip16[i]>>4]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// CheckIP looks the client address up in the address lists
+func (c *Checker) CheckIP(ip net.IP) *Result {
+	name := ReverseIP(ip)
+	if name == "" {
+		return &Result{}
+	}
+	return c.check(false, map[string]string{ip.String(): name})
+}
+
+// CheckDomains looks domains (like the HELO name & the sender's domain) up in the domain
+// lists. Address literals & names without a dot are left out, and each domain only counts
+// once per list
+func (c *Checker) CheckDomains(domains ...string) *Result {
+	names := make(map[string]string)
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if !strings.Contains(domain, ".") || strings.HasPrefix(domain, "[") || net.ParseIP(domain) != nil {
+			continue
+		}
+		names[domain] = domain
+	}
+	return c.check(true, names)
+}
+
+// check queries each list of the kind with names, which map what's checked to how
+// it's looked up
+func (c *Checker) check(domains bool, names map[string]string) *Result {
+	var lists []*List
+	for _, list := range c.Lists {
+		if list.Domains == domains {
+			lists = append(lists, list)
+		}
+	}
+
+	listings := make([][]*Listing, len(lists))
+	var wg sync.WaitGroup
+	for i, list := range lists {
+		for name, query := range names {
+			wg.Add(1)
+			go func(i int, list *List, name, query string) {
+				defer wg.Done()
+				if listing := c.lookup(list, name, query+"."+list.Zone); listing != nil {
+					c.lock.Lock()
+					listings[i] = append(listings[i], listing)
+					c.lock.Unlock()
+				}
+			}(i, list, name, query)
+		}
+	}
+	wg.Wait()
+
+	result := &Result{}
+	for i, list := range lists {
+		if len(listings[i]) > 0 {
+			// a list counts once, however many of the names are in it
+			result.Score += list.Weight
+			result.Listings = append(result.Listings, listings[i]...)
+		}
+	}
+	return result
+}
+
+// lookup queries a list for a name, going through the cache
+func (c *Checker) lookup(list *List, name, query string) *Listing {
+	a := c.cached(query)
+	if a == nil {
+		ips, err := c.Resolver.LookupIP(query)
+		if dnsErr, ok := err.(*net.DNSError); err != nil && !(ok && dnsErr.IsNotFound) {
+			// a list that can't be reached lists nobody, and isn't cached
+			return nil
+		}
+
+		a = &answer{ips: ips, expires: c.now().Add(c.CacheTTL)}
+		if len(ips) > 0 {
+			if txt, err := c.Resolver.LookupTXT(query); err == nil {
+				a.reason = cleanReason(strings.Join(txt, " "))
+			}
+		}
+		c.store(query, a)
+	}
+
+	var codes []net.IP
+	for _, ip := range a.ips {
+		if list.counts(ip) {
+			codes = append(codes, ip)
+		}
+	}
+	if len(codes) == 0 {
+		return nil
+	}
+	return &Listing{List: list, Name: name, Codes: codes, Reason: a.reason}
+}
+
+// cleanReason makes a TXT record safe to show in an SMTP reply: printable ASCII only, so
+// a list can't add lines to the reply, and not too long
+func cleanReason(txt string) string {
+	txt = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return ' '
+		}
+		return r
+	}, txt)
+	txt = strings.Join(strings.Fields(txt), " ")
+	if len(txt) > maxReason {
+		txt = txt[:maxReason]
+	}
+	return txt
+}
+
+func (c *Checker) cached(query string) *answer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if a, ok := c.cache[query]; ok && c.now().Before(a.expires) {
+		return a
+	}
+	return nil
+}
+
+func (c *Checker) store(query string, a *answer) {
+	if c.CacheTTL <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cache == nil {
+		c.cache = make(map[string]*answer)
+	}
+	// drop what's expired now and then, so the cache doesn't grow for good
+	if len(c.cache) >= 1024 {
+		now := c.now()
+		for key, cached := range c.cache {
+			if !now.Before(cached.expires) {
+				delete(c.cache, key)
+			}
+		}
+	}
+	c.cache[query] = a
+}
@@ -0,0 +1,122 @@
+package dnsbl
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers A & TXT lookups from maps, counting the A lookups
+type fakeResolver struct {
+	lock    sync.Mutex
+	ip      map[string][]net.IP
+	txt     map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupAddr(addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lookups++
+	if host == "2.0.0.127.broken.example" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	if ips, ok := r.ip[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestReverseIP(t *testing.T) {
+
+	tests := map[string]string{
+		"192.0.2.99":  "99.2.0.192",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+	}
+	for ip, want := range tests {
+		if got := ReverseIP(net.ParseIP(ip)); got != want {
+			t.Errorf("Expected %v for %v, got: %v", want, ip, got)
+		}
+	}
+}
+
+func TestChecker(t *testing.T) {
+
+	resolver := &fakeResolver{
+		ip: map[string][]net.IP{
+			"2.0.0.127.bl.example":      {net.ParseIP("127.0.0.2")},
+			"2.0.0.127.pbl.example":     {net.ParseIP("127.0.0.10")},
+			"2.0.0.127.wl.example":      {net.ParseIP("127.0.15.1")},
+			"2.0.0.127.refused.example": {net.ParseIP("127.255.255.254")},
+			"spam.example.dbl.example":  {net.ParseIP("127.0.1.2")},
+		},
+		txt: map[string][]string{
+			"2.0.0.127.bl.example":  {"Listed for spamming"},
+			"2.0.0.127.pbl.example": {"Dynamic\r\n250 OK\r\n", strings.Repeat("x", 300)},
+		},
+	}
+
+	spam := &List{Zone: "bl.example", Weight: 5, Codes: []net.IP{net.ParseIP("127.0.0.2")}}
+	policy := &List{Zone: "pbl.example", Weight: 1}
+	// a code list for the same zone as spam, answering differently
+	exploits := &List{Zone: "bl.example", Weight: 10, Codes: []net.IP{net.ParseIP("127.0.0.4")}}
+	allow := &List{Zone: "wl.example", Weight: -3}
+	refused := &List{Zone: "refused.example", Weight: 100}
+	broken := &List{Zone: "broken.example", Weight: 100}
+	domains := &List{Zone: "dbl.example", Weight: 4, Domains: true}
+
+	checker := NewChecker(resolver, spam, policy, exploits, allow, refused, broken, domains)
+
+	result := checker.CheckIP(net.ParseIP("127.0.0.2"))
+	if result.Score != 3 {
+		t.Errorf("Expected a score of 3, got: %v", result.Score)
+	}
+	if zones := result.Zones(); !reflect.DeepEqual(zones, []string{"bl.example", "pbl.example", "wl.example"}) {
+		t.Errorf("Expected the address to be in bl, pbl & wl, got: %v", zones)
+	}
+	if result.Listings[0].Reason != "Listed for spamming" {
+		t.Errorf("Expected the list's reason, got: %q", result.Listings[0].Reason)
+	}
+	// reasons end up in replies, so they can't break lines or go on forever
+	if reason := result.Listings[1].Reason; !strings.HasPrefix(reason, "Dynamic 250 OK xxx") || len(reason) != 200 {
+		t.Errorf("Expected the reason to be cleaned up, got: %q", reason)
+	}
+
+	// answers are cached, apart from the failed lookup
+	lookups := resolver.lookups
+	checker.CheckIP(net.ParseIP("127.0.0.2"))
+	if resolver.lookups-lookups != 1 {
+		t.Errorf("Expected only the failed lookup to be repeated, got: %v lookups", resolver.lookups-lookups)
+	}
+
+	result = checker.CheckDomains("Spam.Example.", "[192.0.2.1]", "localhost", "spam.example", "clean.example")
+	if result.Score != 4 || len(result.Listings) != 1 || result.Listings[0].Name != "spam.example" {
+		t.Errorf("Expected spam.example to be listed once, got: %+v", result)
+	}
+
+	// expired answers are looked up again
+	checker.Now = func() time.Time { return time.Now().Add(DefaultCacheTTL) }
+	lookups = resolver.lookups
+	checker.CheckDomains("spam.example")
+	if resolver.lookups-lookups != 1 {
+		t.Errorf("Expected the expired answer to be looked up again, got: %v lookups", resolver.lookups-lookups)
+	}
+}
@@ -0,0 +1,335 @@
+// Package dsn builds delivery status notifications (RFC 3464) for messages received
+// with the DSN extension parameters of RFC 3461, recorded in email.Envelope.
+package dsn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+// Actions a recipient's status can report, see https://tools.ietf.org/html/rfc3464#section-2.3.3
+const (
+	Delivered = "delivered"
+	Delayed   = "delayed"
+	Failed    = "failed"
+	Relayed   = "relayed"
+	Expanded  = "expanded"
+)
+
+// Status is the delivery outcome for one recipient of a message
+type Status struct {
+	// Recipient is the forward-path, as given in the envelope
+	Recipient string
+
+	// Action is one of Delivered, Delayed, Failed, Relayed or Expanded
+	Action string
+
+	// Code is the enhanced status code, e.g. "5.1.1", see https://tools.ietf.org/html/rfc3463
+	Code string
+
+	// Diagnostic is the reply of the remote server, e.g. "550 5.1.1 No such user", if there was one
+	Diagnostic string
+
+	// RemoteMTA is the server that gave the Diagnostic
+	RemoteMTA string
+
+	// LastAttempt is the time of the last delivery attempt, and RetryUntil the
+	// time the server will give up on a Delayed recipient
+	LastAttempt time.Time
+	RetryUntil  time.Time
+}
+
+// condition maps the action to the NOTIFY= condition that asks for it
+func (s *Status) condition() string {
+	switch s.Action {
+	case Failed:
+		return email.NotifyFailure
+	case Delayed:
+		return email.NotifyDelay
+	}
+	return email.NotifySuccess
+}
+
+// Generator builds notifications on behalf of a reporting MTA
+type Generator struct {
+	// ReportingMTA is the hostname of the server generating the notifications
+	ReportingMTA string
+
+	// From is the author of the notifications, MAILER-DAEMON@ReportingMTA by default
+	From string
+
+	// Now is the clock used for the Date header, time.Now by default
+	Now func() time.Time
+}
+
+// NewGenerator creates a generator reporting as hostname
+func NewGenerator(hostname string) *Generator {
+	return &Generator{ReportingMTA: hostname}
+}
+
+// Generate builds the notification to send back to the sender of m about statuses. The
+// recipients' NOTIFY= parameters decide which statuses are reported, Generate returns nil
+// when there is nothing to report or no one to report to (e.g. m was itself a bounce).
+// The returned message has its Envelope set up for sending with a null reverse-path
+func (g *Generator) Generate(m *email.Message, statuses []*Status) (*email.Message, error) {
+	envelope := m.Envelope
+	if envelope == nil {
+		return nil, fmt.Errorf("Message has no envelope")
+	}
+	if envelope.From == "" {
+		// https://tools.ietf.org/html/rfc3461#section-6.2
+		return nil, nil
+	}
+
+	var (
+		reported   []*Status
+		recipients []*email.Recipient
+	)
+	for _, status := range statuses {
+		recipient := findRecipient(envelope, status.Recipient)
+		if recipient.Notifies(status.condition()) {
+			reported = append(reported, status)
+			recipients = append(recipients, recipient)
+		}
+	}
+	if len(reported) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if g.Now != nil {
+		now = g.Now()
+	}
+	from := g.From
+	if from == "" {
+		from = "MAILER-DAEMON@" + g.ReportingMTA
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	g.writeExplanation(part, reported)
+
+	header = make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType(envelope, "message/delivery-status"))
+	if part, err = mw.CreatePart(header); err != nil {
+		return nil, err
+	}
+	g.writeDeliveryStatus(part, envelope, reported, recipients)
+
+	// https://tools.ietf.org/html/rfc3461#section-4.3
+	returned := m.Raw
+	header = make(textproto.MIMEHeader)
+	if envelope.Return == "FULL" {
+		header.Set("Content-Type", contentType(envelope, "message/rfc822"))
+	} else {
+		header.Set("Content-Type", contentType(envelope, "text/rfc822-headers"))
+		returned = headerSection(m.Raw)
+	}
+	if part, err = mw.CreatePart(header); err != nil {
+		return nil, err
+	}
+	part.Write(returned)
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "From: Mail Delivery System <%v>\r\n", from)
+	fmt.Fprintf(&raw, "To: <%v>\r\n", envelope.From)
+	fmt.Fprintf(&raw, "Subject: %v\r\n", subject(reported))
+	fmt.Fprintf(&raw, "Date: %v\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&raw, "Message-ID: <%v>\r\n", messageID(now, g.ReportingMTA))
+	raw.WriteString("Auto-Submitted: auto-replied\r\n")
+	raw.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&raw, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n", mw.Boundary())
+	raw.WriteString("\r\n")
+	raw.Write(body.Bytes())
+
+	report, err := email.NewMessage(raw.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	report.Raw = raw.Bytes()
+	report.Envelope = &email.Envelope{
+		To:         []string{envelope.From},
+		SMTPUTF8:   envelope.SMTPUTF8,
+		Recipients: []*email.Recipient{{Address: envelope.From, Notify: []string{email.NotifyNever}}},
+	}
+	return report, nil
+}
+
+// writeExplanation writes the human readable part, see https://tools.ietf.org/html/rfc3464#section-2
+func (g *Generator) writeExplanation(w io.Writer, statuses []*Status) {
+	fmt.Fprintf(w, "This is the mail system at %v.\r\n", g.ReportingMTA)
+
+	for _, action := range []string{Failed, Delayed, Delivered, Relayed, Expanded} {
+		var lines []string
+		for _, status := range statuses {
+			if status.Action != action {
+				continue
+			}
+			line := "<" + oneLine(status.Recipient) + ">"
+			if status.Diagnostic != "" {
+				line += ": " + oneLine(status.Diagnostic)
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "\r\n%v\r\n\r\n", explanations[action])
+		for _, line := range lines {
+			fmt.Fprintf(w, "    %v\r\n", line)
+		}
+	}
+}
+
+var explanations = map[string]string{
+	Failed:    "Your message could not be delivered to the following recipients:",
+	Delayed:   "Your message has not been delivered yet to the following recipients, delivery will be retried:",
+	Delivered: "Your message was delivered to the following recipients:",
+	Relayed:   "Your message was relayed to the following recipients, whose servers may not send further notifications:",
+	Expanded:  "Your message was delivered to the following recipients, and forwarded on by them:",
+}
+
+// writeDeliveryStatus writes the machine readable part, see https://tools.ietf.org/html/rfc3464#section-2.1
+func (g *Generator) writeDeliveryStatus(w io.Writer, envelope *email.Envelope, statuses []*Status, recipients []*email.Recipient) {
+	fmt.Fprintf(w, "Reporting-MTA: dns; %v\r\n", g.ReportingMTA)
+	if envelope.ID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %v\r\n", oneLine(envelope.ID))
+	}
+
+	for i, status := range statuses {
+		w.Write([]byte("\r\n"))
+		if original := recipients[i].Original; original != "" {
+			fmt.Fprintf(w, "Original-Recipient: %v\r\n", oneLine(original))
+		}
+		fmt.Fprintf(w, "Final-Recipient: %v; %v\r\n", addressType(status.Recipient), oneLine(status.Recipient))
+		fmt.Fprintf(w, "Action: %v\r\n", status.Action)
+		fmt.Fprintf(w, "Status: %v\r\n", status.code())
+		if status.RemoteMTA != "" {
+			fmt.Fprintf(w, "Remote-MTA: dns; %v\r\n", oneLine(status.RemoteMTA))
+		}
+		if status.Diagnostic != "" {
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; %v\r\n", oneLine(status.Diagnostic))
+		}
+		if !status.LastAttempt.IsZero() {
+			fmt.Fprintf(w, "Last-Attempt-Date: %v\r\n", status.LastAttempt.Format(time.RFC1123Z))
+		}
+		if !status.RetryUntil.IsZero() {
+			fmt.Fprintf(w, "Will-Retry-Until: %v\r\n", status.RetryUntil.Format(time.RFC1123Z))
+		}
+	}
+}
+
+// contentType swaps in the media types for internationalized messages when the
+// envelope was SMTPUTF8, see https://tools.ietf.org/html/rfc6533#section-6
+func contentType(envelope *email.Envelope, mediaType string) string {
+	if !envelope.SMTPUTF8 {
+		return mediaType
+	}
+	return map[string]string{
+		"message/delivery-status": "message/global-delivery-status",
+		"message/rfc822":          "message/global",
+		"text/rfc822-headers":     "message/global-headers",
+	}[mediaType]
+}
+
+// code falls back on the generic status code for the action
+func (s *Status) code() string {
+	if s.Code != "" {
+		return s.Code
+	}
+	switch s.Action {
+	case Failed:
+		return "5.0.0"
+	case Delayed:
+		return "4.0.0"
+	}
+	return "2.0.0"
+}
+
+// addressType is "rfc822" for plain addresses & "utf-8" for internationalized
+// ones, see https://tools.ietf.org/html/rfc6533#section-3
+func addressType(address string) string {
+	for i := 0; i < len(address); i++ {
+		if address[i] >= 0x80 {
+			return "utf-8"
+		}
+	}
+	return "rfc822"
+}
+
+// subject summarizes the most serious of the statuses
+func subject(statuses []*Status) string {
+	worst := ""
+	for _, status := range statuses {
+		switch {
+		case status.Action == Failed:
+			worst = Failed
+		case status.Action == Delayed && worst != Failed:
+			worst = Delayed
+		}
+	}
+
+	switch worst {
+	case Failed:
+		return "Undelivered Mail Returned to Sender"
+	case Delayed:
+		return "Delayed Mail (still being retried)"
+	}
+	return "Successful Mail Delivery Report"
+}
+
+// oneLine folds the line breaks out of a value that comes from the client or a remote
+// server (e.g. a multiline SMTP reply), so it can't start new fields in the report
+func oneLine(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// headerSection cuts the body off a raw message
+func headerSection(raw []byte) []byte {
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[:i+4]
+	}
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		return raw[:i+2]
+	}
+	return raw
+}
+
+func messageID(now time.Time, hostname string) string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("%v.%v@%v", strconv.FormatInt(now.UnixNano(), 36), hex.EncodeToString(random), hostname)
+}
+
+// findRecipient looks up the DSN parameters given for address, recipients that weren't
+// given any get the defaults
+func findRecipient(envelope *email.Envelope, address string) *email.Recipient {
+	for _, recipient := range envelope.Recipients {
+		if strings.EqualFold(recipient.Address, address) {
+			return recipient
+		}
+	}
+	return &email.Recipient{Address: address}
+}
@@ -0,0 +1,206 @@
+package dsn
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+const original = "From: sender@example.org\r\nTo: user@example.net\r\nSubject: hello\r\nContent-Type: text/plain\r\n\r\nsecret body\r\n"
+
+func receivedMessage(t *testing.T, envelope *email.Envelope) *email.Message {
+	m, err := email.NewMessage([]byte(original))
+	if err != nil {
+		t.Fatalf("Couldn't parse message: %v", err)
+	}
+	m.Envelope = envelope
+	return m
+}
+
+func TestGenerateFailure(t *testing.T) {
+	m := receivedMessage(t, &email.Envelope{
+		From: "sender@example.org",
+		To:   []string{"user@example.net"},
+		ID:   "QQ314159",
+		Recipients: []*email.Recipient{
+			{Address: "user@example.net", Original: "rfc822;list@example.net"},
+		},
+	})
+
+	g := NewGenerator("mx.example.com")
+	g.Now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	report, err := g.Generate(m, []*Status{{
+		Recipient:  "user@example.net",
+		Action:     Failed,
+		Code:       "5.1.1",
+		Diagnostic: "550 5.1.1 No such user",
+		RemoteMTA:  "mail.example.net",
+	}})
+	if err != nil || report == nil {
+		t.Fatalf("Expected a report, got: %v, %v", report, err)
+	}
+
+	if mediaType, params := report.ContentType(); mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Errorf("Wrong content type: %v %v", mediaType, params)
+	}
+	if report.Subject != "Undelivered Mail Returned to Sender" {
+		t.Errorf("Wrong subject: %v", report.Subject)
+	}
+	if report.From.Address != "MAILER-DAEMON@mx.example.com" || len(report.To) != 1 || report.To[0].Address != "sender@example.org" {
+		t.Errorf("Wrong addresses: %v -> %v", report.From, report.To)
+	}
+	if got := report.Envelope; got.From != "" || len(got.To) != 1 || got.To[0] != "sender@example.org" {
+		t.Errorf("Report should go back to the sender from the null reverse-path, got: %+v", got)
+	}
+
+	if len(report.Body) != 3 {
+		t.Fatalf("Expected 3 parts, got: %v", len(report.Body))
+	}
+
+	status, err := report.FindByType("message/delivery-status")
+	if err != nil {
+		t.Fatalf("No delivery status: %v", err)
+	}
+	for _, field := range []string{
+		"Reporting-MTA: dns; mx.example.com\r\n",
+		"Original-Envelope-Id: QQ314159\r\n",
+		"Original-Recipient: rfc822;list@example.net\r\n",
+		"Final-Recipient: rfc822; user@example.net\r\n",
+		"Action: failed\r\n",
+		"Status: 5.1.1\r\n",
+		"Remote-MTA: dns; mail.example.net\r\n",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+	} {
+		if !strings.Contains(string(status), field) {
+			t.Errorf("Delivery status is missing %q:\n%s", field, status)
+		}
+	}
+
+	// without RET=FULL only the headers are returned
+	headers, err := report.FindByType("text/rfc822-headers")
+	if err != nil || !strings.Contains(string(headers), "Subject: hello") || strings.Contains(string(headers), "secret body") {
+		t.Errorf("Expected the original headers only, got: %q, %v", headers, err)
+	}
+}
+
+func TestGenerateLineBreaks(t *testing.T) {
+	m := receivedMessage(t, &email.Envelope{
+		From: "sender@example.org",
+		To:   []string{"user@example.net"},
+		ID:   "QQ314159\r\nX-Injected: envid",
+		Recipients: []*email.Recipient{
+			{Address: "user@example.net", Original: "rfc822;list@example.net\nX-Injected: orcpt"},
+		},
+	})
+
+	report, err := NewGenerator("mx.example.com").Generate(m, []*Status{{
+		Recipient:  "user@example.net",
+		Action:     Failed,
+		Diagnostic: "550-5.1.1 No such user\r\n550 5.1.1 X-Injected: diagnostic",
+	}})
+	if err != nil || report == nil {
+		t.Fatalf("Expected a report, got: %v, %v", report, err)
+	}
+
+	status, err := report.FindByType("message/delivery-status")
+	if err != nil {
+		t.Fatalf("No delivery status: %v", err)
+	}
+	for _, field := range []string{
+		"Original-Envelope-Id: QQ314159 X-Injected: envid\r\n",
+		"Original-Recipient: rfc822;list@example.net X-Injected: orcpt\r\n",
+		"Diagnostic-Code: smtp; 550-5.1.1 No such user 550 5.1.1 X-Injected: diagnostic\r\n",
+	} {
+		if !strings.Contains(string(status), field) {
+			t.Errorf("Delivery status is missing %q:\n%s", field, status)
+		}
+	}
+
+	explanation, err := report.FindByType("text/plain")
+	if err != nil || !strings.Contains(string(explanation), "<user@example.net>: 550-5.1.1 No such user 550 5.1.1 X-Injected: diagnostic\r\n") {
+		t.Errorf("Diagnostic should stay on one line, got: %q, %v", explanation, err)
+	}
+}
+
+func TestGenerateReturnFull(t *testing.T) {
+	m := receivedMessage(t, &email.Envelope{
+		From:   "sender@example.org",
+		To:     []string{"user@example.net"},
+		Return: "FULL",
+	})
+
+	report, err := NewGenerator("mx.example.com").Generate(m, []*Status{{Recipient: "user@example.net", Action: Failed}})
+	if err != nil || report == nil {
+		t.Fatalf("Expected a report, got: %v, %v", report, err)
+	}
+
+	if returned, err := report.FindByType("message/rfc822"); err != nil || !strings.Contains(string(returned), "secret body") {
+		t.Errorf("Expected the full message to be returned, got: %q, %v", returned, err)
+	}
+	if status, _ := report.FindByType("message/delivery-status"); !strings.Contains(string(status), "Status: 5.0.0\r\n") {
+		t.Errorf("Expected the generic failure status, got:\n%s", status)
+	}
+}
+
+func TestGenerateNotify(t *testing.T) {
+	envelope := &email.Envelope{
+		From: "sender@example.org",
+		To:   []string{"default@example.net", "never@example.net", "success@example.net"},
+		Recipients: []*email.Recipient{
+			{Address: "default@example.net"},
+			{Address: "never@example.net", Notify: []string{email.NotifyNever}},
+			{Address: "success@example.net", Notify: []string{email.NotifySuccess, email.NotifyFailure}},
+		},
+	}
+	g := NewGenerator("mx.example.com")
+
+	tests := []struct {
+		action   string
+		reported []string
+		subject  string
+	}{
+		{Delivered, []string{"success@example.net"}, "Successful Mail Delivery Report"},
+		{Delayed, []string{"default@example.net"}, "Delayed Mail (still being retried)"},
+		{Failed, []string{"default@example.net", "success@example.net"}, "Undelivered Mail Returned to Sender"},
+	}
+
+	for _, test := range tests {
+		var statuses []*Status
+		for _, to := range envelope.To {
+			statuses = append(statuses, &Status{Recipient: to, Action: test.action})
+		}
+
+		report, err := g.Generate(receivedMessage(t, envelope), statuses)
+		if err != nil || report == nil {
+			t.Fatalf("%v: expected a report, got: %v, %v", test.action, report, err)
+		}
+		if report.Subject != test.subject {
+			t.Errorf("%v: wrong subject %q", test.action, report.Subject)
+		}
+
+		status, _ := report.FindByType("message/delivery-status")
+		if got := strings.Count(string(status), "Final-Recipient:"); got != len(test.reported) {
+			t.Errorf("%v: expected %v recipients, got %v:\n%s", test.action, len(test.reported), got, status)
+		}
+		for _, to := range test.reported {
+			if !strings.Contains(string(status), "Final-Recipient: rfc822; "+to+"\r\n") {
+				t.Errorf("%v: %v should be reported:\n%s", test.action, to, status)
+			}
+		}
+	}
+
+	// nobody asked for a success notification here
+	report, err := g.Generate(receivedMessage(t, envelope), []*Status{{Recipient: "default@example.net", Action: Delivered}})
+	if report != nil || err != nil {
+		t.Errorf("Expected no report, got: %v, %v", report, err)
+	}
+
+	// bounces never get a notification
+	bounce := receivedMessage(t, &email.Envelope{To: []string{"user@example.net"}})
+	if report, err := g.Generate(bounce, []*Status{{Recipient: "user@example.net", Action: Failed}}); report != nil || err != nil {
+		t.Errorf("Expected no report for a null reverse-path, got: %v, %v", report, err)
+	}
+}
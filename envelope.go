@@ -0,0 +1,64 @@
+package email
+
+// Envelope is the SMTP transaction a message was received with, which can differ
+// from the addresses in its headers (e.g. for Bcc recipients or mailing lists)
+type Envelope struct {
+	// From is the reverse-path given with MAIL FROM, empty for bounces
+	From string
+
+	// To holds the forward-paths given with RCPT TO
+	To []string
+
+	// Body is the BODY= type given with MAIL FROM: "7BIT", "8BITMIME", "BINARYMIME",
+	// or empty when the client didn't declare one
+	Body string
+
+	// SMTPUTF8 is set for internationalized email, the addresses may then contain UTF-8
+	// and have their domains in U-label form, see https://tools.ietf.org/html/rfc6531
+	SMTPUTF8 bool
+
+	// Return is the RET= parameter, "FULL" or "HDRS", saying how much of the message a
+	// delivery status notification should include, see https://tools.ietf.org/html/rfc3461#section-4.3
+	Return string
+
+	// ID is the ENVID= parameter, to be quoted back in delivery status notifications
+	ID string
+
+	// Recipients holds the DSN parameters of each recipient, in the same order as To
+	Recipients []*Recipient
+}
+
+// DSN notification conditions, see https://tools.ietf.org/html/rfc3461#section-4.1
+const (
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+// Recipient is a forward-path with the delivery status notification parameters given for it
+type Recipient struct {
+	Address string
+
+	// Notify lists the NOTIFY= conditions, empty when the client left it to the default
+	// (failures & delays)
+	Notify []string
+
+	// Original is the ORCPT= parameter, the address type and the address the message
+	// was originally sent to, e.g. "rfc822;list@example.org"
+	Original string
+}
+
+// Notifies checks whether the sender asked for a notification under condition
+// (NotifySuccess, NotifyFailure or NotifyDelay)
+func (r *Recipient) Notifies(condition string) bool {
+	if len(r.Notify) == 0 {
+		return condition == NotifyFailure || condition == NotifyDelay
+	}
+	for _, notify := range r.Notify {
+		if notify == condition {
+			return true
+		}
+	}
+	return false
+}
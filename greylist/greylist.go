@@ -0,0 +1,194 @@
+// Package greylist implements greylisting: mail from a client, sender & recipient never seen
+// together before is turned away with a temporary failure, which real mail servers retry
+// and most spam bots don't, see https://tools.ietf.org/html/rfc6647
+package greylist
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults, as used by postgrey
+const (
+	DefaultDelay         = 5 * time.Minute
+	DefaultWindow        = 48 * time.Hour
+	DefaultLifetime      = 35 * 24 * time.Hour
+	DefaultAutoWhitelist = 5
+)
+
+// Entry is what's remembered about a triplet, or about a client for auto-whitelisting
+type Entry struct {
+	// First is when the triplet was first seen, or last seen again after its window ran out
+	First time.Time
+
+	// Last is when the triplet (or client) last passed
+	Last time.Time
+
+	// Passes counts the times the triplet was accepted, or for a client, how many of its
+	// triplets passed greylisting
+	Passes int
+}
+
+// Greylister decides whether to accept a (client network, sender, recipient) triplet
+type Greylister struct {
+	Storage Storage
+
+	// Delay is how long a client has to wait before it's accepted on retrying
+	Delay time.Duration
+
+	// Window is how long after first being turned away a retry is accepted, later
+	// retries start over
+	Window time.Duration
+
+	// Lifetime is how long triplets that passed, and whitelisted clients, are remembered
+	// without being seen again
+	Lifetime time.Duration
+
+	// AutoWhitelist is the number of triplets a client has to pass with before it's
+	// accepted right away, zero never whitelists
+	AutoWhitelist int
+
+	// Now tells the time, time.Now if nil
+	Now func() time.Time
+
+	locks networkLocks
+}
+
+// networkLocks serializes the checks for each client network, as a check reads & then
+// updates both the triplet's & the network's entries
+type networkLocks struct {
+	lock  sync.Mutex
+	locks map[string]*networkLock
+}
+
+type networkLock struct {
+	sync.Mutex
+	// users counts the checks holding or waiting for the lock, it's dropped when none are left
+	users int
+}
+
+// acquire locks network, returning the function that unlocks it
+func (l *networkLocks) acquire(network string) func() {
+	l.lock.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*networkLock)
+	}
+	nl := l.locks[network]
+	if nl == nil {
+		nl = &networkLock{}
+		l.locks[network] = nl
+	}
+	nl.users++
+	l.lock.Unlock()
+
+	nl.Lock()
+	return func() {
+		nl.Unlock()
+
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if nl.users--; nl.users == 0 {
+			delete(l.locks, network)
+		}
+	}
+}
+
+// NewGreylister creates a greylister keeping its state in storage, with the default timings
+func NewGreylister(storage Storage) *Greylister {
+	return &Greylister{
+		Storage:       storage,
+		Delay:         DefaultDelay,
+		Window:        DefaultWindow,
+		Lifetime:      DefaultLifetime,
+		AutoWhitelist: DefaultAutoWhitelist,
+	}
+}
+
+func (g *Greylister) now() time.Time {
+	if g.Now != nil {
+		return g.Now()
+	}
+	return time.Now()
+}
+
+// Network is the part of a client address that greylisting goes by, its /24 (or /64 for
+// IPv6), as big senders retry from other servers on the same network
+func Network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+func tripletKey(network, sender, recipient string) string {
+	return fmt.Sprintf("triplet/%v/%v/%v", network, strings.ToLower(sender), strings.ToLower(recipient))
+}
+
+func clientKey(network string) string {
+	return "client/" + network
+}
+
+// Check records an attempt to send mail from sender to recipient by the client at ip, and
+// reports whether it should be accepted. A triplet is accepted once it's retried after
+// Delay and within Window, and from then on until it's gone unseen for Lifetime. Checks for
+// the same network wait on each other, so concurrent retries don't lose each other's updates
+func (g *Greylister) Check(ip net.IP, sender, recipient string) (bool, error) {
+	network := Network(ip)
+	defer g.locks.acquire(network)()
+
+	now := g.now()
+
+	client, err := g.Storage.Get(clientKey(network))
+	if err != nil {
+		return false, err
+	}
+	if client != nil && g.AutoWhitelist > 0 && client.Passes >= g.AutoWhitelist && now.Sub(client.Last) < g.Lifetime {
+		client.Last = now
+		return true, g.Storage.Put(clientKey(network), client)
+	}
+
+	key := tripletKey(network, sender, recipient)
+	entry, err := g.Storage.Get(key)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case entry == nil, entry.Passes == 0 && now.Sub(entry.First) > g.Window, entry.Passes > 0 && now.Sub(entry.Last) > g.Lifetime:
+		// first sight, or long enough ago to be forgotten
+		return false, g.Storage.Put(key, &Entry{First: now})
+	case entry.Passes == 0 && now.Sub(entry.First) < g.Delay:
+		// retried too soon, the delay still runs from the first attempt
+		return false, nil
+	}
+
+	if entry.Passes == 0 {
+		if client == nil {
+			client = &Entry{First: now}
+		}
+		client.Passes++
+		client.Last = now
+		if err := g.Storage.Put(clientKey(network), client); err != nil {
+			return false, err
+		}
+	}
+
+	entry.Passes++
+	entry.Last = now
+	return true, g.Storage.Put(key, entry)
+}
+
+// Expire forgets the triplets & clients that are past their window or lifetime, call it
+// now and then to keep the storage from growing
+func (g *Greylister) Expire() error {
+	now := g.now()
+	return g.Storage.Expire(func(key string, e *Entry) bool {
+		if e.Passes == 0 {
+			return now.Sub(e.First) > g.Window
+		}
+		return now.Sub(e.Last) > g.Lifetime
+	})
+}
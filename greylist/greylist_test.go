@@ -0,0 +1,200 @@
+package greylist
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestGreylister(t *testing.T) {
+
+	c := &clock{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	g := NewGreylister(NewMemoryStorage())
+	g.Now = c.Now
+	g.AutoWhitelist = 2
+
+	check := func(ip, sender, recipient string, want bool) {
+		t.Helper()
+		if pass, err := g.Check(net.ParseIP(ip), sender, recipient); err != nil || pass != want {
+			t.Errorf("Expected %v for %v %v %v, got: %v, %v", want, ip, sender, recipient, pass, err)
+		}
+	}
+
+	check("192.0.2.1", "sender@example.org", "user@example.net", false)
+
+	// too soon
+	c.Advance(time.Minute)
+	check("192.0.2.1", "sender@example.org", "user@example.net", false)
+
+	// retried from another server on the same network
+	c.Advance(5 * time.Minute)
+	check("192.0.2.77", "Sender@example.org", "user@example.net", true)
+
+	// other triplets are still greylisted
+	check("192.0.2.1", "sender@example.org", "other@example.net", false)
+	check("198.51.100.1", "sender@example.org", "user@example.net", false)
+
+	// a retry that comes too late starts over
+	c.Advance(DefaultWindow + time.Hour)
+	check("198.51.100.1", "sender@example.org", "user@example.net", false)
+	c.Advance(10 * time.Minute)
+	check("198.51.100.1", "sender@example.org", "user@example.net", true)
+
+	// a second triplet passing whitelists the network
+	check("192.0.2.1", "sender@example.org", "other@example.net", false)
+	c.Advance(10 * time.Minute)
+	check("192.0.2.1", "sender@example.org", "other@example.net", true)
+	check("192.0.2.1", "someone@example.com", "new@example.net", true)
+
+	// triplets that passed are forgotten after their lifetime
+	c.Advance(DefaultLifetime + time.Hour)
+	if err := g.Expire(); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	check("198.51.100.1", "sender@example.org", "user@example.net", false)
+}
+
+// slowStorage takes its time to answer, so that concurrent checks read the same entries
+type slowStorage struct {
+	*MemoryStorage
+}
+
+func (s slowStorage) Get(key string) (*Entry, error) {
+	e, err := s.MemoryStorage.Get(key)
+	time.Sleep(time.Millisecond)
+	return e, err
+}
+
+func TestGreylisterConcurrentRetries(t *testing.T) {
+
+	c := &clock{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	storage := slowStorage{NewMemoryStorage()}
+	g := NewGreylister(storage)
+	g.Now = c.Now
+
+	if pass, err := g.Check(net.ParseIP("192.0.2.1"), "sender@example.org", "user@example.net"); err != nil || pass {
+		t.Fatalf("First attempt should be greylisted, got: %v, %v", pass, err)
+	}
+	c.Advance(10 * time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if pass, err := g.Check(net.ParseIP("192.0.2.1"), "sender@example.org", "user@example.net"); err != nil || !pass {
+				t.Errorf("Retry should pass, got: %v, %v", pass, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the triplet passed once as far as auto-whitelisting goes, however many retries raced
+	if client, err := storage.Get(clientKey("192.0.2.0")); err != nil || client == nil || client.Passes != 1 {
+		t.Errorf("Expected the client to have passed once, got: %+v, %v", client, err)
+	}
+	if entry, err := storage.Get(tripletKey("192.0.2.0", "sender@example.org", "user@example.net")); err != nil || entry == nil || entry.Passes != 20 {
+		t.Errorf("Expected every retry to be counted, got: %+v, %v", entry, err)
+	}
+	if len(g.locks.locks) != 0 {
+		t.Errorf("Locks should be dropped once unused, got: %v", len(g.locks.locks))
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "greylist")
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("Couldn't open the storage: %v", err)
+	}
+
+	first := time.Unix(1577836800, 0)
+	entry := &Entry{First: first, Last: first.Add(time.Hour), Passes: 3}
+	if err := storage.Put("triplet/192.0.2.0/a@example.org/b@example.net", entry); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := storage.Put("client/192.0.2.0", &Entry{First: first}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := storage.Expire(func(key string, e *Entry) bool { return e.Passes == 0 }); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+
+	reopened, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("Couldn't reopen the storage: %v", err)
+	}
+	got, err := reopened.Get("triplet/192.0.2.0/a@example.org/b@example.net")
+	if err != nil || got == nil || !got.First.Equal(entry.First) || !got.Last.Equal(entry.Last) || got.Passes != 3 {
+		t.Errorf("Expected the entry %+v to be kept, got: %+v, %v", entry, got, err)
+	}
+	if got, _ := reopened.Get("client/192.0.2.0"); got != nil {
+		t.Errorf("The expired entry should be gone, got: %+v", got)
+	}
+}
+
+func TestFileStorageAppends(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "greylist")
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("Couldn't open the storage: %v", err)
+	}
+
+	// a whitelisted client seen again within the second changes nothing on disk
+	first := time.Unix(1577836800, 0)
+	for i := 0; i < 10; i++ {
+		if err := storage.Put("client/192.0.2.0", &Entry{First: first, Last: first.Add(time.Hour), Passes: 5}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := storage.Put("client/192.0.2.0", &Entry{First: first, Last: first.Add(2 * time.Hour), Passes: 6}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if lines := strings.Count(string(b), "\n"); lines != 2 {
+		t.Errorf("Expected only the changes to be appended, got %v lines: %q", lines, b)
+	}
+
+	// a crash while appending leaves a broken last line
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("1577836800 15778")
+	f.Close()
+
+	reopened, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatalf("Couldn't reopen the storage: %v", err)
+	}
+	if got, _ := reopened.Get("client/192.0.2.0"); got == nil || got.Passes != 6 {
+		t.Errorf("Expected the latest entry, got: %+v", got)
+	}
+	if err := reopened.Put("client/198.51.100.0", &Entry{First: first}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := NewFileStorage(path); err != nil {
+		t.Errorf("The broken line should have been dropped, got: %v", err)
+	}
+	b, _ = ioutil.ReadFile(path)
+	if lines := strings.Count(string(b), "\n"); lines != 2 {
+		t.Errorf("Expected the file to be compacted, got %v lines: %q", lines, b)
+	}
+}
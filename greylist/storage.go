@@ -0,0 +1,204 @@
+package greylist
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage keeps the greylisting state. It has to be safe for concurrent use, the Greylister
+// makes each of its checks atomic by locking the client's network around the Get & Put calls
+type Storage interface {
+	// Get returns the entry for key, nil if there is none
+	Get(key string) (*Entry, error)
+
+	// Put stores the entry for key
+	Put(key string, e *Entry) error
+
+	// Expire removes the entries for which expired returns true
+	Expire(expired func(key string, e *Entry) bool) error
+}
+
+// MemoryStorage keeps the state in memory, it's lost when the process exits
+type MemoryStorage struct {
+	lock    sync.Mutex
+	entries map[string]Entry
+}
+
+// NewMemoryStorage creates an empty in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{entries: make(map[string]Entry)}
+}
+
+func (s *MemoryStorage) Get(key string) (*Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		return &e, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStorage) Put(key string, e *Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.entries[key] = *e
+	return nil
+}
+
+func (s *MemoryStorage) Expire(expired func(key string, e *Entry) bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, e := range s.entries {
+		if expired(key, &e) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+// FileStorage keeps the state in memory and in a file, so that it survives restarts. Changes
+// are appended to the file, which is rewritten without the stale lines once they outnumber
+// the entries, and on Expire
+type FileStorage struct {
+	MemoryStorage
+	path string
+
+	// lines counts the lines in the file, stale ones included
+	lines int
+}
+
+// NewFileStorage opens the storage kept in the file at path, which is created on the first change
+func NewFileStorage(path string) (*FileStorage, error) {
+	s := &FileStorage{MemoryStorage: MemoryStorage{entries: make(map[string]Entry)}, path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// each line holds the first & last times, the passes and the key, later lines
+	// replacing earlier ones. A broken last line is what a crash while appending leaves
+	// behind, so it's skipped
+	malformed := 0
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if malformed > 0 {
+			return nil, fmt.Errorf("%v:%v: malformed entry", path, malformed)
+		}
+		key, e, ok := parseEntry(scanner.Text())
+		if !ok {
+			malformed = line
+			continue
+		}
+		s.entries[key] = e
+		s.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if malformed > 0 {
+		// appending after the broken line would break the next one too
+		return s, s.save()
+	}
+	return s, nil
+}
+
+func parseEntry(line string) (string, Entry, bool) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) != 4 {
+		return "", Entry{}, false
+	}
+	first, err1 := strconv.ParseInt(fields[0], 10, 64)
+	last, err2 := strconv.ParseInt(fields[1], 10, 64)
+	passes, err3 := strconv.Atoi(fields[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return "", Entry{}, false
+	}
+	return fields[3], Entry{First: time.Unix(first, 0), Last: time.Unix(last, 0), Passes: passes}, true
+}
+
+func formatEntry(key string, e Entry) string {
+	return fmt.Sprintf("%v %v %v %v\n", e.First.Unix(), e.Last.Unix(), e.Passes, key)
+}
+
+func (s *FileStorage) Put(key string, e *Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, ok := s.entries[key]
+	s.entries[key] = *e
+	if ok && formatEntry(key, old) == formatEntry(key, *e) {
+		// the file only keeps whole seconds, there's nothing new to write
+		return nil
+	}
+
+	if s.lines >= 2*len(s.entries)+1024 {
+		return s.save()
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(formatEntry(key, *e)); err != nil {
+		f.Close()
+		return err
+	}
+	s.lines++
+	return f.Close()
+}
+
+func (s *FileStorage) Expire(expired func(key string, e *Entry) bool) error {
+	s.MemoryStorage.Expire(expired)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.lines == len(s.entries) {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the entries to a temporary file that then replaces the old one, so that a
+// crash never leaves a partial file behind
+func (s *FileStorage) save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for key, e := range s.entries {
+		w.WriteString(formatEntry(key, e))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.lines = len(s.entries)
+	return nil
+}
@@ -0,0 +1,249 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ACE prefix of punycode-encoded labels, see https://tools.ietf.org/html/rfc5890#section-2.3.2.1
+const acePrefix = "xn--"
+
+// ToASCII converts an internationalized domain name to its A-label form (e.g. "xn--mller-kva.de"),
+// for use in DNS and with servers that don't support SMTPUTF8. Labels are lowercased, but not
+// otherwise mapped, see https://tools.ietf.org/html/rfc5891#section-4
+func ToASCII(domain string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	for i, label := range labels {
+		if label == "" {
+			return "", fmt.Errorf("Empty label in domain %q", domain)
+		}
+
+		label = strings.ToLower(label)
+		if isASCII(label) {
+			if strings.HasPrefix(label, acePrefix) {
+				if _, err := punycodeDecode(label[len(acePrefix):]); err != nil {
+					return "", fmt.Errorf("Invalid A-label %q: %v", label, err)
+				}
+			}
+			labels[i] = label
+			continue
+		}
+
+		encoded, err := punycodeEncode(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = acePrefix + encoded
+		if len(labels[i]) > 63 {
+			return "", fmt.Errorf("Label %q is too long", label)
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// ToUnicode converts a domain name to its U-label form (e.g. "müller.de"), the way it
+// should be shown to users and used in SMTPUTF8 addresses
+func ToUnicode(domain string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	for i, label := range labels {
+		if label == "" {
+			return "", fmt.Errorf("Empty label in domain %q", domain)
+		}
+
+		label = strings.ToLower(label)
+		if strings.HasPrefix(label, acePrefix) {
+			decoded, err := punycodeDecode(label[len(acePrefix):])
+			if err != nil {
+				return "", fmt.Errorf("Invalid A-label %q: %v", label, err)
+			}
+			label = decoded
+		}
+		labels[i] = label
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Punycode parameters, see https://tools.ietf.org/html/rfc3492#section-5
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// punycodeEncode implements https://tools.ietf.org/html/rfc3492#section-6.3
+func punycodeEncode(input string) (string, error) {
+	runes := []rune(input)
+
+	var out strings.Builder
+	for _, r := range runes {
+		if r < 0x80 {
+			out.WriteRune(r)
+		}
+	}
+	basic := out.Len()
+	handled := basic
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(runes) {
+		// the smallest code point not handled yet
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+
+		if int(m-n) > (1<<31-1-delta)/(handled+1) {
+			return "", fmt.Errorf("Punycode overflow")
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punyDigit(q))
+
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+
+	return out.String(), nil
+}
+
+// punycodeDecode implements https://tools.ietf.org/html/rfc3492#section-6.2
+func punycodeDecode(input string) (string, error) {
+	var output []rune
+
+	pos := 0
+	if i := strings.LastIndexByte(input, '-'); i >= 0 {
+		for _, r := range input[:i] {
+			if r >= 0x80 {
+				return "", fmt.Errorf("Non-basic code point in punycode")
+			}
+			output = append(output, r)
+		}
+		pos = i + 1
+	}
+
+	n, i, bias := rune(punyInitialN), 0, punyInitialBias
+	for pos < len(input) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(input) {
+				return "", fmt.Errorf("Truncated punycode")
+			}
+			digit, ok := punyValue(input[pos])
+			pos++
+			if !ok {
+				return "", fmt.Errorf("Invalid punycode digit %q", input[pos-1])
+			}
+			if digit > (1<<31-1-i)/w {
+				return "", fmt.Errorf("Punycode overflow")
+			}
+			i += digit * w
+
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+		}
+
+		bias = punyAdapt(i-oldi, len(output)+1, oldi == 0)
+		n += rune(i / (len(output) + 1))
+		i %= len(output) + 1
+
+		if n > utf8.MaxRune {
+			return "", fmt.Errorf("Punycode overflow")
+		}
+
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = n
+		i++
+	}
+
+	return string(output), nil
+}
+
+func punyThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punyTMin
+	case k >= bias+punyTMax:
+		return punyTMax
+	}
+	return k - bias
+}
+
+// punyAdapt is the bias adaptation function, see https://tools.ietf.org/html/rfc3492#section-6.1
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyValue(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
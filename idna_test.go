@@ -0,0 +1,48 @@
+package email
+
+import "testing"
+
+func TestPunycode(t *testing.T) {
+	// samples from https://tools.ietf.org/html/rfc3492#section-7.1
+	for decoded, encoded := range map[string]string{
+		"ليهمابتكلموشعربي؟":        "egbpdaj6bu4bxfgehfvwxn",
+		"他们为什么不说中文":                "ihqwcrb4cv8a8dqg056pqjye",
+		"3年B組金八先生":                 "3B-ww4c5e180e575a65lsy2b",
+		"安室奈美恵-with-SUPER-MONKEYS": "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n",
+		"bücher":                   "bcher-kva",
+	} {
+		if got, err := punycodeEncode(decoded); err != nil || got != encoded {
+			t.Errorf("Wrong encoding of %v, want: %v, got: %v (%v)", decoded, encoded, got, err)
+		}
+		if got, err := punycodeDecode(encoded); err != nil || got != decoded {
+			t.Errorf("Wrong decoding of %v, want: %v, got: %v (%v)", encoded, decoded, got, err)
+		}
+	}
+}
+
+func TestIDNA(t *testing.T) {
+	for _, test := range []struct {
+		unicode, ascii string
+	}{
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"例子.测试", "xn--fsqu00a.xn--0zwm56d"},
+		{"example.com", "example.com"},
+	} {
+		if got, err := ToASCII(test.unicode); err != nil || got != test.ascii {
+			t.Errorf("Wrong A-labels for %v, want: %v, got: %v (%v)", test.unicode, test.ascii, got, err)
+		}
+		if got, err := ToUnicode(test.ascii); err != nil || got != test.unicode {
+			t.Errorf("Wrong U-labels for %v, want: %v, got: %v (%v)", test.ascii, test.unicode, got, err)
+		}
+	}
+
+	if got, _ := ToASCII("Bücher.Example."); got != "xn--bcher-kva.example" {
+		t.Errorf("Domains should be lowercased, got: %v", got)
+	}
+
+	for _, domain := range []string{"xn--a!b.example", "a..example", ""} {
+		if _, err := ToASCII(domain); err == nil {
+			t.Errorf("Domain %q should be refused", domain)
+		}
+	}
+}
@@ -71,13 +71,18 @@ func (d *Dir) Write(m *email.Message) (string, error) {
         return "", err
     }
 
-    // this will be in a weird order. is that a problem?
-    for k, v := range m.Headers {
-        f.Write([]byte(fmt.Sprintf("%v: %v\n", k, v)))
-    }
+    if len(m.Raw) > 0 {
+        // store the message verbatim, so signatures & the like survive
+        f.Write(m.Raw)
+    } else {
+        // this will be in a weird order. is that a problem?
+        for k, v := range m.Headers {
+            f.Write([]byte(fmt.Sprintf("%v: %v\n", k, v)))
+        }
 
-    f.Write([]byte("\n"))
-    f.Write(m.RawBody)
+        f.Write([]byte("\n"))
+        f.Write(m.RawBody)
+    }
     f.Close()
 
     return filename, os.Rename(tmpname, filepath.Join(d.dir, "new", filename))
@@ -2,6 +2,7 @@ package maildir
 
 import (
     "fmt"
+    "io/ioutil"
     "os"
     "path/filepath"
     "reflect"
@@ -142,3 +143,72 @@ This is the email body`
     }
 
 }
+
+func TestWriteVerbatim(t *testing.T) {
+    defer os.RemoveAll("tmp")
+
+    dir, err := NewDir("tmp/maildir-test/")
+    if err != nil {
+        t.Errorf("Couldn't create a maildir: %v", err)
+    }
+
+    rawMessage := "To: sender@example.org\r\nFrom: recipient@example.net\r\nX-B: 2\r\nX-A: 1\r\nContent-Type: text/plain\r\n\r\nThis is the email body\r\n"
+
+    m, err := email.NewMessage([]byte(rawMessage))
+    if err != nil {
+        t.Errorf("Example message unparseable: %v", err)
+    }
+
+    m.Prepend("Received", "from example.net\n\tby example.org")
+
+    filename, err := dir.Write(m)
+    if err != nil {
+        t.Errorf("Couldn't write message to maildir: %v", err)
+    }
+
+    b, err := ioutil.ReadFile(filepath.Join(dir.dir, "new", filename))
+    if err != nil {
+        t.Errorf("Couldn't read back '%v': %v", filename, err)
+    }
+
+    want := "Received: from example.net\r\n\tby example.org\r\n" + rawMessage
+    if string(b) != want {
+        t.Errorf("Message not stored verbatim, want: %q, got: %q", want, b)
+    }
+}
+
+func TestWriteBuiltMessage(t *testing.T) {
+    defer os.RemoveAll("tmp")
+
+    dir, err := NewDir("tmp/maildir-test/")
+    if err != nil {
+        t.Errorf("Couldn't create a maildir: %v", err)
+    }
+
+    m := &email.Message{
+        Headers: map[string]string{
+            "To":           "sender@example.org",
+            "From":         "recipient@example.net",
+            "Content-Type": "text/plain",
+        },
+        RawBody: []byte("This is the email body"),
+    }
+    m.Prepend("Received", "from example.net by example.org")
+
+    filename, err := dir.Write(m)
+    if err != nil {
+        t.Errorf("Couldn't write message to maildir: %v", err)
+    }
+
+    n, err := dir.Open(filename)
+    if err != nil {
+        t.Fatalf("Couldn't open message: %v", err)
+    }
+
+    if n.Headers["Received"] != "from example.net by example.org" || n.Headers["From"] != "recipient@example.net" {
+        t.Errorf("Headers not stored, got: %v", n.Headers)
+    }
+    if string(n.RawBody) != "This is the email body" {
+        t.Errorf("Body not stored, got: %q", n.RawBody)
+    }
+}
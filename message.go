@@ -2,14 +2,20 @@ package email
 
 import (
 	"bytes"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math"
+	"math/big"
 	"mime"
 	"mime/multipart"
 	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // type Message interface {
@@ -31,6 +37,22 @@ type Message struct {
 	Subject string
 	Body    []*Part
 	RawBody []byte
+
+	// Raw holds the message exactly as it was received, headers included
+	Raw []byte
+
+	// Warnings lists the problems tolerated while parsing with NewLenientMessage
+	Warnings []error
+
+	// AuthResults holds the outcome of the authentication checks (DKIM, SPF, ...)
+	// run by the server that received the message
+	AuthResults []*AuthResult
+
+	// Envelope is the SMTP transaction the message arrived with, when it was received by smtpd
+	Envelope *Envelope
+
+	header mail.Header
+	id     string
 }
 
 // Part represents a single part of the message
@@ -39,8 +61,206 @@ type Part struct {
 	Body []byte
 }
 
+// ID returns the Message-ID of the message, without the angle brackets. Messages
+// that don't carry a Message-ID get a generated, globally unique one instead
 func (m *Message) ID() string {
-	return "not-implemented"
+	if m.id == "" {
+		if ids := parseMessageIDs(m.header.Get("Message-Id")); len(ids) > 0 {
+			m.id = ids[0]
+		} else {
+			m.id = generateMessageID()
+		}
+	}
+	return m.id
+}
+
+// Date parses the Date header
+func (m *Message) Date() (time.Time, error) {
+	return m.header.Date()
+}
+
+// Cc returns the addresses in the Cc header
+func (m *Message) Cc() ([]*mail.Address, error) {
+	return m.addressList("Cc")
+}
+
+// Bcc returns the addresses in the Bcc header, if the sender left it in
+func (m *Message) Bcc() ([]*mail.Address, error) {
+	return m.addressList("Bcc")
+}
+
+// ReplyTo returns the addresses in the Reply-To header
+func (m *Message) ReplyTo() ([]*mail.Address, error) {
+	return m.addressList("Reply-To")
+}
+
+// Sender returns the address in the Sender header, or nil if there isn't one
+func (m *Message) Sender() (*mail.Address, error) {
+	if m.header.Get("Sender") == "" {
+		return nil, nil
+	}
+	return mail.ParseAddress(m.header.Get("Sender"))
+}
+
+// InReplyTo returns the message IDs listed in the In-Reply-To header
+func (m *Message) InReplyTo() []string {
+	return parseMessageIDs(m.header.Get("In-Reply-To"))
+}
+
+// References returns the message IDs listed in the References header
+func (m *Message) References() []string {
+	return parseMessageIDs(m.header.Get("References"))
+}
+
+// addressList parses an address header, treating a missing header as an empty list
+func (m *Message) addressList(key string) ([]*mail.Address, error) {
+	if m.header.Get(key) == "" {
+		return []*mail.Address{}, nil
+	}
+	return m.header.AddressList(key)
+}
+
+// parseMessageIDs pulls the <id@host> values out of a header, see https://tools.ietf.org/html/rfc5322#section-3.6.4
+func parseMessageIDs(value string) []string {
+	var ids []string
+
+	for {
+		start := strings.Index(value, "<")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(value[start:], ">")
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(value[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+
+	return ids
+}
+
+// generateMessageID builds a message id using the http://www.jwz.org/doc/mid.html recommendation
+func generateMessageID() string {
+	randValue, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		panic(err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatInt(randValue.Int64(), 36) + "@" + hostname
+}
+
+// Prepend adds a header field above all the others, leaving the rest of the raw
+// message untouched. This is how trace fields like Received are meant to be added,
+// see https://tools.ietf.org/html/rfc5322#section-3.6.7. A message built in code,
+// without Raw, only gets the parsed header
+func (m *Message) Prepend(key, value string) {
+	eol := "\n"
+	if i := bytes.IndexByte(m.Raw, '\n'); i > 0 && m.Raw[i-1] == '\r' {
+		eol = "\r\n"
+	}
+	value = strings.Replace(value, "\r\n", "\n", -1)
+
+	if len(m.Raw) > 0 {
+		m.Raw = append([]byte(key+": "+strings.Replace(value, "\n", eol, -1)+eol), m.Raw...)
+	}
+
+	// the parsed headers hold the canonical key & unfolded value
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	value = strings.Replace(value, "\n", "", -1)
+
+	if m.header == nil {
+		m.header = make(mail.Header)
+	}
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+	m.header[key] = append([]string{value}, m.header[key]...)
+
+	if len(m.header[key]) == 1 {
+		m.Headers[key] = value
+	} else {
+		delete(m.Headers, key)
+	}
+}
+
+// Remove deletes the header fields called key whose unfolded value matches, from the
+// raw message as well as the parsed headers, returning how many were removed
+func (m *Message) Remove(key string, match func(value string) bool) int {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+
+	removed := 0
+	if len(m.Raw) > 0 {
+		var kept [][]byte
+		field := -1
+		lines := bytes.SplitAfter(m.Raw, []byte("\n"))
+		for i, line := range lines {
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				// the blank line ending the header section, the body follows as is
+				kept = append(kept, lines[i:]...)
+				break
+			}
+			if (line[0] == ' ' || line[0] == '\t') && field >= 0 {
+				kept[field] = append(kept[field], line...)
+				continue
+			}
+			kept = append(kept, append([]byte{}, line...))
+			field = len(kept) - 1
+		}
+
+		var raw []byte
+		for _, f := range kept {
+			colon := bytes.IndexByte(f, ':')
+			if colon > 0 && textproto.CanonicalMIMEHeaderKey(string(bytes.TrimRight(f[:colon], " \t"))) == key {
+				value := strings.NewReplacer("\r", "", "\n", "").Replace(string(f[colon+1:]))
+				if match(strings.TrimSpace(value)) {
+					removed++
+					continue
+				}
+			}
+			raw = append(raw, f...)
+		}
+		m.Raw = raw
+	}
+
+	var values []string
+	for _, value := range m.header[key] {
+		if match(value) {
+			if len(m.Raw) == 0 {
+				removed++
+			}
+			continue
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		delete(m.header, key)
+	} else {
+		m.header[key] = values
+	}
+
+	if len(values) == 1 && m.Headers != nil {
+		m.Headers[key] = values[0]
+	} else {
+		delete(m.Headers, key)
+	}
+	return removed
+}
+
+// ContentType returns the media type and parameters of the message, falling back
+// to text/plain; charset=us-ascii when the Content-Type header is missing or invalid
+func (m *Message) ContentType() (string, map[string]string) {
+	if mediaType, params, err := mime.ParseMediaType(m.header.Get("Content-Type")); err == nil {
+		return mediaType, params
+	}
+	return defaultMediaType()
 }
 
 // Plain returns the text/plain content of the message, if any
@@ -66,7 +286,7 @@ func (m *Message) FindByType(contentType string) ([]byte, error) {
 }
 
 // parseBody unwraps the body io.Reader into a set of *Part structs
-func parseBody(m *mail.Message) ([]byte, []*Part, error) {
+func parseBody(m *mail.Message, mediaType string, params map[string]string) ([]byte, []*Part, error) {
 
 	mbody, err := ioutil.ReadAll(m.Body)
 	if err != nil {
@@ -76,11 +296,6 @@ func parseBody(m *mail.Message) ([]byte, []*Part, error) {
 
 	var parts []*Part
 
-	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
-	if err != nil {
-		return mbody, parts, fmt.Errorf("Media Type error: %v", err)
-	}
-
 	if strings.HasPrefix(mediaType, "multipart/") {
 		mr := multipart.NewReader(buf, params["boundary"])
 		for {
@@ -93,7 +308,7 @@ func parseBody(m *mail.Message) ([]byte, []*Part, error) {
 
 			slurp, err := ioutil.ReadAll(p)
 			if err != nil {
-				log.Fatal(err)
+				return mbody, parts, fmt.Errorf("MIME error: %v", err)
 			}
 
 			parts = append(parts, &Part{p, slurp})
@@ -105,19 +320,48 @@ func parseBody(m *mail.Message) ([]byte, []*Part, error) {
 
 // NewMessage creates a Message from a data blob
 func NewMessage(data []byte) (*Message, error) {
+	return parseMessage(data, false)
+}
+
+// NewLenientMessage creates a Message from a data blob, recording problems with the
+// To, From and Content-Type headers or the MIME structure in Message.Warnings instead
+// of failing. Only a message without a readable header section is rejected
+func NewLenientMessage(data []byte) (*Message, error) {
+	return parseMessage(data, true)
+}
+
+func parseMessage(data []byte, lenient bool) (*Message, error) {
 	m, err := mail.ReadMessage(bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
 
+	var warnings []error
+
+	// strict parsing needs a To header, lenient parsing lets a missing one through
+	// silently (e.g. Bcc-only mail) and only warns about a broken one
 	to, err := m.Header.AddressList("to")
 	if err != nil {
-		return nil, err
+		if !lenient {
+			return nil, err
+		} else if err != mail.ErrHeaderNotPresent {
+			warnings = append(warnings, fmt.Errorf("To header: %v", err))
+		}
+		to = []*mail.Address{}
 	}
 
+	var sender *mail.Address
 	from, err := m.Header.AddressList("from")
+	if err == nil && len(from) == 0 {
+		err = fmt.Errorf("no address")
+	}
 	if err != nil {
-		return nil, err
+		if !lenient {
+			return nil, err
+		}
+		warnings = append(warnings, fmt.Errorf("From header: %v", err))
+	} else {
+		sender = from[0]
 	}
 
 	header := make(map[string]string)
@@ -128,18 +372,40 @@ func NewMessage(data []byte) (*Message, error) {
 		}
 	}
 
-	raw, parts, err := parseBody(m)
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
 	if err != nil {
-		return nil, err
+		if !lenient {
+			return nil, fmt.Errorf("Media Type error: %v", err)
+		} else if m.Header.Get("Content-Type") != "" {
+			warnings = append(warnings, fmt.Errorf("Media Type error: %v", err))
+		}
+		mediaType, params = defaultMediaType()
+	}
+
+	raw, parts, err := parseBody(m, mediaType, params)
+	if err != nil {
+		if !lenient {
+			return nil, err
+		}
+		warnings = append(warnings, err)
 	}
 
 	return &Message{
-		to,
-		from[0],
-		header,
-		m.Header.Get("subject"),
-		parts,
-		raw,
+		To:       to,
+		From:     sender,
+		Headers:  header,
+		Subject:  m.Header.Get("subject"),
+		Body:     parts,
+		RawBody:  raw,
+		Raw:      data,
+		Warnings: warnings,
+		header:   m.Header,
 	}, nil
 
 }
+
+// defaultMediaType is the Content-Type assumed for messages that lack a usable one,
+// see https://tools.ietf.org/html/rfc2045#section-5.2
+func defaultMediaType() (string, map[string]string) {
+	return "text/plain", map[string]string{"charset": "us-ascii"}
+}
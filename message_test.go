@@ -1 +1,268 @@
 package email
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var attachmentMessage = strings.Replace(`To: recipient@example.net
+From: sender@example.org
+Subject: attachments
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/related; boundary="inner"
+
+--inner
+Content-Type: text/html; charset=utf-8
+
+<img src="cid:logo@example.org"> see attached
+--inner
+Content-Type: image/png
+Content-ID: <logo@example.org>
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgo=
+--inner--
+--outer
+Content-Type: text/plain; name="../../etc/passwd"
+Content-Disposition: attachment; filename="../../etc/passwd"
+Content-Transfer-Encoding: quoted-printable
+
+root:x:0:0=3Aroot
+--outer
+Content-Type: application/pdf
+Content-Disposition: attachment; filename="=?UTF-8?B?csOpc3Vtw6kucGRm?="
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--outer--
+`, "\n", "\r\n", -1)
+
+func TestAttachments(t *testing.T) {
+	m, err := NewMessage([]byte(attachmentMessage))
+	if err != nil {
+		t.Fatalf("Example message unparseable: %v", err)
+	}
+
+	attachments, err := m.Attachments()
+	if err != nil {
+		t.Fatalf("Couldn't list attachments: %v", err)
+	}
+
+	if len(attachments) != 3 {
+		t.Fatalf("Wrong number of attachments, want: 3, got: %v", len(attachments))
+	}
+
+	logo := attachments[0]
+	if !logo.Inline() || logo.ContentID != "logo@example.org" || logo.MediaType != "image/png" {
+		t.Errorf("Inline image not detected properly: %+v", logo)
+	}
+	if logo.Size != 8 {
+		t.Errorf("Inline image should be decoded, want 8 bytes, got: %v", logo.Size)
+	}
+
+	passwd := attachments[1]
+	if passwd.Inline() || passwd.Filename != "../../etc/passwd" {
+		t.Errorf("Attachment not detected properly: %+v", passwd)
+	}
+	if b, _ := ioutil.ReadAll(passwd.Open()); string(b) != "root:x:0:0:root" {
+		t.Errorf("Quoted-printable attachment not decoded, got: %q", b)
+	}
+
+	pdf := attachments[2]
+	if pdf.Filename != "résumé.pdf" {
+		t.Errorf("Encoded filename not decoded, got: %q", pdf.Filename)
+	}
+	if b, _ := ioutil.ReadAll(pdf.Open()); string(b) != "%PDF-1.4\n" {
+		t.Errorf("Base64 attachment not decoded, got: %q", b)
+	}
+}
+
+func TestSinglePartAttachment(t *testing.T) {
+	raw := strings.Replace(`To: recipient@example.net
+From: sender@example.org
+Subject: scan
+MIME-Version: 1.0
+Content-Type: application/pdf
+Content-Disposition: attachment; filename="scan.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+`, "\n", "\r\n", -1)
+
+	m, err := NewMessage([]byte(raw))
+	if err != nil {
+		t.Fatalf("Example message unparseable: %v", err)
+	}
+
+	attachments, err := m.Attachments()
+	if err != nil {
+		t.Fatalf("Couldn't list attachments: %v", err)
+	}
+	if len(attachments) != 1 || attachments[0].Filename != "scan.pdf" || attachments[0].MediaType != "application/pdf" {
+		t.Fatalf("The message itself should be the attachment, got: %+v", attachments)
+	}
+	if b, _ := ioutil.ReadAll(attachments[0].Open()); string(b) != "%PDF-1.4\n" {
+		t.Errorf("Base64 attachment not decoded, got: %q", b)
+	}
+
+	// a plain message has none
+	m, _ = NewMessage([]byte("From: sender@example.org\r\nTo: recipient@example.net\r\nContent-Type: text/plain\r\n\r\nhello\r\n"))
+	if attachments, err := m.Attachments(); err != nil || len(attachments) != 0 {
+		t.Errorf("A plain message has no attachments, got: %v, %v", attachments, err)
+	}
+}
+
+func TestSaveAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatalf("Couldn't create testing dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewMessage([]byte(attachmentMessage))
+	if err != nil {
+		t.Fatalf("Example message unparseable: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		paths, err := m.SaveAttachments(dir)
+		if err != nil {
+			t.Fatalf("Couldn't save attachments: %v", err)
+		}
+		if len(paths) != 3 {
+			t.Fatalf("Wrong number of saved attachments, want: 3, got: %v", len(paths))
+		}
+		for _, p := range paths {
+			if filepath.Dir(p) != dir {
+				t.Errorf("Attachment escaped the target dir: %v", p)
+			}
+		}
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 6 {
+		t.Errorf("Saving twice should not overwrite files, want 6 files, got: %v", len(files))
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "passwd")); err != nil {
+		t.Errorf("Sanitized filename not used: %v", err)
+	}
+}
+
+func TestHeaderAccessors(t *testing.T) {
+	raw := `To: recipient@example.net
+From: sender@example.org
+Cc: "Carbon Copy" <cc@example.net>, other@example.net
+Reply-To: replies@example.org
+Sender: list@example.org
+Date: Mon, 02 Jan 2006 15:04:05 -0700
+Message-ID: <abc.123@example.org>
+In-Reply-To: <parent@example.org>
+References: <root@example.org>
+ <parent@example.org>
+Content-Type: text/plain
+
+body`
+
+	m, err := NewMessage([]byte(raw))
+	if err != nil {
+		t.Fatalf("Example message unparseable: %v", err)
+	}
+
+	if m.ID() != "abc.123@example.org" {
+		t.Errorf("Wrong message ID, got: %v", m.ID())
+	}
+
+	if d, err := m.Date(); err != nil || d.Unix() != 1136239445 {
+		t.Errorf("Wrong date, got: %v (%v)", d, err)
+	}
+
+	if cc, err := m.Cc(); err != nil || len(cc) != 2 || cc[0].Name != "Carbon Copy" {
+		t.Errorf("Wrong Cc list, got: %v (%v)", cc, err)
+	}
+
+	if bcc, err := m.Bcc(); err != nil || len(bcc) != 0 {
+		t.Errorf("Missing Bcc should be an empty list, got: %v (%v)", bcc, err)
+	}
+
+	if rt, err := m.ReplyTo(); err != nil || len(rt) != 1 || rt[0].Address != "replies@example.org" {
+		t.Errorf("Wrong Reply-To, got: %v (%v)", rt, err)
+	}
+
+	if s, err := m.Sender(); err != nil || s.Address != "list@example.org" {
+		t.Errorf("Wrong Sender, got: %v (%v)", s, err)
+	}
+
+	if irt := m.InReplyTo(); len(irt) != 1 || irt[0] != "parent@example.org" {
+		t.Errorf("Wrong In-Reply-To, got: %v", irt)
+	}
+
+	if refs := m.References(); len(refs) != 2 || refs[0] != "root@example.org" || refs[1] != "parent@example.org" {
+		t.Errorf("Wrong References, got: %v", refs)
+	}
+}
+
+func TestGeneratedID(t *testing.T) {
+	m1, _ := NewMessage([]byte("To: a@example.net\nFrom: b@example.org\nContent-Type: text/plain\n\nbody"))
+	m2, _ := NewMessage([]byte("To: a@example.net\nFrom: b@example.org\nContent-Type: text/plain\n\nbody"))
+
+	if m1.ID() == "" || m1.ID() == m2.ID() {
+		t.Errorf("Generated IDs should be unique, got %q and %q", m1.ID(), m2.ID())
+	}
+
+	if m1.ID() != m1.ID() {
+		t.Errorf("Generated ID should be stable for a message")
+	}
+
+	if !strings.Contains(m1.ID(), "@") {
+		t.Errorf("Generated ID should look like a Message-ID, got: %v", m1.ID())
+	}
+}
+
+func TestLenientMessage(t *testing.T) {
+	raw := "Bcc: hidden@example.net\nFrom: \nSubject: no headers\n\nbody"
+
+	if _, err := NewMessage([]byte(raw)); err == nil {
+		t.Errorf("Strict parsing should reject a message without To/From")
+	}
+
+	m, err := NewLenientMessage([]byte(raw))
+	if err != nil {
+		t.Fatalf("Lenient parsing should accept the message: %v", err)
+	}
+
+	if len(m.To) != 0 || m.From != nil {
+		t.Errorf("Missing headers should be empty, got To: %v From: %v", m.To, m.From)
+	}
+
+	if len(m.Warnings) != 1 {
+		t.Errorf("Missing From should be recorded as a warning, got: %v", m.Warnings)
+	}
+
+	if mediaType, params := m.ContentType(); mediaType != "text/plain" || params["charset"] != "us-ascii" {
+		t.Errorf("Content-Type should default to text/plain; charset=us-ascii, got: %v %v", mediaType, params)
+	}
+}
+
+func TestLenientGroups(t *testing.T) {
+	raw := "To: undisclosed-recipients:;\nFrom: sender@example.org, other@example.org\nContent-Type: text/plain; =broken\n\nbody"
+
+	m, err := NewLenientMessage([]byte(raw))
+	if err != nil {
+		t.Fatalf("Lenient parsing should accept the message: %v", err)
+	}
+
+	if len(m.To) != 0 || m.From.Address != "sender@example.org" {
+		t.Errorf("Wrong addresses, got To: %v From: %v", m.To, m.From)
+	}
+
+	if len(m.Warnings) != 1 {
+		t.Errorf("Bad Content-Type should be recorded as a warning, got: %v", m.Warnings)
+	}
+}
@@ -0,0 +1,483 @@
+// Package milter is a client for the Sendmail mail filter protocol (version 6), for running
+// messages past existing filters like OpenDKIM, rspamd or clamav-milter while they're received,
+// see https://github.com/emersion/go-milter/blob/master/milter-protocol.txt
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the protocol version spoken by the client
+const Version = 6
+
+// Actions a filter can ask to take, the client only allows the ones in Client.Actions
+const (
+	ActAddHeaders = 0x01
+	ActChangeBody = 0x02
+	ActAddRcpt    = 0x04
+	ActDelRcpt    = 0x08
+	ActChangeHdrs = 0x10
+	ActQuarantine = 0x20
+	ActChangeFrom = 0x40
+	ActAddRcptPar = 0x80
+	AllActions    = ActAddHeaders | ActChangeBody | ActAddRcpt | ActDelRcpt | ActChangeHdrs | ActQuarantine | ActChangeFrom | ActAddRcptPar
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	maxBodyChunk   = 65535
+	maxPacketSize  = 64 << 20
+)
+
+// Protocol flags, with which a filter leaves out stages it doesn't need or replies it won't send
+const (
+	optNoConnect  = 0x01
+	optNoHelo     = 0x02
+	optNoMail     = 0x04
+	optNoRcpt     = 0x08
+	optNoBody     = 0x10
+	optNoHeaders  = 0x20
+	optNoEOH      = 0x40
+	optNRHeader   = 0x80
+	optNoUnknown  = 0x100
+	optNoData     = 0x200
+	optSkip       = 0x400
+	optNRConnect  = 0x1000
+	optNRHelo     = 0x2000
+	optNRMail     = 0x4000
+	optNRRcpt     = 0x8000
+	optNRData     = 0x10000
+	optNRUnknown  = 0x20000
+	optNREOH      = 0x40000
+	optNRBody     = 0x80000
+	optLeadSpace  = 0x100000
+	offeredProtos = optNoConnect | optNoHelo | optNoMail | optNoRcpt | optNoBody | optNoHeaders | optNoEOH | optNRHeader |
+		optNoUnknown | optNoData | optSkip | optNRConnect | optNRHelo | optNRMail | optNRRcpt | optNRData | optNRUnknown |
+		optNREOH | optNRBody | optLeadSpace
+)
+
+// Stages of the SMTP session, as passed to SetMacros
+const (
+	StageConnect = 'C'
+	StageHelo    = 'H'
+	StageMail    = 'M'
+	StageRcpt    = 'R'
+	StageData    = 'T'
+	StageEOH     = 'N'
+	StageEOM     = 'E'
+)
+
+// Commands sent to the filter
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdEOM     = 'E'
+	cmdHelo    = 'H'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+)
+
+// Replies from the filter
+const (
+	replyAddRcpt    = '+'
+	replyDelRcpt    = '-'
+	replyAddRcptPar = '2'
+	replyShutdown   = '4'
+	replyAccept     = 'a'
+	replyReplBody   = 'b'
+	replyContinue   = 'c'
+	replyDiscard    = 'd'
+	replyChgFrom    = 'e'
+	replyConnFail   = 'f'
+	replyAddHeader  = 'h'
+	replyInsHeader  = 'i'
+	replyChgHeader  = 'm'
+	replyProgress   = 'p'
+	replyQuarantine = 'q'
+	replyReject     = 'r'
+	replySkip       = 's'
+	replyTempFail   = 't'
+	replyReplyCode  = 'y'
+)
+
+// Action is what a filter decided at some stage
+type Action int
+
+const (
+	// Continue on to the next stage
+	Continue Action = iota
+	// Accept the message (or connection) without calling the filter for it again
+	Accept
+	// Reject the command, or the message at the end of it
+	Reject
+	// TempFail the command or message
+	TempFail
+	// Discard the message, while telling the client it was accepted
+	Discard
+	// Skip the rest of the body
+	Skip
+)
+
+// Response is the filter's verdict for a stage
+type Response struct {
+	Action Action
+
+	// Reply is the SMTP reply the filter picked for a Reject or TempFail, e.g.
+	// "550 5.7.1 Spam detected". Empty for the server's default reply
+	Reply string
+}
+
+// Client connects to a filter
+type Client struct {
+	// Network & Address of the filter, e.g. "tcp" & "127.0.0.1:8891", or "unix" & "/run/opendkim.sock"
+	Network string
+	Address string
+
+	// Timeout applies to connecting and to each reply from the filter
+	Timeout time.Duration
+
+	// Actions the filter is allowed to take, a combination of the Act flags
+	Actions uint32
+}
+
+// NewClient creates a client for the filter at address, allowing it every action
+func NewClient(network, address string) *Client {
+	return &Client{
+		Network: network,
+		Address: address,
+		Timeout: defaultTimeout,
+		Actions: AllActions,
+	}
+}
+
+// Session is the conversation with a filter about a single SMTP connection
+type Session struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	// the actions & protocol flags agreed with the filter
+	actions  uint32
+	protocol uint32
+}
+
+// Open connects to the filter and negotiates the protocol, ready for a new SMTP connection
+func (c *Client) Open() (*Session, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	conn, err := net.DialTimeout(c.Network, c.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{conn: conn, timeout: timeout}
+
+	negotiation := make([]byte, 12)
+	binary.BigEndian.PutUint32(negotiation, Version)
+	binary.BigEndian.PutUint32(negotiation[4:], c.Actions)
+	binary.BigEndian.PutUint32(negotiation[8:], offeredProtos)
+	if err := s.send(cmdOptNeg, negotiation); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	code, data, err := s.receive()
+	if err == nil && (code != cmdOptNeg || len(data) < 12) {
+		err = fmt.Errorf("Unexpected reply %q to option negotiation", code)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if version := binary.BigEndian.Uint32(data); version < 2 || version > Version {
+		conn.Close()
+		return nil, fmt.Errorf("Unsupported milter protocol version %v", version)
+	}
+	s.actions = binary.BigEndian.Uint32(data[4:]) & c.Actions
+	s.protocol = binary.BigEndian.Uint32(data[8:]) & offeredProtos
+
+	return s, nil
+}
+
+// send writes a packet: its length, the command code & the data
+func (s *Session) send(code byte, data []byte) error {
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = code
+
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	_, err := s.conn.Write(append(packet, data...))
+	return err
+}
+
+// receive reads a packet from the filter
+func (s *Session) receive() (byte, []byte, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size == 0 || size > maxPacketSize {
+		return 0, nil, fmt.Errorf("Invalid milter packet length %v", size)
+	}
+
+	data := make([]byte, size-1)
+	if _, err := io.ReadFull(s.conn, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+// command sends a command, and reads the filter's response unless it said it wouldn't send one
+func (s *Session) command(code byte, data []byte, noReply uint32) (*Response, error) {
+	if err := s.send(code, data); err != nil {
+		return nil, err
+	}
+	if s.protocol&noReply != 0 {
+		return &Response{Action: Continue}, nil
+	}
+
+	for {
+		code, data, err := s.receive()
+		if err != nil {
+			return nil, err
+		}
+		if code == replyProgress {
+			// the filter needs more time
+			continue
+		}
+		return response(code, data)
+	}
+}
+
+// response converts a reply code into a verdict
+func response(code byte, data []byte) (*Response, error) {
+	switch code {
+	case replyContinue:
+		return &Response{Action: Continue}, nil
+	case replyAccept:
+		return &Response{Action: Accept}, nil
+	case replyReject:
+		return &Response{Action: Reject}, nil
+	case replyTempFail, replyShutdown, replyConnFail:
+		return &Response{Action: TempFail}, nil
+	case replyDiscard:
+		return &Response{Action: Discard}, nil
+	case replySkip:
+		return &Response{Action: Skip}, nil
+	case replyReplyCode:
+		reply := string(bytes.TrimRight(data, "\x00"))
+		if len(reply) < 3 || (reply[0] != '4' && reply[0] != '5') {
+			return nil, fmt.Errorf("Invalid milter reply %q", reply)
+		}
+		if _, err := strconv.Atoi(reply[:3]); err != nil {
+			return nil, fmt.Errorf("Invalid milter reply %q", reply)
+		}
+		if reply[0] == '4' {
+			return &Response{Action: TempFail, Reply: reply}, nil
+		}
+		return &Response{Action: Reject, Reply: reply}, nil
+	}
+	return nil, fmt.Errorf("Unexpected milter reply %q", code)
+}
+
+// strings0 joins values as NUL-terminated strings
+func strings0(values ...string) []byte {
+	var buf bytes.Buffer
+	for _, value := range values {
+		buf.WriteString(value)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// SetMacros sends the values of Sendmail macros (like "j", "i" or "{auth_authen}") for
+// the filter to use at the next stage. Call it before the stage's command
+func (s *Session) SetMacros(stage byte, macros map[string]string) error {
+	if len(macros) == 0 {
+		return nil
+	}
+
+	data := []byte{stage}
+	for name, value := range macros {
+		if len(name) > 1 && !strings.HasPrefix(name, "{") {
+			name = "{" + name + "}"
+		}
+		data = append(data, strings0(name, value)...)
+	}
+	return s.send(cmdMacro, data)
+}
+
+// Connect tells the filter about a new client, by its hostname and address
+func (s *Session) Connect(hostname string, addr net.Addr) (*Response, error) {
+	if s.protocol&optNoConnect != 0 {
+		return &Response{Action: Continue}, nil
+	}
+
+	data := strings0(hostname)
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		family := byte('4')
+		if addr.IP.To4() == nil {
+			family = '6'
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, uint16(addr.Port))
+		data = append(append(append(data, family), port...), strings0(addr.IP.String())...)
+	case *net.UnixAddr:
+		data = append(append(data, 'L', 0, 0), strings0(addr.Name)...)
+	default:
+		data = append(data, 'U')
+	}
+
+	return s.command(cmdConnect, data, optNRConnect)
+}
+
+// Helo passes on the HELO/EHLO name
+func (s *Session) Helo(name string) (*Response, error) {
+	if s.protocol&optNoHelo != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return s.command(cmdHelo, strings0(name), optNRHelo)
+}
+
+// Mail passes on the sender and the ESMTP parameters of MAIL FROM
+func (s *Session) Mail(from string, params []string) (*Response, error) {
+	if s.protocol&optNoMail != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return s.command(cmdMail, strings0(append([]string{"<" + from + ">"}, params...)...), optNRMail)
+}
+
+// Rcpt passes on a recipient and the ESMTP parameters of RCPT TO
+func (s *Session) Rcpt(to string, params []string) (*Response, error) {
+	if s.protocol&optNoRcpt != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return s.command(cmdRcpt, strings0(append([]string{"<" + to + ">"}, params...)...), optNRRcpt)
+}
+
+// Abort ends the current message (e.g. on RSET), the connection goes on
+func (s *Session) Abort() error {
+	return s.send(cmdAbort, nil)
+}
+
+// Close says goodbye to the filter
+func (s *Session) Close() error {
+	s.send(cmdQuit, nil)
+	return s.conn.Close()
+}
+
+// SendMessage passes the message on (DATA, its headers & body) and returns the filter's
+// verdict, with the changes it asks for when that's Continue or Accept. raw is the whole
+// message as received; stages stop at the first response that isn't Continue
+func (s *Session) SendMessage(raw []byte) (*Response, []*Modification, error) {
+	if s.protocol&optNoData == 0 {
+		if r, err := s.command(cmdData, nil, optNRData); err != nil || r.Action != Continue {
+			return r, nil, err
+		}
+	}
+
+	fields, body := splitMessage(raw)
+
+	if s.protocol&optNoHeaders == 0 {
+		for _, f := range fields {
+			value := f.value
+			if s.protocol&optLeadSpace == 0 {
+				value = strings.TrimLeft(value, " \t")
+			}
+			if r, err := s.command(cmdHeader, strings0(f.name, value), optNRHeader); err != nil || r.Action != Continue {
+				return r, nil, err
+			}
+		}
+	}
+
+	if s.protocol&optNoEOH == 0 {
+		if r, err := s.command(cmdEOH, nil, optNREOH); err != nil || r.Action != Continue {
+			return r, nil, err
+		}
+	}
+
+	if s.protocol&optNoBody == 0 {
+	Body:
+		for len(body) > 0 {
+			chunk := body
+			if len(chunk) > maxBodyChunk {
+				chunk = chunk[:maxBodyChunk]
+			}
+			body = body[len(chunk):]
+
+			r, err := s.command(cmdBody, chunk, optNRBody)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch r.Action {
+			case Continue:
+			case Skip:
+				break Body
+			default:
+				return r, nil, nil
+			}
+		}
+	}
+
+	return s.endOfMessage()
+}
+
+// endOfMessage collects the changes the filter makes, up to its final verdict
+func (s *Session) endOfMessage() (*Response, []*Modification, error) {
+	if err := s.send(cmdEOM, nil); err != nil {
+		return nil, nil, err
+	}
+
+	var mods []*Modification
+	for {
+		code, data, err := s.receive()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch code {
+		case replyProgress:
+			continue
+		case replyAddRcpt, replyDelRcpt, replyAddRcptPar, replyReplBody, replyChgFrom,
+			replyAddHeader, replyInsHeader, replyChgHeader, replyQuarantine:
+			mod, err := s.modification(code, data)
+			if err != nil {
+				return nil, nil, err
+			}
+			if mod.Kind == ReplaceBody && len(mods) > 0 && mods[len(mods)-1].Kind == ReplaceBody {
+				// a new body comes in chunks
+				mods[len(mods)-1].Body = append(mods[len(mods)-1].Body, mod.Body...)
+				continue
+			}
+			mods = append(mods, mod)
+			continue
+		}
+
+		r, err := response(code, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, mods, nil
+	}
+}
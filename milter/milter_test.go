@@ -0,0 +1,249 @@
+package milter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type packet struct {
+	code byte
+	data string
+}
+
+// fakeFilter plays the filter side of the protocol, replying to each command with the
+// packets respond returns (Continue when it returns none)
+type fakeFilter struct {
+	listener net.Listener
+	actions  uint32
+	protocol uint32
+	respond  func(code byte, data string) []packet
+
+	lock sync.Mutex
+	seen []string
+}
+
+func newFakeFilter(t *testing.T, respond func(code byte, data string) []packet) *fakeFilter {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	f := &fakeFilter{listener: listener, actions: AllActions, respond: respond}
+	go f.serve()
+	return f
+}
+
+func (f *fakeFilter) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeFilter) handle(conn net.Conn) {
+	defer conn.Close()
+
+	write := func(p packet) {
+		header := make([]byte, 5)
+		binary.BigEndian.PutUint32(header, uint32(len(p.data)+1))
+		header[4] = p.code
+		conn.Write(append(header, p.data...))
+	}
+
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header)-1)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		code := header[4]
+		switch code {
+		case cmdOptNeg:
+			negotiation := make([]byte, 12)
+			binary.BigEndian.PutUint32(negotiation, Version)
+			binary.BigEndian.PutUint32(negotiation[4:], f.actions)
+			binary.BigEndian.PutUint32(negotiation[8:], f.protocol)
+			write(packet{cmdOptNeg, string(negotiation)})
+			continue
+		case cmdQuit:
+			return
+		}
+
+		f.lock.Lock()
+		f.seen = append(f.seen, fmt.Sprintf("%c %q", code, data))
+		f.lock.Unlock()
+
+		if code == cmdMacro || code == cmdAbort {
+			continue
+		}
+
+		replies := f.respond(code, string(data))
+		if len(replies) == 0 {
+			replies = []packet{{replyContinue, ""}}
+		}
+		for _, reply := range replies {
+			write(reply)
+		}
+	}
+}
+
+func (f *fakeFilter) Seen() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.seen...)
+}
+
+const message = "Subject: hello\r\nFrom: sender@example.org\r\n\r\nhi\r\n"
+
+func TestSession(t *testing.T) {
+
+	filter := newFakeFilter(t, func(code byte, data string) []packet {
+		if code != cmdEOM {
+			return nil
+		}
+		return []packet{
+			{replyAddHeader, "X-Spam\x00no\x00"},
+			{replyChgHeader, "\x00\x00\x00\x01Subject\x00[filtered] hello\x00"},
+			{replyReplBody, "new "},
+			{replyReplBody, "body\r\n"},
+			{replyAddRcpt, "<extra@example.net>\x00"},
+			{replyContinue, ""},
+		}
+	})
+	defer filter.listener.Close()
+
+	session, err := NewClient("tcp", filter.listener.Addr().String()).Open()
+	if err != nil {
+		t.Fatalf("Couldn't open a session: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.SetMacros(StageConnect, map[string]string{"j": "mx.example.org"}); err != nil {
+		t.Fatalf("SetMacros failed: %v", err)
+	}
+	steps := []func() (*Response, error){
+		func() (*Response, error) {
+			return session.Connect("client.example.net", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321})
+		},
+		func() (*Response, error) { return session.Helo("client.example.net") },
+		func() (*Response, error) { return session.Mail("sender@example.org", []string{"BODY=8BITMIME"}) },
+		func() (*Response, error) { return session.Rcpt("user@example.net", nil) },
+	}
+	for i, step := range steps {
+		if r, err := step(); err != nil || r.Action != Continue {
+			t.Fatalf("Step %v should continue, got: %+v, %v", i, r, err)
+		}
+	}
+
+	r, mods, err := session.SendMessage([]byte(message))
+	if err != nil || r.Action != Continue {
+		t.Fatalf("The message should continue, got: %+v, %v", r, err)
+	}
+
+	want := []string{
+		`D "Cj\x00mx.example.org\x00"`,
+		`C "client.example.net\x004\x10\xe1192.0.2.1\x00"`,
+		`H "client.example.net\x00"`,
+		`M "<sender@example.org>\x00BODY=8BITMIME\x00"`,
+		`R "<user@example.net>\x00"`,
+		`T ""`,
+		`L "Subject\x00hello\x00"`,
+		`L "From\x00sender@example.org\x00"`,
+		`N ""`,
+		`B "hi\r\n"`,
+		`E ""`,
+	}
+	if seen := filter.Seen(); !reflect.DeepEqual(seen, want) {
+		t.Errorf("The filter should have seen:\n%v\ngot:\n%v", want, seen)
+	}
+
+	if len(mods) != 4 {
+		t.Fatalf("Expected 4 modifications, got: %v", len(mods))
+	}
+	if mods[3].Kind != AddRecipient || mods[3].Address != "extra@example.net" {
+		t.Errorf("Expected an added recipient, got: %+v", mods[3])
+	}
+
+	modified := "Subject: [filtered] hello\r\nFrom: sender@example.org\r\nX-Spam: no\r\n\r\nnew body\r\n"
+	if got := string(Apply([]byte(message), mods)); got != modified {
+		t.Errorf("Expected the modified message:\n%q\ngot:\n%q", modified, got)
+	}
+}
+
+func TestSessionReject(t *testing.T) {
+
+	filter := newFakeFilter(t, func(code byte, data string) []packet {
+		switch code {
+		case cmdMail:
+			return []packet{{replyTempFail, ""}}
+		case cmdRcpt:
+			return []packet{{replyProgress, ""}, {replyReplyCode, "550 5.7.1 No such user\x00"}}
+		}
+		return nil
+	})
+	defer filter.listener.Close()
+
+	session, err := NewClient("tcp", filter.listener.Addr().String()).Open()
+	if err != nil {
+		t.Fatalf("Couldn't open a session: %v", err)
+	}
+	defer session.Close()
+
+	if r, err := session.Mail("sender@example.org", nil); err != nil || r.Action != TempFail {
+		t.Errorf("MAIL should tempfail, got: %+v, %v", r, err)
+	}
+	if r, err := session.Rcpt("nobody@example.net", nil); err != nil || r.Action != Reject || r.Reply != "550 5.7.1 No such user" {
+		t.Errorf("RCPT should be rejected with the filter's reply, got: %+v, %v", r, err)
+	}
+}
+
+func TestSessionActions(t *testing.T) {
+
+	filter := newFakeFilter(t, func(code byte, data string) []packet {
+		if code == cmdEOM {
+			return []packet{{replyReplBody, "new body\r\n"}, {replyContinue, ""}}
+		}
+		return nil
+	})
+	defer filter.listener.Close()
+
+	client := NewClient("tcp", filter.listener.Addr().String())
+	client.Actions = ActAddHeaders
+	session, err := client.Open()
+	if err != nil {
+		t.Fatalf("Couldn't open a session: %v", err)
+	}
+	defer session.Close()
+
+	if _, _, err := session.SendMessage([]byte(message)); err == nil {
+		t.Errorf("Replacing the body shouldn't be allowed without negotiating it")
+	}
+}
+
+func TestApply(t *testing.T) {
+
+	raw := "Received: from a\n\tby b\nSubject: hello\nX-Old: 1\nX-Old: 2\n\nbody\n"
+	mods := []*Modification{
+		{Kind: InsertHeader, Index: 0, Name: "X-First", Value: "yes"},
+		{Kind: ChangeHeader, Index: 2, Name: "x-old", Value: ""},
+		{Kind: ChangeHeader, Index: 1, Name: "X-Missing", Value: "added"},
+		{Kind: AddHeader, Name: "X-Folded", Value: "one\n\ttwo"},
+	}
+
+	want := "X-First: yes\r\nReceived: from a\r\n\tby b\r\nSubject: hello\r\nX-Old: 1\r\n" +
+		"X-Missing: added\r\nX-Folded: one\r\n\ttwo\r\n\r\nbody\r\n"
+	if got := string(Apply([]byte(raw), mods)); got != want {
+		t.Errorf("Expected:\n%q\ngot:\n%q", want, got)
+	}
+}
@@ -0,0 +1,241 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Kinds of modification a filter can make at the end of a message
+const (
+	AddHeader       = replyAddHeader
+	InsertHeader    = replyInsHeader
+	ChangeHeader    = replyChgHeader
+	AddRecipient    = replyAddRcpt
+	DeleteRecipient = replyDelRcpt
+	ChangeFrom      = replyChgFrom
+	ReplaceBody     = replyReplBody
+	Quarantine      = replyQuarantine
+)
+
+// Modification is a change a filter asked for
+type Modification struct {
+	// Kind is one of AddHeader, InsertHeader, ChangeHeader, AddRecipient, DeleteRecipient,
+	// ChangeFrom, ReplaceBody or Quarantine
+	Kind byte
+
+	// Name & Value of the header to add, insert or change. An empty Value for
+	// ChangeHeader deletes the header
+	Name  string
+	Value string
+
+	// Index is the position to insert a header at (0 for the top), or which occurrence
+	// of Name to change, counting from 1
+	Index int
+
+	// Address is the recipient or sender, without angle brackets, with its ESMTP Params
+	Address string
+	Params  string
+
+	// Body is the new message body
+	Body []byte
+
+	// Reason is why the filter wants the message quarantined
+	Reason string
+}
+
+// requiredAction is the negotiated action a kind of modification needs
+var requiredAction = map[byte]uint32{
+	AddHeader:       ActAddHeaders,
+	InsertHeader:    ActAddHeaders,
+	ChangeHeader:    ActChangeHdrs,
+	AddRecipient:    ActAddRcpt,
+	replyAddRcptPar: ActAddRcptPar,
+	DeleteRecipient: ActDelRcpt,
+	ChangeFrom:      ActChangeFrom,
+	ReplaceBody:     ActChangeBody,
+	Quarantine:      ActQuarantine,
+}
+
+// modification parses a modification the filter sent, checking that it was allowed to
+func (s *Session) modification(code byte, data []byte) (*Modification, error) {
+	if s.actions&requiredAction[code] == 0 {
+		return nil, fmt.Errorf("Milter asked for modification %q without negotiating it", code)
+	}
+
+	mod := &Modification{Kind: code}
+	if code == replyAddRcptPar {
+		mod.Kind = AddRecipient
+	}
+
+	switch code {
+	case InsertHeader, ChangeHeader:
+		if len(data) < 4 {
+			return nil, fmt.Errorf("Short milter modification %q", code)
+		}
+		mod.Index = int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+	case ReplaceBody:
+		mod.Body = append([]byte(nil), data...)
+		return mod, nil
+	}
+
+	args := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+
+	switch code {
+	case AddHeader, InsertHeader, ChangeHeader:
+		if len(args) != 2 || args[0] == "" {
+			return nil, fmt.Errorf("Malformed milter header modification")
+		}
+		mod.Name, mod.Value = args[0], args[1]
+	case AddRecipient, replyAddRcptPar, DeleteRecipient, ChangeFrom:
+		mod.Address = strings.TrimSuffix(strings.TrimPrefix(args[0], "<"), ">")
+		if len(args) > 1 {
+			mod.Params = args[1]
+		}
+	case Quarantine:
+		mod.Reason = args[0]
+	}
+
+	return mod, nil
+}
+
+// field is a single header field: its name, and its value with folding kept
+type field struct {
+	name  string
+	value string
+}
+
+// splitMessage splits a message into its header fields, with internal folds as bare LF
+// like Sendmail & Postfix do, and its body with CRLF line endings
+func splitMessage(raw []byte) ([]field, []byte) {
+	head, body := splitHead(toCRLF(raw))
+
+	var fields []field
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		line = strings.TrimSuffix(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += "\n" + line
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		fields = append(fields, field{strings.TrimRight(line[:colon], " \t"), line[colon+1:]})
+	}
+
+	return fields, body
+}
+
+// splitHead cuts a CRLF message into its header section (with the final CRLF of the
+// last field) and body
+func splitHead(data []byte) ([]byte, []byte) {
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		return nil, data[2:]
+	} else if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return data[:i+2], data[i+4:]
+	}
+	return data, nil
+}
+
+// toCRLF converts bare LF line endings to CRLF
+func toCRLF(data []byte) []byte {
+	if bytes.Count(data, []byte("\n")) == bytes.Count(data, []byte("\r\n")) {
+		return data
+	}
+
+	var buf bytes.Buffer
+	for i, b := range data {
+		if b == '\n' && (i == 0 || data[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(b)
+	}
+	return buf.Bytes()
+}
+
+// Apply makes the header & body changes in mods to a raw message, returning it with CRLF
+// line endings. Changes to the envelope (recipients, sender) and quarantine requests are
+// left to the caller
+func Apply(raw []byte, mods []*Modification) []byte {
+	head, body := splitHead(toCRLF(raw))
+
+	// each entry holds one whole field, folding & CRLF included
+	var fields []string
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+
+	for _, mod := range mods {
+		switch mod.Kind {
+		case AddHeader:
+			fields = append(fields, formatField(mod.Name, mod.Value))
+		case InsertHeader:
+			index := mod.Index
+			if index < 0 || index > len(fields) {
+				index = len(fields)
+			}
+			fields = append(fields[:index], append([]string{formatField(mod.Name, mod.Value)}, fields[index:]...)...)
+		case ChangeHeader:
+			fields = changeField(fields, mod)
+		case ReplaceBody:
+			body = toCRLF(mod.Body)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, f := range fields {
+		buf.WriteString(f)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// changeField replaces (or with an empty value, deletes) the Index'th field called Name,
+// adding it when there are fewer of them
+func changeField(fields []string, mod *Modification) []string {
+	seen := 0
+	for i, f := range fields {
+		colon := strings.Index(f, ":")
+		if colon < 0 || !strings.EqualFold(strings.TrimRight(f[:colon], " \t"), mod.Name) {
+			continue
+		}
+		seen++
+		if seen != mod.Index && mod.Index > 0 {
+			continue
+		}
+
+		if mod.Value == "" {
+			return append(fields[:i], fields[i+1:]...)
+		}
+		fields[i] = formatField(mod.Name, mod.Value)
+		return fields
+	}
+
+	if mod.Value != "" {
+		fields = append(fields, formatField(mod.Name, mod.Value))
+	}
+	return fields
+}
+
+// formatField builds a header field from what a filter sent, which folds lines with bare LF
+func formatField(name, value string) string {
+	value = strings.Replace(strings.Replace(value, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	if !strings.HasPrefix(value, " ") && !strings.HasPrefix(value, "\t") {
+		value = " " + value
+	}
+	return name + ":" + value + "\r\n"
+}
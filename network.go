@@ -0,0 +1,71 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Networks is a list of IP ranges, like the load balancers trusted to send PROXY
+// headers or the clients a server refuses
+type Networks []*net.IPNet
+
+// ParseNetworks parses CIDR ranges ("192.0.2.0/24", "2001:db8::/32"), bare addresses
+// are taken as single hosts
+func ParseNetworks(cidrs ...string) (Networks, error) {
+	var networks Networks
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Contains checks whether ip falls within any of the networks
+func (n Networks) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddrIP extracts the IP address of a TCP (or similar) network address, nil for
+// addresses without one, like Unix sockets
+func AddrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
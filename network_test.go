@@ -0,0 +1,38 @@
+package email
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetworks(t *testing.T) {
+	networks, err := ParseNetworks("192.0.2.0/24", "2001:db8::/32", "198.51.100.7", "::1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for ip, want := range map[string]bool{
+		"192.0.2.200":     true,
+		"192.0.3.1":       false,
+		"198.51.100.7":    true,
+		"198.51.100.8":    false,
+		"2001:db8::25":    true,
+		"2001:db9::25":    false,
+		"::1":             true,
+		"::ffff:c000:201": true,
+	} {
+		if got := networks.Contains(net.ParseIP(ip)); got != want {
+			t.Errorf("%v: want %v, got %v", ip, want, got)
+		}
+	}
+
+	if networks.Contains(nil) {
+		t.Errorf("A missing address shouldn't match")
+	}
+
+	for _, bad := range []string{"192.0.2.0/33", "example.com", "192.0.2"} {
+		if _, err := ParseNetworks(bad); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
     "strings"
 
     "github.com/hownowstephen/email"
+    "github.com/hownowstephen/email/proxyproto"
 )
 
 const (
@@ -43,6 +44,10 @@ type Server struct {
     // RateLimiter gets called before proceeding through to message handling
     RateLimiter func(*Conn) bool
 
+    // ProxyProtocol lists the load balancers allowed to send a PROXY protocol header, so
+    // that Conn.RemoteAddr is the real client's address rather than the balancer's. Empty disables it
+    ProxyProtocol email.Networks
+
     // Handler is the handoff function for messages
     Handler MessageHandler
 
@@ -120,6 +125,10 @@ func (s *Server) ListenAndServe(addr string) error {
         return err
     }
 
+    if len(s.ProxyProtocol) > 0 {
+        listener = proxyproto.NewListener(listener, s.ProxyProtocol)
+    }
+
     var clientID int64
     clientID = 1
 
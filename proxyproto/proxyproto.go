@@ -0,0 +1,269 @@
+// Package proxyproto reads the PROXY protocol headers (versions 1 & 2) that load balancers
+// like HAProxy send ahead of a proxied connection, so that servers behind them see the real
+// client address, see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+// DefaultTimeout is how long a trusted source gets to send its header
+const DefaultTimeout = 10 * time.Second
+
+// v2Signature starts every version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength is the longest a version 1 header can be, CRLF included
+const v1MaxLength = 107
+
+// Listener wraps a net.Listener, reading the PROXY header sent by connections from
+// Trusted networks. Connections from anywhere else are passed through untouched
+type Listener struct {
+	net.Listener
+
+	// Trusted lists the load balancers, connections from them must start with a PROXY header
+	Trusted email.Networks
+
+	// Timeout limits how long reading a header can take, DefaultTimeout when zero
+	Timeout time.Duration
+}
+
+// NewListener wraps listener, trusting the given networks to send PROXY headers
+func NewListener(listener net.Listener, trusted email.Networks) *Listener {
+	return &Listener{Listener: listener, Trusted: trusted}
+}
+
+// Accept waits for the next connection. The header of a proxied connection is read on its
+// first Read or RemoteAddr call, so that a slow balancer doesn't hold up other connections
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.Trusted.Contains(email.AddrIP(conn.RemoteAddr())) {
+		return conn, nil
+	}
+
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Conn{Conn: conn, timeout: timeout}, nil
+}
+
+// Conn is a proxied connection, reporting the addresses from its PROXY header
+type Conn struct {
+	net.Conn
+
+	timeout  time.Duration
+	deadline time.Time
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+// readHeader consumes the PROXY header, under the connection's own read deadline if that's sooner
+func (c *Conn) readHeader() {
+	deadline := time.Now().Add(c.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	c.Conn.SetReadDeadline(deadline)
+	defer c.Conn.SetReadDeadline(c.deadline)
+
+	c.reader = bufio.NewReader(c.Conn)
+	c.remote, c.local, c.err = ReadHeader(c.reader)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr is the client address given in the header, or the balancer's address for
+// health checks & unknown protocols
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to, as given in the header
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyAddr is the address of the load balancer itself
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// ReadHeader reads a version 1 or 2 PROXY header, returning the source & destination
+// addresses. Both are nil when the header doesn't carry any (v1 UNKNOWN, v2 LOCAL)
+func ReadHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Reading PROXY header: %v", err)
+	}
+
+	switch first[0] {
+	case 'P':
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	}
+	return nil, nil, fmt.Errorf("Missing PROXY header")
+}
+
+// readV1 parses the human-readable header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLength {
+			return nil, nil, fmt.Errorf("PROXY header too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Reading PROXY header: %v", err)
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, fmt.Errorf("Invalid PROXY header %q", line)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, fmt.Errorf("Unsupported PROXY protocol %v", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("Invalid PROXY header %q", line)
+	}
+
+	src, err := v1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := v1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func v1Addr(protocol, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (protocol == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("Invalid %v address %q in PROXY header", protocol, host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("Invalid port %q in PROXY header", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// Version 2 commands & address families
+const (
+	v2Local = 0x0
+	v2Proxy = 0x1
+
+	v2Inet  = 0x1
+	v2Inet6 = 0x2
+)
+
+// readV2 parses the binary header
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("Reading PROXY header: %v", err)
+	}
+	if !bytes.Equal(header[:12], v2Signature) {
+		return nil, nil, fmt.Errorf("Invalid PROXY v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("Unsupported PROXY version %v", header[12]>>4)
+	}
+
+	// the addresses are followed by TLVs, which aren't used
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("Reading PROXY header: %v", err)
+	}
+
+	switch header[12] & 0xF {
+	case v2Local:
+		// health checks from the balancer itself
+		return nil, nil, nil
+	case v2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("Unsupported PROXY command %v", header[12]&0xF)
+	}
+
+	size := 0
+	switch header[13] >> 4 {
+	case v2Inet:
+		size = net.IPv4len
+	case v2Inet6:
+		size = net.IPv6len
+	default:
+		// AF_UNIX & unspecified addresses don't mean anything to the server
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return nil, nil, fmt.Errorf("PROXY header too short for its addresses")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,146 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+func v2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte(nil), v2Signature...)
+	header = append(header, 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadHeader(t *testing.T) {
+	inet := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25}
+	inet6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0, 25)
+
+	tests := []struct {
+		header string
+		src    string
+		dst    string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", "192.0.2.1:56324", "198.51.100.1:25"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:25"},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", ""},
+		{string(v2Header(v2Proxy, v2Inet, inet)), "192.0.2.1:56324", "198.51.100.1:25"},
+		{string(v2Header(v2Proxy, v2Inet6, inet6)), "[2001:db8::1]:56324", "[2001:db8::2]:25"},
+		// TLVs after the addresses are skipped
+		{string(v2Header(v2Proxy, v2Inet, append(inet, 0x04, 0, 1, 'x'))), "192.0.2.1:56324", "198.51.100.1:25"},
+		{string(v2Header(v2Local, 0, nil)), "", ""},
+	}
+
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "EHLO client\r\n"))
+		src, dst, err := ReadHeader(r)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.header, err)
+			continue
+		}
+
+		if test.src == "" {
+			if src != nil || dst != nil {
+				t.Errorf("%q: expected no addresses, got: %v %v", test.header, src, dst)
+			}
+		} else if src == nil || src.String() != test.src || dst == nil || dst.String() != test.dst {
+			t.Errorf("%q: want %v -> %v, got: %v -> %v", test.header, test.src, test.dst, src, dst)
+		}
+
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "EHLO client\r\n" {
+			t.Errorf("%q: the header should be consumed exactly, left: %q", test.header, rest)
+		}
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	tests := []string{
+		"EHLO client\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 99999 25\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 56324 25\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25",
+		"PROXY " + strings.Repeat("x", 200) + "\r\n",
+		string(v2Header(v2Proxy, v2Inet, []byte{192, 0, 2, 1})),
+		string(bytes.Replace(v2Header(v2Local, 0, nil), []byte("QUIT"), []byte("QUIZ"), 1)),
+	}
+
+	for _, header := range tests {
+		if src, dst, err := ReadHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("%q: expected an error, got: %v %v", header, src, dst)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	defer l.Close()
+
+	trusted, _ := email.ParseNetworks("127.0.0.1")
+	listener := NewListener(l, trusted)
+
+	accept := func(send string) net.Conn {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Couldn't connect: %v", err)
+		}
+		client.Write([]byte(send))
+		defer client.Close()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Couldn't accept: %v", err)
+		}
+		return conn
+	}
+
+	conn := accept("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nHELLO")
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("Expected the client address from the header, got: %v", got)
+	}
+	if got := conn.(*Conn).ProxyAddr().String(); !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("Expected the balancer's address, got: %v", got)
+	}
+	if data, _ := ioutil.ReadAll(conn); string(data) != "HELLO" {
+		t.Errorf("Expected the data after the header, got: %q", data)
+	}
+	conn.Close()
+
+	// a trusted source without a header is refused
+	conn = accept("HELLO")
+	if _, err := ioutil.ReadAll(conn); err == nil {
+		t.Errorf("Expected an error for a missing header")
+	}
+	conn.Close()
+
+	// the connection's own deadline still applies while waiting for the header
+	client, _ := net.Dial("tcp", l.Addr().String())
+	defer client.Close()
+	conn, _ = listener.Accept()
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil || time.Since(start) > time.Second {
+		t.Errorf("Expected the read to time out quickly, got: %v after %v", err, time.Since(start))
+	}
+	conn.Close()
+
+	// anyone else is passed through untouched
+	listener.Trusted, _ = email.ParseNetworks("192.0.2.0/24")
+	conn = accept("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+	if _, ok := conn.(*Conn); ok || !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:") {
+		t.Errorf("Untrusted connections shouldn't be parsed, got: %v", conn.RemoteAddr())
+	}
+	conn.Close()
+}
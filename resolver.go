@@ -0,0 +1,20 @@
+package email
+
+import "net"
+
+// Resolver performs the DNS lookups needed by the servers and sender checks,
+// so that they can be pointed at a fake resolver in tests
+type Resolver interface {
+	LookupAddr(addr string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupTXT(name string) ([]string, error)
+}
+
+// NetResolver is a Resolver using the system resolver from the net package
+type NetResolver struct{}
+
+func (r *NetResolver) LookupAddr(addr string) ([]string, error) { return net.LookupAddr(addr) }
+func (r *NetResolver) LookupIP(host string) ([]net.IP, error)   { return net.LookupIP(host) }
+func (r *NetResolver) LookupMX(name string) ([]*net.MX, error)  { return net.LookupMX(name) }
+func (r *NetResolver) LookupTXT(name string) ([]string, error)  { return net.LookupTXT(name) }
@@ -42,7 +42,7 @@ func (a *Auth) Handle(c *Conn, args string) error {
         }
     }
 
-    return &SMTPError{500, fmt.Errorf("AUTH mechanism %v not available", mech[0])}
+    return &SMTPError{504, "5.5.4", fmt.Errorf("AUTH mechanism %v not available", mech[0])}
 
 }
 
@@ -0,0 +1,61 @@
+package smtpd
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/dkim"
+)
+
+// authenticate runs the configured sender authentication checks on an accepted message,
+// recording the results on the message and in an Authentication-Results header. An error
+// is returned if the message should be refused
+func (s *Server) authenticate(c *Conn, m *email.Message) *SMTPError {
+	m.AuthResults = append(m.AuthResults, c.AuthResults...)
+
+	// DMARC builds on the DKIM results, so it needs the signatures checked as well
+	if s.VerifyDKIM || s.DMARC != nil {
+		if verifications, err := dkim.NewVerifier(s.Resolver).Verify(bytes.NewReader(m.Raw)); err == nil {
+			m.AuthResults = append(m.AuthResults, dkim.AuthResults(verifications)...)
+		} else {
+			s.Logger.Printf("DKIM verification error: %v", err)
+		}
+	}
+
+	if s.VerifyARC {
+		if verification, err := dkim.NewVerifier(s.Resolver).VerifyARC(bytes.NewReader(m.Raw)); err == nil {
+			m.AuthResults = append(m.AuthResults, verification.AuthResult())
+		} else {
+			s.Logger.Printf("ARC verification error: %v", err)
+		}
+	}
+
+	s.tagSPF(c, m)
+	s.tagDNSBL(c, m)
+
+	if err := s.checkDMARC(m); err != nil {
+		return err
+	}
+
+	// only we get to speak for our authserv-id, see https://tools.ietf.org/html/rfc8601#section-5
+	if n := m.Remove("Authentication-Results", s.ownAuthResults); n > 0 {
+		s.Logger.Printf("Removed %v Authentication-Results header(s) claiming to be from %v", n, s.ServerName)
+	}
+
+	if len(m.AuthResults) > 0 {
+		m.Prepend("Authentication-Results", email.AuthenticationResults(s.ServerName, m.AuthResults))
+	}
+	return nil
+}
+
+// ownAuthResults reports whether an Authentication-Results value carries our authserv-id,
+// which comes first, maybe followed by a version & comments
+func (s *Server) ownAuthResults(value string) bool {
+	id := strings.SplitN(value, ";", 2)[0]
+	if i := strings.Index(id, "("); i >= 0 {
+		id = id[:i]
+	}
+	fields := strings.Fields(id)
+	return len(fields) > 0 && strings.EqualFold(strings.TrimSuffix(fields[0], "."), strings.TrimSuffix(s.ServerName, "."))
+}
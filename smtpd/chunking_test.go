@@ -0,0 +1,90 @@
+package smtpd_test
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email/smtpd"
+)
+
+// sendChunks writes BDAT commands for each chunk, the last one flagged LAST
+func sendChunks(conn *textproto.Conn, chunks ...string) {
+	for i, chunk := range chunks {
+		last := ""
+		if i == len(chunks)-1 {
+			last = " LAST"
+		}
+		fmt.Fprintf(conn.W, "BDAT %v%v\r\n%v", len(chunk), last, chunk)
+	}
+	conn.W.Flush()
+}
+
+func TestSMTPChunking(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.BinaryMIME = true
+	server.MaxSize = 1024
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	expectReplies(t, conn, 220)
+	conn.PrintfLine("EHLO client.example.net")
+	_, msg, err := conn.ReadResponse(250)
+	if err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	}
+	if !strings.Contains(msg, "\nCHUNKING\n") || !strings.Contains(msg, "\nBINARYMIME\n") {
+		t.Errorf("CHUNKING & BINARYMIME should be advertised, got: %v", msg)
+	}
+
+	// no transaction yet, the chunk is thrown away
+	sendChunks(conn, "junk")
+	expectReplies(t, conn, 503)
+
+	// binary content with lines that would need dot-stuffing in DATA
+	body := "\x00\x01binary\r\n.\r\n..leading dots\r\n"
+	message := "From: sender@example.net\r\nTo: recipient@example.org\r\nContent-Type: application/octet-stream\r\n\r\n" + body
+
+	conn.PrintfLine("MAIL FROM:<sender@example.net> BODY=BINARYMIME SIZE=%v", len(message))
+	conn.PrintfLine("RCPT TO:<recipient@example.org>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 503)
+
+	sendChunks(conn, message[:40], message[40:90], message[90:])
+	expectReplies(t, conn, 250, 250, 250)
+
+	// a message over MaxSize is refused, and the transaction with it
+	conn.PrintfLine("MAIL FROM:<sender@example.net>")
+	conn.PrintfLine("RCPT TO:<recipient@example.org>")
+	expectReplies(t, conn, 250, 250)
+	sendChunks(conn, strings.Repeat("x", 1000), strings.Repeat("x", 100))
+	expectReplies(t, conn, 250, 552)
+	sendChunks(conn, "after the refusal")
+	expectReplies(t, conn, 503)
+
+	conn.PrintfLine("MAIL FROM:<sender@example.net> SIZE=2048")
+	expectReplies(t, conn, 552)
+	conn.PrintfLine("MAIL FROM:<sender@example.net> FOO=BAR")
+	expectReplies(t, conn, 555)
+
+	conn.PrintfLine("QUIT")
+	expectReplies(t, conn, 221)
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	if got := string(recorder.Messages[0].Raw); !strings.HasSuffix(got, message) {
+		t.Errorf("Chunks should be stored as-is, want: %q, got: %q", message, got)
+	}
+}
@@ -1,13 +1,21 @@
 package smtpd
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/mail"
 	"net/textproto"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/dnsbl"
 )
 
 type Conn struct {
@@ -21,6 +29,42 @@ type Conn struct {
 	FromAddr *mail.Address
 	ToAddr   []*mail.Address
 
+	// Helo is the name the client gave in its HELO/EHLO, and ESMTP
+	// is set when that was an EHLO
+	Helo  string
+	ESMTP bool
+
+	// RemoteName is the reverse DNS name of the client, once it has been looked up
+	RemoteName string
+
+	// HeloCheck & FCrDNS are the verdicts of the HELO name & reverse DNS checks, when the
+	// server has a HeloPolicy. See the Helo & FCrDNS constants
+	HeloCheck string
+	FCrDNS    string
+
+	// Forwarded holds the XFORWARD attributes (NAME, ADDR, PORT, PROTO, HELO, IDENT &
+	// SOURCE) a trusted proxy sent about the client of the next message
+	Forwarded map[string]string
+
+	// DNSBL is the outcome of the DNS blocklist & allowlist checks so far, see Server.DNSBL
+	DNSBL *dnsbl.Result
+
+	// AuthResults holds the outcome of the checks run on the current transaction
+	// so far, like SPF at MAIL FROM time
+	AuthResults []*email.AuthResult
+
+	// Body is the BODY= type given with MAIL FROM (e.g. BINARYMIME), if any
+	Body string
+
+	// SMTPUTF8 is set when the transaction carries internationalized email
+	SMTPUTF8 bool
+
+	// Return & EnvelopeID are the DSN parameters given with MAIL FROM, and Recipients
+	// holds those of each accepted RCPT TO, see https://tools.ietf.org/html/rfc3461
+	Return     string
+	EnvelopeID string
+	Recipients []*email.Recipient
+
 	// Configuration options
 	MaxSize      int
 	ReadTimeout  int64
@@ -29,47 +73,181 @@ type Conn struct {
 	// internal state
 	lock        sync.Mutex
 	transaction int
+	queueID     string
+	chunks      bytes.Buffer
+
+	// clientAddr & clientUser are the address & login of the client a trusted proxy
+	// passed on with XCLIENT
+	clientAddr net.Addr
+	clientUser AuthUser
+
+	// dnsblClient is the outcome of the client address lookups, at connect time
+	dnsblClient *dnsbl.Result
+
+	// milters are the filter sessions of this connection, see Server.Milters. milterFailed
+	// is set once one of them broke down, and discard when a filter dropped the message
+	milters      []*milterSession
+	milterFailed bool
+	discard      bool
+
+	// values are attached to the session by the server's hooks, see SetValue
+	values map[string]interface{}
 
-	asTextProto sync.Once
-	textProto   *textproto.Conn
+	// enhancedCodes is set once ENHANCEDSTATUSCODES has been advertised to the client
+	enhancedCodes bool
+
+	textProto *textproto.Conn
 }
 
 // tp returns a textproto wrapper for this connection
 func (c *Conn) tp() *textproto.Conn {
-	c.asTextProto.Do(func() {
+	if c.textProto == nil {
 		c.textProto = textproto.NewConn(c)
-	})
+	}
 	return c.textProto
 }
 
+// upgradeTLS swaps the underlying connection for its TLS-wrapped version, throwing
+// away anything the client pipelined or told us before the handshake: the greeting,
+// the login & any transaction, see https://tools.ietf.org/html/rfc3207#section-4.2
+func (c *Conn) upgradeTLS(tlsConn *tls.Conn) {
+	c.Reset()
+	c.Conn = tlsConn
+	c.IsTLS = true
+	c.DNSBL = c.dnsblClient
+	c.Helo = ""
+	c.HeloCheck = ""
+	c.ESMTP = false
+	c.enhancedCodes = false
+	c.textProto = nil
+}
+
+// RemoteAddr is the address of the client, as passed on by a trusted proxy with XCLIENT
+// if there was one
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.clientAddr != nil {
+		return c.clientAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// RemoteIP is the IP address of the client
+func (c *Conn) RemoteIP() net.IP {
+	return email.AddrIP(c.RemoteAddr())
+}
+
+// peerIP is the IP address the connection comes from, whatever XCLIENT said
+func (c *Conn) peerIP() net.IP {
+	return email.AddrIP(c.Conn.RemoteAddr())
+}
+
+// SetValue attaches a value to the session under key, e.g. from Server.OnConnect, for the
+// later hooks & extensions to use. Values last until the connection is closed
+func (c *Conn) SetValue(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]interface{})
+	}
+	c.values[key] = value
+}
+
+// Value returns the value attached to the session under key, or nil
+func (c *Conn) Value(key string) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+
+// QueueID identifies the current (or most recent) mail transaction
+func (c *Conn) QueueID() string {
+	return c.queueID
+}
+
 // StartTX starts a new MAIL transaction
 func (c *Conn) StartTX(from *mail.Address) error {
 	if c.transaction != 0 {
 		return ErrTransaction
 	}
+	c.milterAbort()
 	c.transaction = int(time.Now().UnixNano())
+	c.queueID = strings.ToUpper(strconv.FormatInt(int64(c.transaction), 36))
 	c.FromAddr = from
+	c.ToAddr = nil
+	c.AuthResults = nil
+	c.Body = ""
+	c.SMTPUTF8 = false
+	c.Return = ""
+	c.EnvelopeID = ""
+	c.Recipients = nil
+	c.chunks.Reset()
 	return nil
 }
 
+// Envelope describes the current (or most recent) mail transaction
+func (c *Conn) Envelope() *email.Envelope {
+	envelope := &email.Envelope{
+		Body:       c.Body,
+		SMTPUTF8:   c.SMTPUTF8,
+		Return:     c.Return,
+		ID:         c.EnvelopeID,
+		Recipients: c.Recipients,
+	}
+	if c.FromAddr != nil {
+		envelope.From = c.FromAddr.Address
+	}
+	for _, to := range c.ToAddr {
+		envelope.To = append(envelope.To, to.Address)
+	}
+	return envelope
+}
+
+// abortTX drops a transaction that was refused after it started
+func (c *Conn) abortTX() {
+	c.milterAbort()
+	c.transaction = 0
+	c.FromAddr = nil
+	c.AuthResults = nil
+	c.Body = ""
+	c.SMTPUTF8 = false
+	c.Return = ""
+	c.EnvelopeID = ""
+	c.Recipients = nil
+	c.chunks.Reset()
+}
+
 // EndTX closes off a MAIL transaction and returns a message object
 func (c *Conn) EndTX() error {
 	if c.transaction == 0 {
 		return ErrTransaction
 	}
 	c.transaction = 0
+	c.chunks.Reset()
 	return nil
 }
 
 func (c *Conn) Reset() {
-	c.User = nil
+	c.milterAbort()
+	c.User = c.clientUser
 	c.FromAddr = nil
+	c.Forwarded = nil
 	c.ToAddr = make([]*mail.Address, 0)
+	c.AuthResults = nil
+	c.Body = ""
+	c.SMTPUTF8 = false
+	c.Return = ""
+	c.EnvelopeID = ""
+	c.Recipients = nil
+	c.chunks.Reset()
 	c.transaction = 0
 }
 
 // ReadSMTP pulls a single SMTP command line (ending in a carriage return + newline)
 func (c *Conn) ReadSMTP() (string, string, error) {
+	if err := c.flushIfIdle(); err != nil {
+		return "", "", err
+	}
+
 	if line, err := c.tp().ReadLine(); err == nil {
 		var args string
 		command := strings.SplitN(line, " ", 2)
@@ -87,31 +265,100 @@ func (c *Conn) ReadSMTP() (string, string, error) {
 
 // ReadLine reads a single line from the client
 func (c *Conn) ReadLine() (string, error) {
+	if err := c.flushIfIdle(); err != nil {
+		return "", err
+	}
+
 	c.SetReadDeadline(time.Now().Add(time.Duration(c.ReadTimeout) * time.Second))
 	return c.tp().ReadLine()
 }
 
-// ReadData brokers the special case of SMTP data messages
+// ReadData brokers the special case of SMTP data messages. The message is returned
+// byte for byte as the client sent it, apart from the dot-unstuffing and the
+// terminating ".", see https://tools.ietf.org/html/rfc5321#section-4.5.2
 func (c *Conn) ReadData() (string, error) {
+	if err := c.Flush(); err != nil {
+		return "", err
+	}
+
 	c.SetReadDeadline(time.Now().Add(time.Duration(c.ReadTimeout) * time.Second))
-	lines, err := c.tp().ReadDotLines()
-	return strings.Join(lines, "\n"), err
+
+	var data bytes.Buffer
+	for {
+		// ErrBufferFull just means a long line, the rest of it comes with the next read
+		line, err := c.tp().R.ReadSlice('\n')
+		if err == io.EOF {
+			return data.String(), io.ErrUnexpectedEOF
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return data.String(), err
+		}
+
+		// only a "." at the start of a line is special
+		if data.Len() == 0 || data.Bytes()[data.Len()-1] == '\n' {
+			if string(line) == ".\r\n" || string(line) == ".\n" {
+				return data.String(), nil
+			} else if line[0] == '.' {
+				line = line[1:]
+			}
+		}
+		data.Write(line)
+	}
 }
 
-// WriteSMTP writes a general SMTP line
+// ReadChunk copies the size octets that follow a BDAT command to w, as-is,
+// see https://tools.ietf.org/html/rfc3030#section-2
+func (c *Conn) ReadChunk(w io.Writer, size int64) error {
+	c.SetReadDeadline(time.Now().Add(time.Duration(c.ReadTimeout) * time.Second))
+	_, err := io.CopyN(w, c.tp().R, size)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WriteSMTP writes a general SMTP line. Replies are buffered so that a pipelining client
+// gets the replies to a group of commands together, they're sent once the client has
+// nothing more to read or Flush is called, see https://tools.ietf.org/html/rfc2920#section-3.2
 func (c *Conn) WriteSMTP(code int, message string) error {
-	c.SetWriteDeadline(time.Now().Add(time.Duration(c.WriteTimeout) * time.Second))
-	_, err := c.Write([]byte(fmt.Sprintf("%v %v", code, message) + "\r\n"))
+	return c.WriteReply(NewReply(code, "", message))
+}
+
+// WriteReply writes a (possibly multi-line) reply, with its enhanced status code
+// if the client was told about them, see https://tools.ietf.org/html/rfc2034
+func (c *Conn) WriteReply(r *Reply) error {
+	_, err := c.tp().W.WriteString(r.String(c.enhancedCodes))
 	return err
 }
 
 // WriteEHLO writes an EHLO line, see https://tools.ietf.org/html/rfc2821#section-4.1.1.1
 func (c *Conn) WriteEHLO(message string) error {
-	c.SetWriteDeadline(time.Now().Add(time.Duration(c.WriteTimeout) * time.Second))
-	_, err := c.Write([]byte(fmt.Sprintf("250-%v", message) + "\r\n"))
+	_, err := fmt.Fprintf(c.tp().W, "250-%v\r\n", message)
 	return err
 }
 
+// Flush sends any buffered replies to the client
+func (c *Conn) Flush() error {
+	if c.textProto == nil || c.textProto.W.Buffered() == 0 {
+		return nil
+	}
+	c.SetWriteDeadline(time.Now().Add(time.Duration(c.WriteTimeout) * time.Second))
+	return c.textProto.W.Flush()
+}
+
+// flushIfIdle sends the buffered replies unless there are more pipelined commands waiting
+func (c *Conn) flushIfIdle() error {
+	if c.tp().R.Buffered() > 0 {
+		return nil
+	}
+	return c.Flush()
+}
+
+// Close flushes any buffered replies and closes the connection
+func (c *Conn) Close() error {
+	c.Flush()
+	return c.Conn.Close()
+}
+
 // WriteOK is a convenience function for sending the default OK response
 func (c *Conn) WriteOK() error {
 	return c.WriteSMTP(250, "OK")
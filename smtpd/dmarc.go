@@ -0,0 +1,32 @@
+package smtpd
+
+import (
+	"fmt"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/dmarc"
+)
+
+// DMARCPolicy configures the author domain policy checks done on each accepted message,
+// see https://tools.ietf.org/html/rfc7489. The verdict is recorded in Message.AuthResults,
+// handlers can use dmarc.Disposition to quarantine failing messages
+type DMARCPolicy struct {
+	// Reject refuses messages whose domain asks for p=reject, instead of just recording the result
+	Reject bool
+}
+
+// checkDMARC evaluates the author domain's policy once the SPF and DKIM results are in,
+// returning an error if the message should be refused
+func (s *Server) checkDMARC(m *email.Message) *SMTPError {
+	if s.DMARC == nil {
+		return nil
+	}
+
+	evaluation := dmarc.NewChecker(s.Resolver).CheckMessage(m)
+	m.AuthResults = append(m.AuthResults, evaluation.AuthResult())
+
+	if evaluation.Disposition == dmarc.PolicyReject && s.DMARC.Reject {
+		return &SMTPError{550, "5.7.1", fmt.Errorf("Rejected by DMARC policy for %v", evaluation.Domain)}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package smtpd_test
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email/dmarc"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPDMARC(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.ServerName = "mx.example.org"
+	server.SPF = &smtpd.SPFPolicy{}
+	server.DMARC = &smtpd.DMARCPolicy{Reject: true}
+	server.Resolver = &FakeResolver{TXT: map[string][]string{
+		"mail.aligned.example":      {"v=spf1 ip4:127.0.0.0/8 -all"},
+		"bulk.example":              {"v=spf1 ip4:127.0.0.0/8 -all"},
+		"_dmarc.aligned.example":    {"v=DMARC1; p=reject"},
+		"_dmarc.reject.example":     {"v=DMARC1; p=reject"},
+		"_dmarc.quarantine.example": {"v=DMARC1; p=quarantine"},
+	}}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	send := func(sender, author string) error {
+		raw := "To: recipient@example.org\r\nFrom: " + author + "\r\nContent-Type: text/plain\r\n\r\nbody\r\n"
+		return smtp.SendMail(server.Address(), nil, sender, []string{"recipient@example.org"}, []byte(raw))
+	}
+
+	if err := send("bounces@mail.aligned.example", "joe@aligned.example"); err != nil {
+		t.Fatalf("Aligned mail should be accepted: %v", err)
+	}
+
+	if err := send("bounces@bulk.example", "joe@reject.example"); err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("Unaligned mail from a p=reject domain should be refused with a 550, got: %v", err)
+	}
+
+	if err := send("bounces@bulk.example", "joe@quarantine.example"); err != nil {
+		t.Fatalf("Unaligned mail from a p=quarantine domain should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 2 {
+		t.Fatalf("Expected two messages, got: %v", len(recorder.Messages))
+	}
+
+	aligned, quarantined := recorder.Messages[0], recorder.Messages[1]
+
+	if got := dmarc.Disposition(aligned); got != dmarc.PolicyNone {
+		t.Errorf("Aligned mail shouldn't be quarantined, got: %v", got)
+	}
+	if !strings.Contains(aligned.Headers["Authentication-Results"], "dmarc=pass header.from=aligned.example policy.dmarc=none") {
+		t.Errorf("Missing DMARC result, got: %v", aligned.Headers["Authentication-Results"])
+	}
+
+	if got := dmarc.Disposition(quarantined); got != dmarc.PolicyQuarantine {
+		t.Errorf("Unaligned mail should be quarantined, got: %v", got)
+	}
+}
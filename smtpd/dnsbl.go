@@ -0,0 +1,100 @@
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/dnsbl"
+)
+
+// DNSBLPolicy configures the DNS blocklist & allowlist checks: of the client address
+// at connect time, and of the HELO & sender domains at MAIL FROM. The outcome is kept
+// in Conn.DNSBL for the hooks to use
+type DNSBLPolicy struct {
+	Checker *dnsbl.Checker
+
+	// RejectScore refuses clients once their score reaches it, at connect time for the
+	// address lists and at MAIL FROM for the domain lists. Zero only scores them
+	RejectScore float64
+
+	// Header adds the score & the lists the client is in to accepted messages, under
+	// this name (e.g. "X-DNSBL"). Empty leaves it out
+	Header string
+}
+
+func (p *DNSBLPolicy) rejects(r *dnsbl.Result) bool {
+	return p.RejectScore > 0 && r.Score >= p.RejectScore
+}
+
+// blockedBy describes the lists a client is in for the reply refusing it
+func blockedBy(what string, r *dnsbl.Result) string {
+	text := fmt.Sprintf("Service unavailable; %v blocked using %v", what, strings.Join(r.Zones(), ", "))
+	for _, l := range r.Listings {
+		if l.Reason != "" {
+			return text + "; " + l.Reason
+		}
+	}
+	return text
+}
+
+// checkDNSBL looks the client address up when it connects, returning an error if it
+// should be refused
+func (s *Server) checkDNSBL(c *Conn) *SMTPError {
+	if s.DNSBL == nil {
+		return nil
+	}
+
+	ip := c.RemoteIP()
+	if ip == nil {
+		return nil
+	}
+
+	c.dnsblClient = s.DNSBL.Checker.CheckIP(ip)
+	c.DNSBL = c.dnsblClient
+
+	if s.DNSBL.rejects(c.DNSBL) {
+		return &SMTPError{554, "5.7.1", fmt.Errorf("%v", blockedBy(fmt.Sprintf("client [%v]", ip), c.DNSBL))}
+	}
+	return nil
+}
+
+// checkDNSBLDomains adds the lookups of the HELO & sender domains to the client's score
+// at MAIL FROM, returning an error if the sender should be refused
+func (s *Server) checkDNSBLDomains(c *Conn) *SMTPError {
+	if s.DNSBL == nil || s.Allow.Contains(c.RemoteIP()) {
+		return nil
+	}
+
+	domains := []string{c.Helo}
+	if c.FromAddr != nil {
+		if at := strings.LastIndex(c.FromAddr.Address, "@"); at >= 0 {
+			domains = append(domains, c.FromAddr.Address[at+1:])
+		}
+	}
+
+	c.DNSBL = &dnsbl.Result{}
+	if c.dnsblClient != nil {
+		c.DNSBL.Merge(c.dnsblClient)
+	}
+	domainResult := s.DNSBL.Checker.CheckDomains(domains...)
+	c.DNSBL.Merge(domainResult)
+
+	if len(domainResult.Listings) > 0 && s.DNSBL.rejects(c.DNSBL) {
+		return &SMTPError{550, "5.7.1", fmt.Errorf("%v", blockedBy("sender", domainResult))}
+	}
+	return nil
+}
+
+// tagDNSBL adds the score header to a message, when the policy asks for it
+func (s *Server) tagDNSBL(c *Conn, m *email.Message) {
+	if s.DNSBL == nil || s.DNSBL.Header == "" || c.DNSBL == nil {
+		return
+	}
+
+	value := fmt.Sprintf("score=%v", c.DNSBL.Score)
+	for _, l := range c.DNSBL.Listings {
+		value += fmt.Sprintf("; %v=%v", l.List.Zone, l.Name)
+	}
+	m.Prepend(s.DNSBL.Header, value)
+}
@@ -0,0 +1,90 @@
+package smtpd_test
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email/dnsbl"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPDNSBL(t *testing.T) {
+
+	resolver := &FakeResolver{
+		IP: map[string][]net.IP{
+			"1.0.0.127.bl.example":     {net.ParseIP("127.0.0.2")},
+			"1.0.0.127.wl.example":     {net.ParseIP("127.0.10.1")},
+			"spam.example.dbl.example": {net.ParseIP("127.0.1.2")},
+		},
+		TXT: map[string][]string{
+			"1.0.0.127.bl.example": {"See https://bl.example/lookup"},
+		},
+	}
+	lists := []*dnsbl.List{
+		{Zone: "bl.example", Weight: 5},
+		{Zone: "dbl.example", Weight: 5, Domains: true},
+	}
+
+	// blocked at connect time
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.Resolver = resolver
+	server.DNSBL = &smtpd.DNSBLPolicy{Checker: dnsbl.NewChecker(resolver, lists...), RejectScore: 5}
+	go server.ListenAndServe("127.0.0.1:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	want := `554 "Service unavailable; client [127.0.0.1] blocked using bl.example; See https://bl.example/lookup"`
+	if _, _, err := conn.ReadResponse(220); err == nil || err.Error() != want {
+		t.Errorf("The client should be refused, got: %v", err)
+	}
+
+	// an allowlist outweighs the blocklist, the sender's domain tips it over
+	lists = append(lists, &dnsbl.List{Zone: "wl.example", Weight: -5})
+	scoring := smtpd.NewServer(recorder.Record)
+	scoring.Resolver = resolver
+	scoring.DNSBL = &smtpd.DNSBLPolicy{Checker: dnsbl.NewChecker(resolver, lists...), RejectScore: 5, Header: "X-DNSBL"}
+	go scoring.ListenAndServe("127.0.0.1:0")
+	defer scoring.Close()
+
+	WaitUntilAlive(scoring)
+
+	conn, err = textproto.Dial("tcp", scoring.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	conn.ReadResponse(250)
+	conn.PrintfLine("MAIL FROM:<sender@spam.example>")
+	if _, _, err := conn.ReadResponse(250); err == nil || !strings.HasPrefix(err.Error(), `550 "5.7.1 Service unavailable; sender blocked using dbl.example`) {
+		t.Errorf("The sender should be refused, got: %v", err)
+	}
+
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	conn.PrintfLine("RCPT TO:<user@example.net>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 354)
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\nhi\r\n.")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("Message should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	if header := recorder.Messages[0].Headers["X-Dnsbl"]; header != "score=0; bl.example=127.0.0.1; wl.example=127.0.0.1" {
+		t.Errorf("Expected the score header, got: %q", header)
+	}
+}
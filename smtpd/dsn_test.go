@@ -0,0 +1,108 @@
+package smtpd_test
+
+import (
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPDSN(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	expectReplies(t, conn, 220)
+	conn.PrintfLine("EHLO client.example.net")
+	if _, msg, _ := conn.ReadResponse(250); !strings.Contains(msg, "\nDSN\n") {
+		t.Errorf("DSN should be advertised, got: %v", msg)
+	}
+
+	// bad parameters are refused
+	conn.PrintfLine("MAIL FROM:<sender@example.org> RET=SOME")
+	conn.PrintfLine("MAIL FROM:<sender@example.org> ENVID=bad=id")
+	expectReplies(t, conn, 501, 501)
+
+	conn.PrintfLine("MAIL FROM:<sender@example.org> RET=hdrs ENVID=QQ+2B314159")
+	conn.PrintfLine("RCPT TO:<a@example.net> NOTIFY=NEVER,SUCCESS")
+	conn.PrintfLine("RCPT TO:<a@example.net> NOTIFY=SOMETIMES")
+	conn.PrintfLine("RCPT TO:<a@example.net> ORCPT=list@example.net")
+	conn.PrintfLine("RCPT TO:<a@example.net> NOTIFY=success,failure ORCPT=rfc822;list+2Bdsn@example.net")
+	conn.PrintfLine("RCPT TO:<b@example.net> NOTIFY=NEVER")
+	conn.PrintfLine("RCPT TO:<c@example.net>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 501, 501, 501, 250, 250, 250, 354)
+
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\nhi\r\n.")
+	expectReplies(t, conn, 250)
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+
+	envelope := recorder.Messages[0].Envelope
+	if envelope.Return != "HDRS" || envelope.ID != "QQ+314159" {
+		t.Errorf("Wrong MAIL FROM parameters: %+v", envelope)
+	}
+
+	want := []*email.Recipient{
+		{Address: "a@example.net", Notify: []string{email.NotifySuccess, email.NotifyFailure}, Original: "rfc822;list+dsn@example.net"},
+		{Address: "b@example.net", Notify: []string{email.NotifyNever}},
+		{Address: "c@example.net"},
+	}
+	if !reflect.DeepEqual(envelope.Recipients, want) {
+		t.Errorf("Wrong recipients, want: %+v, got: %+v", want, envelope.Recipients)
+	}
+
+	// bounces come from the null reverse-path
+	conn.PrintfLine("MAIL FROM:<>")
+	conn.PrintfLine("RCPT TO:<sender@example.org>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 354)
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: bounce\r\n\r\nhi\r\n.")
+	expectReplies(t, conn, 250)
+
+	if len(recorder.Messages) != 2 || recorder.Messages[1].Envelope.From != "" {
+		t.Errorf("Expected a bounce with an empty reverse-path")
+	}
+}
+
+func TestSMTPDSNDisabled(t *testing.T) {
+
+	server := smtpd.NewServer(func(*email.Message) error { return nil })
+	server.Disabled = map[string]bool{"DSN": true}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	if _, msg, _ := conn.ReadResponse(250); strings.Contains(msg, "\nDSN\n") {
+		t.Errorf("DSN shouldn't be advertised, got: %v", msg)
+	}
+
+	conn.PrintfLine("MAIL FROM:<sender@example.org> RET=FULL")
+	if _, _, err := conn.ReadResponse(250); err == nil || !strings.HasPrefix(err.Error(), "555") {
+		t.Errorf("RET should be refused with a 555, got: %v", err)
+	}
+}
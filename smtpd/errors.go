@@ -1,16 +1,27 @@
 package smtpd
 
-import "errors"
+import (
+    "errors"
 
-var ErrAuthFailed = &SMTPError{535, errors.New("Authentication credentials invalid")}
-var ErrAuthCancelled = &SMTPError{501, errors.New("Cancelled")}
-var ErrRequiresTLS = &SMTPError{538, errors.New("Encryption required for requested authentication mechanism")}
-var ErrTransaction = &SMTPError{501, errors.New("Transaction unsuccessful")}
+    "github.com/hownowstephen/email"
+)
+
+var ErrAuthFailed = &SMTPError{535, "5.7.8", errors.New("Authentication credentials invalid")}
+var ErrAuthCancelled = &SMTPError{501, "5.0.0", errors.New("Cancelled")}
+var ErrRequiresTLS = &SMTPError{538, "5.7.11", errors.New("Encryption required for requested authentication mechanism")}
+var ErrTransaction = &SMTPError{501, "5.5.1", errors.New("Transaction unsuccessful")}
 
 // SMTPError is an error + SMTP response code
 type SMTPError struct {
-    code int
-    err  error
+    code     int
+    enhanced string
+    err      error
+}
+
+// NewSMTPError creates an error for a Handler (or extension) to return, which is sent
+// to the client as is, e.g. NewSMTPError(452, "4.2.2", "Mailbox full")
+func NewSMTPError(code int, enhanced, message string) *SMTPError {
+    return &SMTPError{code, enhanced, errors.New(message)}
 }
 
 // Code pulls the code
@@ -18,7 +29,79 @@ func (a *SMTPError) Code() int {
     return a.code
 }
 
+// Enhanced pulls the enhanced status code, see https://tools.ietf.org/html/rfc3463
+func (a *SMTPError) Enhanced() string {
+    return a.enhanced
+}
+
 // Error pulls the base error value
 func (a *SMTPError) Error() string {
     return a.err.Error()
 }
+
+// Reply is the response that reports the error to the client
+func (a *SMTPError) Reply() *Reply {
+    return NewReply(a.code, a.enhanced, a.err.Error())
+}
+
+// Temporary reports whether the client should try again later, for 4xx codes
+func (a *SMTPError) Temporary() bool {
+    return a.code/100 == 4
+}
+
+// Unwrap gives the base error value
+func (a *SMTPError) Unwrap() error {
+    return a.err
+}
+
+// failure marks a Handler error as temporary or permanent, see Temporary & Permanent
+type failure struct {
+    err       error
+    temporary bool
+}
+
+func (f *failure) Error() string {
+    return f.err.Error()
+}
+
+func (f *failure) Temporary() bool {
+    return f.temporary
+}
+
+func (f *failure) Unwrap() error {
+    return f.err
+}
+
+// Temporary marks an error returned by the Handler as a temporary failure, so the message
+// is turned away with a 451 and the client tries again later. Unknown errors are temporary
+// already, this makes it explicit
+func Temporary(err error) error {
+    return &failure{err, true}
+}
+
+// Permanent marks an error returned by the Handler as a permanent failure, so the message
+// is bounced with a 554 rather than retried. It's the only way besides an *SMTPError to
+// bounce a message
+func Permanent(err error) error {
+    return &failure{err, false}
+}
+
+// handlerError converts an error from the Handler into the error reported to the client.
+// An *SMTPError is sent as is, and errors made with Permanent bounce the message. Anything
+// else fails it temporarily: other errors claiming not to be temporary (like a net.Error
+// for a refused connection) still come from an outage the client should wait out. Only
+// an *SMTPError's text reaches the client, other errors are logged instead
+func (s *Server) handlerError(m *email.Message, err error) *SMTPError {
+    var serr *SMTPError
+    if errors.As(err, &serr) {
+        return serr
+    }
+
+    s.Logger.Printf("Handler failed on message %v: %v", m.ID(), err)
+
+    var f *failure
+    if errors.As(err, &f) && !f.temporary {
+        return &SMTPError{554, "5.3.0", errors.New("Error: I blame me")}
+    }
+    return &SMTPError{451, "4.3.0", errors.New("Error: Local error in processing")}
+}
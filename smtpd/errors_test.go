@@ -0,0 +1,76 @@
+package smtpd_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"testing"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPHandlerErrors(t *testing.T) {
+
+	// a connection refused by a backend that's down, which isn't Temporary()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	listener.Close()
+	_, refused := net.Dial("tcp", listener.Addr().String())
+	if _, ok := refused.(*net.OpError); !ok {
+		t.Fatalf("Expected a *net.OpError, got: %v", refused)
+	}
+
+	handlerErrors := map[string]error{
+		"refused":   refused,
+		"reply":     smtpd.NewSMTPError(452, "4.2.2", "Mailbox full"),
+		"wrapped":   fmt.Errorf("lookup failed: %w", smtpd.NewSMTPError(550, "5.1.1", "No such user")),
+		"unknown":   errors.New("database unavailable"),
+		"temporary": smtpd.Temporary(errors.New("database unavailable")),
+		"permanent": smtpd.Permanent(errors.New("message refused")),
+	}
+
+	server := smtpd.NewServer(func(m *email.Message) error {
+		return handlerErrors[m.Subject]
+	})
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	conn.ReadResponse(250)
+
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"reply", `452 "4.2.2 Mailbox full"`},
+		{"wrapped", `550 "5.1.1 No such user"`},
+		{"unknown", `451 "4.3.0 Error: Local error in processing"`},
+		{"temporary", `451 "4.3.0 Error: Local error in processing"`},
+		{"permanent", `554 "5.3.0 Error: I blame me"`},
+		{"refused", `451 "4.3.0 Error: Local error in processing"`},
+	}
+
+	for _, test := range tests {
+		conn.PrintfLine("MAIL FROM:<sender@example.org>")
+		conn.PrintfLine("RCPT TO:<user@example.net>")
+		conn.PrintfLine("DATA")
+		expectReplies(t, conn, 250, 250, 354)
+		conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: %v\r\n\r\nhi\r\n.", test.subject)
+		if _, _, err := conn.ReadResponse(250); err == nil || err.Error() != test.want {
+			t.Errorf("Expected %v for the %v error, got: %v", test.want, test.subject, err)
+		}
+	}
+}
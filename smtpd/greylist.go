@@ -0,0 +1,35 @@
+package smtpd
+
+import (
+	"fmt"
+	"net/mail"
+)
+
+// checkGreylist turns away recipients whose (client, sender, recipient) triplet hasn't been
+// seen before. Authenticated users aren't greylisted, and mail goes through when the
+// storage fails, rather than being held up
+func (s *Server) checkGreylist(c *Conn, to *mail.Address) *SMTPError {
+	if s.Greylist == nil || c.User != nil {
+		return nil
+	}
+
+	ip := c.RemoteIP()
+	if ip == nil {
+		return nil
+	}
+
+	sender := ""
+	if c.FromAddr != nil {
+		sender = c.FromAddr.Address
+	}
+
+	pass, err := s.Greylist.Check(ip, sender, to.Address)
+	if err != nil {
+		s.Logger.Printf("Greylisting error for %v: %v", ip, err)
+		return nil
+	}
+	if !pass {
+		return &SMTPError{451, "4.7.1", fmt.Errorf("Greylisted, please try again later")}
+	}
+	return nil
+}
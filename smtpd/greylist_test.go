@@ -0,0 +1,50 @@
+package smtpd_test
+
+import (
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/greylist"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPGreylist(t *testing.T) {
+
+	now := time.Now()
+	server := smtpd.NewServer(func(*email.Message) error { return nil })
+	server.Greylist = greylist.NewGreylister(greylist.NewMemoryStorage())
+	server.Greylist.Now = func() time.Time { return now }
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	rcpt := func() error {
+		conn, err := textproto.Dial("tcp", server.Address())
+		if err != nil {
+			t.Fatalf("Couldn't connect: %v", err)
+		}
+		defer conn.Close()
+
+		conn.ReadResponse(220)
+		conn.PrintfLine("EHLO client.example.net")
+		conn.ReadResponse(250)
+		conn.PrintfLine("MAIL FROM:<sender@example.org>")
+		conn.ReadResponse(250)
+		conn.PrintfLine("RCPT TO:<user@example.net>")
+		_, _, err = conn.ReadResponse(250)
+		return err
+	}
+
+	if err := rcpt(); err == nil || err.Error() != `451 "4.7.1 Greylisted, please try again later"` {
+		t.Errorf("The first attempt should be greylisted, got: %v", err)
+	}
+
+	// the clock only moves between connections
+	now = now.Add(greylist.DefaultDelay + time.Minute)
+	if err := rcpt(); err != nil {
+		t.Errorf("The retry should be accepted, got: %v", err)
+	}
+}
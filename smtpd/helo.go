@@ -0,0 +1,211 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hownowstephen/email"
+)
+
+// Verdicts of the HELO/EHLO name checks, kept in Conn.HeloCheck
+const (
+	// HeloValid is a fully qualified domain name or address literal
+	HeloValid = "valid"
+	// HeloInvalid isn't a hostname at all, or is missing
+	HeloInvalid = "invalid"
+	// HeloNonFQDN is a hostname without a domain, like "localhost" or "mailer"
+	HeloNonFQDN = "non-fqdn"
+	// HeloForged claims to be this server, by its name or address
+	HeloForged = "forged"
+)
+
+// Verdicts of the forward-confirmed reverse DNS check, kept in Conn.FCrDNS. They're
+// those of the iprev authentication method, see https://tools.ietf.org/html/rfc8601#section-3
+const (
+	FCrDNSPass      = "pass"
+	FCrDNSFail      = "fail"
+	FCrDNSTempError = "temperror"
+)
+
+// maxPTRNames is how many of the client's reverse DNS names are tried, see https://tools.ietf.org/html/rfc8601#section-3
+const maxPTRNames = 10
+
+// HeloPolicy configures the checks of the name clients give with HELO/EHLO, and of their
+// reverse DNS. The verdicts are kept in Conn.HeloCheck & Conn.FCrDNS whatever the policy
+// refuses. Clients without confirmed reverse DNS show up as "unknown" in the Received header,
+// which also gets a "(helo=<verdict>, fcrdns=<verdict>)" comment
+type HeloPolicy struct {
+	// RequireFQDN refuses names that aren't a fully qualified domain name or an address
+	// literal, see https://tools.ietf.org/html/rfc5321#section-4.1.4
+	RequireFQDN bool
+
+	// RejectForged refuses clients that claim to be this server, by its Name, ServerName or
+	// the address they connected to. Clients connecting from that address are let through
+	RejectForged bool
+
+	// RequireFCrDNS refuses clients at connect time unless their address has a reverse DNS
+	// name whose addresses include it. Clients in Server.Allow are let through
+	RequireFCrDNS bool
+}
+
+// checkFCrDNS confirms the client's reverse DNS name when it connects, returning an error
+// if it should be refused
+func (s *Server) checkFCrDNS(c *Conn) *SMTPError {
+	if s.HeloPolicy == nil {
+		return nil
+	}
+
+	ip := c.RemoteIP()
+	if ip == nil {
+		return nil
+	}
+
+	c.FCrDNS = s.fcrdns(c, ip)
+	if !s.HeloPolicy.RequireFCrDNS || c.FCrDNS == FCrDNSPass || s.Allow.Contains(ip) {
+		return nil
+	}
+
+	if c.FCrDNS == FCrDNSTempError {
+		return &SMTPError{421, "4.7.25", fmt.Errorf("Cannot validate the reverse DNS of [%v], try again later", ip)}
+	}
+	return &SMTPError{554, "5.7.25", fmt.Errorf("Reverse DNS validation failed for [%v]", ip)}
+}
+
+// fcrdns looks up the reverse DNS names of ip, and the addresses of those names, setting
+// RemoteName to the first name that points back at ip
+func (s *Server) fcrdns(c *Conn, ip net.IP) string {
+	names, err := s.Resolver.LookupAddr(ip.String())
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return FCrDNSFail
+		}
+		return FCrDNSTempError
+	}
+
+	verdict := FCrDNSFail
+	for i, name := range names {
+		if i == maxPTRNames {
+			break
+		}
+
+		name = strings.TrimSuffix(name, ".")
+		addrs, err := s.Resolver.LookupIP(name)
+		if dnsErr, ok := err.(*net.DNSError); err != nil && !(ok && dnsErr.IsNotFound) {
+			verdict = FCrDNSTempError
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Equal(ip) {
+				c.RemoteName = name
+				return FCrDNSPass
+			}
+		}
+	}
+	return verdict
+}
+
+// checkHeloName judges the HELO/EHLO name, returning an error if the policy refuses it
+func (s *Server) checkHeloName(c *Conn) *SMTPError {
+	if s.HeloPolicy == nil {
+		return nil
+	}
+
+	c.HeloCheck = s.heloVerdict(c)
+
+	switch {
+	case c.HeloCheck == HeloInvalid && s.HeloPolicy.RequireFQDN:
+		return &SMTPError{501, "5.5.2", fmt.Errorf("Invalid HELO name, a hostname or address literal is required")}
+	case c.HeloCheck == HeloNonFQDN && s.HeloPolicy.RequireFQDN:
+		return &SMTPError{504, "5.5.2", fmt.Errorf("Need a fully qualified hostname")}
+	case c.HeloCheck == HeloForged && s.HeloPolicy.RejectForged:
+		return &SMTPError{550, "5.7.1", fmt.Errorf("You are not %v", c.Helo)}
+	}
+	return nil
+}
+
+// heloVerdict checks the syntax of the HELO/EHLO name, and whether it's one of ours
+func (s *Server) heloVerdict(c *Conn) string {
+	helo := strings.TrimSpace(c.Helo)
+	local := email.AddrIP(c.LocalAddr())
+
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		ip := parseAddressLiteral(helo[1 : len(helo)-1])
+		switch {
+		case ip == nil:
+			return HeloInvalid
+		case ip.Equal(local) && !s.fromSelf(c, local):
+			return HeloForged
+		}
+		return HeloValid
+	}
+
+	if ip := net.ParseIP(helo); ip != nil {
+		// addresses go in brackets
+		if ip.Equal(local) && !s.fromSelf(c, local) {
+			return HeloForged
+		}
+		return HeloInvalid
+	}
+
+	// IDNs are checked in their A-label form
+	name, err := email.ToASCII(helo)
+	if err != nil || !validHostname(name) {
+		return HeloInvalid
+	}
+
+	ours := strings.EqualFold(name, strings.TrimSuffix(s.ServerName, ".")) || strings.EqualFold(name, strings.TrimSuffix(s.Name, "."))
+	if ours && !s.fromSelf(c, local) {
+		return HeloForged
+	}
+	if !strings.Contains(name, ".") {
+		return HeloNonFQDN
+	}
+	return HeloValid
+}
+
+// fromSelf reports whether the client connects from this host, which may use our name
+func (s *Server) fromSelf(c *Conn, local net.IP) bool {
+	ip := c.RemoteIP()
+	return ip != nil && (ip.IsLoopback() || ip.Equal(local))
+}
+
+// parseAddressLiteral reads the inside of an address literal, see https://tools.ietf.org/html/rfc5321#section-4.1.3
+func parseAddressLiteral(literal string) net.IP {
+	if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+		if ip := net.ParseIP(literal[5:]); ip != nil && strings.Contains(literal[5:], ":") {
+			return ip
+		}
+		return nil
+	}
+	if ip := net.ParseIP(literal); ip != nil && ip.To4() != nil && !strings.Contains(literal, ":") {
+		return ip
+	}
+	return nil
+}
+
+// validHostname checks the letters, digits & hyphens syntax of a hostname, with an
+// optional final dot, see https://tools.ietf.org/html/rfc1123#section-2.1
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			ch := label[i]
+			if !('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' || ch == '-') {
+				return false
+			}
+		}
+	}
+
+	// top-level domains are never all-numeric, that would make it look like an address
+	tld := labels[len(labels)-1]
+	return len(labels) == 1 || strings.Trim(tld, "0123456789") != ""
+}
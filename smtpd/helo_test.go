@@ -0,0 +1,156 @@
+package smtpd_test
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPHeloPolicy(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.ServerName = "mx.example.com"
+	server.Resolver = &FakeResolver{
+		PTR: map[string][]string{"127.0.0.1": {"forged.example.net.", "client.example.net."}},
+		IP: map[string][]net.IP{
+			"forged.example.net": {net.ParseIP("192.0.2.1")},
+			"client.example.net": {net.ParseIP("127.0.0.1")},
+		},
+	}
+	server.HeloPolicy = &smtpd.HeloPolicy{RequireFQDN: true, RejectForged: true, RequireFCrDNS: true}
+
+	var verdicts []string
+	server.OnHelo = func(conn *smtpd.Conn) error {
+		verdicts = append(verdicts, conn.FCrDNS+" "+conn.HeloCheck)
+		return nil
+	}
+	go server.ListenAndServe("127.0.0.1:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("The client's reverse DNS should check out, got: %v", err)
+	}
+
+	tests := []struct {
+		helo string
+		want string
+	}{
+		{"client_example.net", `501 "Invalid HELO name, a hostname or address literal is required"`},
+		{"127.0.0.1", `501 "Invalid HELO name, a hostname or address literal is required"`},
+		{"[IPv6:127.0.0.1]", `501 "Invalid HELO name, a hostname or address literal is required"`},
+		{"mailer", `504 "Need a fully qualified hostname"`},
+	}
+	for _, test := range tests {
+		conn.PrintfLine("EHLO %v", test.helo)
+		if _, _, err := conn.ReadResponse(250); err == nil || err.Error() != test.want {
+			t.Errorf("Expected %v for %v, got: %v", test.want, test.helo, err)
+		}
+	}
+
+	// the client is on this host, so it may use our name
+	for _, helo := range []string{"[127.0.0.1]", "mx.example.com", "client.example.net"} {
+		conn.PrintfLine("EHLO %v", helo)
+		if _, _, err := conn.ReadResponse(250); err != nil {
+			t.Errorf("Expected %v to be accepted, got: %v", helo, err)
+		}
+	}
+	if want := []string{"pass valid", "pass valid", "pass valid"}; strings.Join(verdicts, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected the verdicts %v, got: %v", want, verdicts)
+	}
+
+	conn.PrintfLine("MAIL FROM:<sender@example.net>")
+	conn.PrintfLine("RCPT TO:<user@example.com>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 354)
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\nhi\r\n.")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("Message should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	if received := recorder.Messages[0].Headers["Received"]; !strings.Contains(received, "from client.example.net (client.example.net [127.0.0.1])") {
+		t.Errorf("Expected the confirmed name in the Received header, got: %q", received)
+	}
+	if received := recorder.Messages[0].Headers["Received"]; !strings.Contains(received, "(helo=valid, fcrdns=pass)") {
+		t.Errorf("Expected the verdicts in the Received header, got: %q", received)
+	}
+}
+
+func TestSMTPFCrDNS(t *testing.T) {
+
+	// the client's name doesn't point back at it
+	resolver := &FakeResolver{
+		PTR: map[string][]string{"127.0.0.1": {"client.example.net."}},
+	}
+
+	refusing := smtpd.NewServer(func(*email.Message) error { return nil })
+	refusing.Resolver = resolver
+	refusing.HeloPolicy = &smtpd.HeloPolicy{RequireFCrDNS: true}
+	go refusing.ListenAndServe("127.0.0.1:0")
+	defer refusing.Close()
+
+	WaitUntilAlive(refusing)
+
+	conn, err := textproto.Dial("tcp", refusing.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	want := `554 "Reverse DNS validation failed for [127.0.0.1]"`
+	if _, _, err := conn.ReadResponse(220); err == nil || err.Error() != want {
+		t.Errorf("The client should be refused, got: %v", err)
+	}
+
+	// only recorded, the client is unknown in the Received header
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.Resolver = resolver
+	server.HeloPolicy = &smtpd.HeloPolicy{}
+	go server.ListenAndServe("127.0.0.1:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err = textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("HELO client.example.net")
+	conn.PrintfLine("MAIL FROM:<sender@example.net>")
+	conn.PrintfLine("RCPT TO:<user@example.com>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 250, 354)
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\nhi\r\n.")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("Message should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	if received := recorder.Messages[0].Headers["Received"]; !strings.Contains(received, "from client.example.net (unknown [127.0.0.1])") {
+		t.Errorf("Expected an unknown client in the Received header, got: %q", received)
+	}
+	if received := recorder.Messages[0].Headers["Received"]; !strings.Contains(received, "(helo=valid, fcrdns=fail)") {
+		t.Errorf("Expected the verdicts in the Received header, got: %q", received)
+	}
+}
@@ -0,0 +1,73 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// hookError converts an error from one of the Server's hooks into the reply for the client,
+// an *SMTPError is sent as is, others with the given code
+func hookError(err error, code int, enhanced string) *SMTPError {
+	var serr *SMTPError
+	if errors.As(err, &serr) {
+		return serr
+	}
+	return &SMTPError{code, enhanced, err}
+}
+
+// checkConnect runs the connect-time access control: the Allow & Deny lists, the DNSBL
+// checks for clients that aren't in Allow, the reverse DNS check, then OnConnect
+func (s *Server) checkConnect(conn *Conn) *SMTPError {
+	if ip := conn.RemoteIP(); !s.Allow.Contains(ip) {
+		if s.Deny.Contains(ip) {
+			return &SMTPError{554, "5.7.1", fmt.Errorf("Access denied")}
+		}
+		if serr := s.checkDNSBL(conn); serr != nil {
+			return serr
+		}
+	}
+	if serr := s.checkFCrDNS(conn); serr != nil {
+		return serr
+	}
+
+	if s.OnConnect != nil {
+		if err := s.OnConnect(conn); err != nil {
+			return hookError(err, 554, "5.7.1")
+		}
+	}
+	return nil
+}
+
+// checkHelo runs the HELO/EHLO name past the HeloPolicy, OnHelo & the milters
+func (s *Server) checkHelo(conn *Conn) *SMTPError {
+	if serr := s.checkHeloName(conn); serr != nil {
+		return serr
+	}
+	if s.OnHelo != nil {
+		if err := s.OnHelo(conn); err != nil {
+			return hookError(err, 550, "5.7.1")
+		}
+	}
+	return s.milterHelo(conn)
+}
+
+// command reports a command to OnCommand, leaving out the credentials AUTH can carry
+func (s *Server) command(conn *Conn, verb, args string) {
+	if s.OnCommand == nil {
+		return
+	}
+	if verb == "AUTH" {
+		args = strings.SplitN(args, " ", 2)[0]
+	}
+	s.OnCommand(conn, verb, args)
+}
+
+// banner is the text of the 220 reply that opens a session, sent again after XCLIENT
+func (s *Server) banner(conn *Conn) string {
+	if s.Banner != nil {
+		return s.Banner(conn)
+	}
+	return fmt.Sprintf("%v %v", s.Name, time.Now().Format(time.RFC1123Z))
+}
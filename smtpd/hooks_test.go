@@ -0,0 +1,107 @@
+package smtpd_test
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPAccessLists(t *testing.T) {
+
+	connect := func(allow ...string) error {
+		server := smtpd.NewServer(func(*email.Message) error { return nil })
+		server.Allow, _ = email.ParseNetworks(allow...)
+		server.Deny, _ = email.ParseNetworks("0.0.0.0/0", "::/0")
+		go server.ListenAndServe("127.0.0.1:0")
+		defer server.Close()
+
+		WaitUntilAlive(server)
+
+		conn, err := textproto.Dial("tcp", server.Address())
+		if err != nil {
+			t.Fatalf("Couldn't connect: %v", err)
+		}
+		defer conn.Close()
+		_, _, err = conn.ReadResponse(220)
+		return err
+	}
+
+	if err := connect(); err == nil || err.Error() != `554 "Access denied"` {
+		t.Errorf("A denied client should be refused, got: %v", err)
+	}
+	if err := connect("127.0.0.0/8"); err != nil {
+		t.Errorf("An allowed client should be greeted, got: %v", err)
+	}
+}
+
+func TestSMTPHooks(t *testing.T) {
+
+	var commands []string
+	disconnected := make(chan string, 1)
+
+	server := smtpd.NewServer(func(*email.Message) error { return nil })
+	server.OnConnect = func(conn *smtpd.Conn) error {
+		conn.SetValue("tenant", "acme")
+		return nil
+	}
+	server.Banner = func(conn *smtpd.Conn) string {
+		return fmt.Sprintf("mx.%v.example ESMTP", conn.Value("tenant"))
+	}
+	server.OnHelo = func(conn *smtpd.Conn) error {
+		if conn.Helo == "localhost" {
+			return smtpd.NewSMTPError(504, "5.5.2", "Bad HELO name")
+		}
+		return nil
+	}
+	server.OnCommand = func(conn *smtpd.Conn, verb, args string) {
+		commands = append(commands, strings.TrimSpace(verb+" "+args))
+	}
+	server.OnDisconnect = func(conn *smtpd.Conn) {
+		disconnected <- conn.Helo
+	}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	if _, msg, err := conn.ReadResponse(220); err != nil || msg != "mx.acme.example ESMTP" {
+		t.Errorf("Expected the custom banner, got: %v, %v", msg, err)
+	}
+
+	conn.PrintfLine("HELO localhost")
+	if _, _, err := conn.ReadResponse(250); err == nil || err.Error() != `504 "Bad HELO name"` {
+		t.Errorf("The HELO name should be refused, got: %v", err)
+	}
+	conn.PrintfLine("EHLO client.example.net")
+	conn.ReadResponse(250)
+	// without an Auth extension AUTH fails, it's still reported, without its credentials
+	conn.PrintfLine("AUTH PLAIN AHVzZXIAcGFzcw==")
+	conn.ReadResponse(502)
+	conn.PrintfLine("QUIT")
+	conn.ReadResponse(221)
+
+	select {
+	case helo := <-disconnected:
+		if helo != "client.example.net" {
+			t.Errorf("OnDisconnect should see the session, got HELO %v", helo)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnDisconnect wasn't called")
+	}
+
+	want := "HELO localhost, EHLO client.example.net, AUTH PLAIN, QUIT"
+	if got := strings.Join(commands, ", "); got != want {
+		t.Errorf("Expected the commands %v, got: %v", want, got)
+	}
+}
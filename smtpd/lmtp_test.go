@@ -0,0 +1,106 @@
+package smtpd_test
+
+import (
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestLMTP(t *testing.T) {
+
+	var delivered []*email.Message
+	server := smtpd.NewServer(func(m *email.Message) error {
+		delivered = append(delivered, m)
+		return smtpd.RecipientErrors{"full@example.net": smtpd.NewSMTPError(552, "5.2.2", "Mailbox over quota")}
+	})
+	server.LMTP = true
+
+	socket := filepath.Join(t.TempDir(), "lmtp.sock")
+	go server.ListenAndServeUnix(socket)
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+
+	conn.PrintfLine("EHLO client.example.net")
+	if _, _, err := conn.ReadResponse(250); err == nil || !strings.HasPrefix(err.Error(), "500") {
+		t.Errorf("EHLO should be refused by an LMTP server, got: %v", err)
+	}
+
+	conn.PrintfLine("LHLO client.example.net")
+	if _, msg, err := conn.ReadResponse(250); err != nil || !strings.Contains(msg, "PIPELINING") {
+		t.Errorf("LHLO should list the extensions, got: %v, %v", msg, err)
+	}
+
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	conn.PrintfLine("RCPT TO:<one@example.net>")
+	conn.PrintfLine("RCPT TO:<full@example.net>")
+	conn.PrintfLine("RCPT TO:<two@example.net>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 250, 250, 354)
+
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\nhi\r\n.")
+
+	// one reply per recipient, in RCPT order
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Errorf("one@example.net should be delivered: %v", err)
+	}
+	if _, msg, err := conn.ReadResponse(250); err == nil || err.Error() != `552 "5.2.2 Mailbox over quota"` {
+		t.Errorf("full@example.net should be refused, got: %v, %v", msg, err)
+	}
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Errorf("two@example.net should be delivered: %v", err)
+	}
+
+	if len(delivered) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(delivered))
+	}
+	if received := delivered[0].Headers["Received"]; !strings.Contains(received, "with LMTP") {
+		t.Errorf("Received header should record LMTP, got: %v", received)
+	}
+
+	// errors that aren't per recipient apply to all of them
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	conn.PrintfLine("RCPT TO:<one@example.net>")
+	conn.PrintfLine("RCPT TO:<two@example.net>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 250, 354)
+	conn.PrintfLine("Not a message\r\n.")
+	for i := 0; i < 2; i++ {
+		if _, _, err := conn.ReadResponse(250); err == nil || !strings.HasPrefix(err.Error(), "554") {
+			t.Errorf("Expected a 554 for recipient %v, got: %v", i+1, err)
+		}
+	}
+
+	// no recipient was accepted, so there's nobody to reply for
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	conn.PrintfLine("RCPT TO:<not an address>")
+	conn.PrintfLine("DATA")
+	conn.PrintfLine("BDAT 0 LAST")
+	conn.PrintfLine("NOOP")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("Expected a 250 reply: %v", err)
+	}
+	if _, _, err := conn.ReadResponse(250); err == nil {
+		t.Errorf("The recipient should be refused")
+	}
+	for _, verb := range []string{"DATA", "BDAT"} {
+		if _, _, err := conn.ReadResponse(354); err == nil || !strings.HasPrefix(err.Error(), "503") {
+			t.Errorf("%v without recipients should get a 503, got: %v", verb, err)
+		}
+	}
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Errorf("The session should still be in step, got: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package smtpd
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+// Middleware wraps a MessageHandler with some behaviour of its own (logging, policy checks,
+// header changes...), calling next to pass the message on or returning early to stop it.
+// The Wrap methods of dkim.Signer & dkim.Sealer work as middleware:
+//
+//	server.Use(func(next smtpd.MessageHandler) smtpd.MessageHandler { return signer.Wrap(next) })
+type Middleware func(next MessageHandler) MessageHandler
+
+// Use adds middleware around the Handler. The first added is the outermost, so it sees
+// each message first and its outcome last
+func (s *Server) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// Chain wraps handler in middleware, the first of which ends up outermost
+func Chain(handler MessageHandler, middleware ...Middleware) MessageHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Logging logs every message with its envelope, the outcome and how long handling it took
+func Logging(logger email.Logger) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *email.Message) error {
+			start := time.Now()
+			err := next(m)
+
+			from, to := "", ""
+			if m.Envelope != nil {
+				from, to = m.Envelope.From, strings.Join(m.Envelope.To, ",")
+			}
+			outcome := "accepted"
+			if err != nil {
+				outcome = fmt.Sprintf("failed: %v", err)
+			}
+			logger.Printf("Message %v from=<%v> to=<%v> %v in %v", m.ID(), from, to, outcome, time.Since(start))
+			return err
+		}
+	}
+}
+
+// Recover turns a panic in the handler into a temporary failure, so the client can try again
+// later, rather than dropping the connection. The panic & its stack trace go to logger.
+// The server always recovers around the whole chain, logging to its Logger; use Recover
+// to log elsewhere, or to keep the middleware outside it running
+func Recover(logger email.Logger) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *email.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Printf("Handler panicked on message %v: %v\n%s", m.ID(), r, debug.Stack())
+					err = &SMTPError{451, "4.3.0", fmt.Errorf("Error: Local error in processing")}
+				}
+			}()
+			return next(m)
+		}
+	}
+}
+
+// Timing reports how long the rest of the chain took with each message, and its outcome,
+// e.g. to feed a metrics histogram
+func Timing(observe func(m *email.Message, elapsed time.Duration, err error)) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *email.Message) error {
+			start := time.Now()
+			err := next(m)
+			observe(m, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// AddHeader prepends a header field to every message before passing it on. value is called
+// with each message, so the field can depend on it
+func AddHeader(name string, value func(*email.Message) string) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(m *email.Message) error {
+			if v := value(m); v != "" {
+				m.Prepend(name, v)
+			}
+			return next(m)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package smtpd_test
+
+import (
+	"bytes"
+	"log"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestChain(t *testing.T) {
+
+	var calls []string
+	trace := func(name string) smtpd.Middleware {
+		return func(next smtpd.MessageHandler) smtpd.MessageHandler {
+			return func(m *email.Message) error {
+				calls = append(calls, name+" in")
+				err := next(m)
+				calls = append(calls, name+" out")
+				return err
+			}
+		}
+	}
+	handler := smtpd.Chain(func(*email.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}, trace("first"), trace("second"))
+
+	handler(&email.Message{})
+
+	want := "first in, second in, handler, second out, first out"
+	if got := strings.Join(calls, ", "); got != want {
+		t.Errorf("Expected the calls %v, got: %v", want, got)
+	}
+}
+
+func TestSMTPMiddleware(t *testing.T) {
+
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+
+	var elapsed []time.Duration
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(func(m *email.Message) error {
+		if m.Subject == "panic" {
+			panic("something broke")
+		}
+		return recorder.Record(m)
+	})
+	server.Use(
+		smtpd.Logging(logger),
+		smtpd.Recover(logger),
+		smtpd.Timing(func(m *email.Message, d time.Duration, err error) { elapsed = append(elapsed, d) }),
+		smtpd.AddHeader("X-Policy", func(*email.Message) string { return "checked" }),
+	)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	conn.ReadResponse(250)
+
+	send := func(subject string) error {
+		conn.PrintfLine("MAIL FROM:<sender@example.org>")
+		conn.PrintfLine("RCPT TO:<user@example.net>")
+		conn.PrintfLine("DATA")
+		expectReplies(t, conn, 250, 250, 354)
+		conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: %v\r\n\r\nhi\r\n.", subject)
+		_, _, err := conn.ReadResponse(250)
+		return err
+	}
+
+	if err := send("panic"); err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("A panicking handler should tempfail the message, got: %v", err)
+	}
+	// the connection survives
+	if err := send("hello"); err != nil {
+		t.Fatalf("Message should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 || recorder.Messages[0].Headers["X-Policy"] != "checked" {
+		t.Errorf("The header should be added to the message, got: %v", recorder.Messages)
+	}
+	if len(elapsed) != 1 {
+		t.Errorf("Only the message that got past Recover should be timed, got: %v", elapsed)
+	}
+	for _, want := range []string{"something broke", "from=<sender@example.org> to=<user@example.net> accepted"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("The log should contain %q, got: %v", want, logs.String())
+		}
+	}
+}
+
+func TestSMTPRecoverByDefault(t *testing.T) {
+
+	server := smtpd.NewServer(func(m *email.Message) error {
+		panic("something broke")
+	})
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("HELO client.example.net")
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	conn.PrintfLine("RCPT TO:<user@example.net>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 250, 354)
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\n\r\nhi\r\n.")
+	if _, _, err := conn.ReadResponse(250); err == nil || !strings.HasPrefix(err.Error(), "451") {
+		t.Errorf("A panicking handler should tempfail the message, got: %v", err)
+	}
+
+	conn.PrintfLine("NOOP")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Errorf("The server should keep going, got: %v", err)
+	}
+}
@@ -0,0 +1,348 @@
+package smtpd
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/milter"
+)
+
+// milterSession is a connection's conversation with one of the Server.Milters
+type milterSession struct {
+	*milter.Session
+
+	// inMessage is set once the filter has been told about MAIL FROM, until the message is done
+	inMessage bool
+
+	// accepted is set when the filter accepted the current message and wants no more of it
+	accepted bool
+}
+
+// errMilterUnavailable is the reply when a filter can't be reached or breaks the protocol,
+// which holds up the connection's mail rather than letting it through unfiltered
+var errMilterUnavailable = &SMTPError{451, "4.7.1", fmt.Errorf("Service unavailable, try again later")}
+
+// milterError converts a filter's Reject or TempFail into an SMTP error, using the reply
+// the filter picked if it gave one
+func milterError(r *milter.Response) *SMTPError {
+	if r.Reply != "" {
+		code, _ := strconv.Atoi(r.Reply[:3])
+		text := strings.TrimSpace(r.Reply[3:])
+		enhanced := ""
+		if fields := strings.SplitN(text, " ", 2); len(fields) == 2 && isEnhancedCode(fields[0]) {
+			enhanced, text = fields[0], fields[1]
+		}
+		return &SMTPError{code, enhanced, fmt.Errorf("%v", text)}
+	}
+	if r.Action == milter.TempFail {
+		return &SMTPError{451, "4.7.1", fmt.Errorf("Service unavailable, try again later")}
+	}
+	return &SMTPError{550, "5.7.1", fmt.Errorf("Command rejected")}
+}
+
+// isEnhancedCode checks for a class.subject.detail status code, see https://tools.ietf.org/html/rfc3463
+func isEnhancedCode(code string) bool {
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || (parts[0] != "2" && parts[0] != "4" && parts[0] != "5") {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if _, err := strconv.ParseUint(part, 10, 16); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// milterFail drops every filter session of a connection after one of them failed, so
+// that the rest of its mail is turned away
+func (s *Server) milterFail(conn *Conn, err error) *SMTPError {
+	s.Logger.Printf("Milter error for %v: %v", conn.RemoteAddr(), err)
+	s.milterClose(conn)
+	conn.milterFailed = true
+	return errMilterUnavailable
+}
+
+// milterStage runs one stage of the connection past each filter, stopping at the first
+// one that doesn't Continue. Filters that already accepted the current message are skipped
+func (s *Server) milterStage(conn *Conn, stage byte, macros map[string]string, call func(*milterSession) (*milter.Response, error)) (*milter.Response, *SMTPError) {
+	if conn.milterFailed {
+		return nil, errMilterUnavailable
+	}
+
+	for _, session := range conn.milters {
+		if session.accepted {
+			continue
+		}
+		if err := session.SetMacros(stage, macros); err != nil {
+			return nil, s.milterFail(conn, err)
+		}
+		r, err := call(session)
+		if err != nil {
+			return nil, s.milterFail(conn, err)
+		}
+		switch r.Action {
+		case milter.Continue:
+		case milter.Accept:
+			session.accepted = true
+		default:
+			return r, nil
+		}
+	}
+	return &milter.Response{Action: milter.Continue}, nil
+}
+
+// milterConnect opens a session with each filter for a new connection and tells them
+// about the client, returning the error to close the connection with if they refuse it.
+// Filters that accept the connection are left out of the rest of it
+func (s *Server) milterConnect(conn *Conn) *SMTPError {
+	if len(s.Milters) == 0 {
+		return nil
+	}
+
+	for _, client := range s.Milters {
+		session, err := client.Open()
+		if err != nil {
+			// the client gets to say hello, its mail is turned away from MAIL on
+			s.milterFail(conn, err)
+			return nil
+		}
+		conn.milters = append(conn.milters, &milterSession{Session: session})
+	}
+
+	// filters expect the reverse DNS name, or the address in brackets without one
+	s.remoteInfo(conn)
+	hostname := conn.RemoteName
+	if hostname == "" {
+		hostname = fmt.Sprintf("[%v]", conn.RemoteIP())
+	}
+
+	macros := map[string]string{
+		"j":           s.ServerName,
+		"daemon_name": s.Name,
+	}
+	r, serr := s.milterStage(conn, milter.StageConnect, macros, func(session *milterSession) (*milter.Response, error) {
+		return session.Connect(hostname, conn.RemoteAddr())
+	})
+	if serr != nil {
+		// the failure is remembered, like when a filter can't be reached
+		return nil
+	}
+	s.milterDone(conn)
+
+	// the only replies that can open a session are 220, 421 & 554, see https://tools.ietf.org/html/rfc5321#section-3.1
+	switch {
+	case r.Reply != "":
+		serr := milterError(r)
+		if serr.code/100 == 4 {
+			serr.code = 421
+		} else {
+			serr.code = 554
+		}
+		return serr
+	case r.Action == milter.Reject:
+		return &SMTPError{554, "5.7.1", fmt.Errorf("Connection rejected")}
+	case r.Action == milter.TempFail:
+		return &SMTPError{421, "4.7.1", fmt.Errorf("Service unavailable, try again later")}
+	}
+	return nil
+}
+
+// milterHelo passes the HELO/EHLO name on to the filters
+func (s *Server) milterHelo(conn *Conn) *SMTPError {
+	if conn.milterFailed {
+		// leave turning the client away to MAIL
+		return nil
+	}
+
+	r, serr := s.milterStage(conn, milter.StageHelo, nil, func(session *milterSession) (*milter.Response, error) {
+		return session.Helo(conn.Helo)
+	})
+	if serr != nil {
+		return serr
+	}
+	s.milterDone(conn)
+
+	switch r.Action {
+	case milter.Reject, milter.TempFail:
+		return milterError(r)
+	}
+	return nil
+}
+
+// milterDone closes the sessions of filters that accepted the connection before a
+// message started, they've seen all they want of it
+func (s *Server) milterDone(conn *Conn) {
+	sessions := conn.milters[:0]
+	for _, session := range conn.milters {
+		if session.accepted {
+			session.Close()
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	conn.milters = sessions
+}
+
+// milterMail starts a message with the filters. A Discard drops the message once it's received
+func (s *Server) milterMail(conn *Conn, params map[string]string) *SMTPError {
+	macros := map[string]string{
+		"i":         conn.QueueID(),
+		"mail_addr": conn.FromAddr.Address,
+	}
+	if user, ok := conn.User.(*XClientUser); ok {
+		macros["auth_authen"] = user.Login
+	}
+
+	r, serr := s.milterStage(conn, milter.StageMail, macros, func(session *milterSession) (*milter.Response, error) {
+		session.inMessage = true
+		return session.Mail(conn.FromAddr.Address, milterParams(params))
+	})
+	if serr != nil {
+		return serr
+	}
+
+	switch r.Action {
+	case milter.Reject, milter.TempFail:
+		return milterError(r)
+	case milter.Discard:
+		conn.discard = true
+	}
+	return nil
+}
+
+// milterRcpt checks a recipient with the filters, a rejection only turns down that recipient
+func (s *Server) milterRcpt(conn *Conn, to *mail.Address, params map[string]string) *SMTPError {
+	if conn.transaction == 0 {
+		// the filters only hear about recipients of a message
+		return nil
+	}
+
+	macros := map[string]string{"rcpt_addr": to.Address}
+
+	r, serr := s.milterStage(conn, milter.StageRcpt, macros, func(session *milterSession) (*milter.Response, error) {
+		return session.Rcpt(to.Address, milterParams(params))
+	})
+	if serr != nil {
+		return serr
+	}
+
+	switch r.Action {
+	case milter.Reject, milter.TempFail:
+		return milterError(r)
+	case milter.Discard:
+		conn.discard = true
+	}
+	return nil
+}
+
+// milterMessage passes the message on to each filter in turn, making the changes they ask
+// for. It returns the message as the filters left it
+func (s *Server) milterMessage(conn *Conn, m *email.Message) (*email.Message, *SMTPError) {
+	if conn.milterFailed {
+		return nil, errMilterUnavailable
+	}
+
+	macros := map[string]string{"i": conn.QueueID()}
+
+	for _, session := range conn.milters {
+		if session.accepted {
+			continue
+		}
+		if err := session.SetMacros(milter.StageEOM, macros); err != nil {
+			return nil, s.milterFail(conn, err)
+		}
+		r, mods, err := session.SendMessage(m.Raw)
+		if err != nil {
+			return nil, s.milterFail(conn, err)
+		}
+		session.inMessage = false
+
+		switch r.Action {
+		case milter.Reject, milter.TempFail:
+			session.Abort()
+			return nil, milterError(r)
+		case milter.Discard:
+			session.Abort()
+			conn.discard = true
+			return m, nil
+		}
+
+		if len(mods) > 0 {
+			if m, err = s.milterModify(m, mods); err != nil {
+				return nil, &SMTPError{554, "5.6.0", fmt.Errorf("Error: Filter broke the message. %v", err)}
+			}
+		}
+	}
+	return m, nil
+}
+
+// milterModify applies the changes a filter made to the message and its envelope
+func (s *Server) milterModify(m *email.Message, mods []*milter.Modification) (*email.Message, error) {
+	modified, err := s.parseMessage(milter.Apply(m.Raw, mods))
+	if err != nil {
+		return nil, err
+	}
+	modified.Envelope = m.Envelope
+	modified.AuthResults = m.AuthResults
+
+	envelope := m.Envelope
+	for _, mod := range mods {
+		switch mod.Kind {
+		case milter.ChangeFrom:
+			envelope.From = mod.Address
+		case milter.AddRecipient:
+			envelope.To = append(envelope.To, mod.Address)
+			envelope.Recipients = append(envelope.Recipients, &email.Recipient{Address: mod.Address})
+		case milter.DeleteRecipient:
+			for i := 0; i < len(envelope.To); i++ {
+				if strings.EqualFold(envelope.To[i], mod.Address) {
+					envelope.To = append(envelope.To[:i], envelope.To[i+1:]...)
+					envelope.Recipients = append(envelope.Recipients[:i], envelope.Recipients[i+1:]...)
+					i--
+				}
+			}
+		case milter.Quarantine:
+			s.Logger.Printf("Milter quarantined message %v: %v", modified.ID(), mod.Reason)
+		}
+	}
+	return modified, nil
+}
+
+// milterAbort tells the filters that the current message won't be sent after all, and
+// readies them for the next one
+func (c *Conn) milterAbort() {
+	c.discard = false
+	for _, session := range c.milters {
+		if session.inMessage {
+			session.Abort()
+		}
+		session.inMessage = false
+		session.accepted = false
+	}
+}
+
+// milterClose ends every filter session of a connection
+func (s *Server) milterClose(conn *Conn) {
+	for _, session := range conn.milters {
+		session.Close()
+	}
+	conn.milters = nil
+}
+
+// milterParams rebuilds the ESMTP parameters of a MAIL or RCPT command for the filters
+func milterParams(params map[string]string) []string {
+	var list []string
+	for key, value := range params {
+		if value != "" {
+			key += "=" + value
+		}
+		list = append(list, key)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,216 @@
+package smtpd_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/milter"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+// FakeMilter is a filter that answers each command (by its code) with the packets respond
+// returns, each a reply code followed by its data. It continues when there are none
+func FakeMilter(t *testing.T, respond func(code byte, data string) []string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			header := make([]byte, 5)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			data := make([]byte, binary.BigEndian.Uint32(header)-1)
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return
+			}
+
+			var replies []string
+			switch code := header[4]; code {
+			case 'O':
+				negotiation := make([]byte, 12)
+				binary.BigEndian.PutUint32(negotiation, milter.Version)
+				binary.BigEndian.PutUint32(negotiation[4:], milter.AllActions)
+				replies = []string{"O" + string(negotiation)}
+			case 'D', 'A':
+				continue
+			case 'Q':
+				return
+			default:
+				if replies = respond(code, string(data)); len(replies) == 0 {
+					replies = []string{"c"}
+				}
+			}
+
+			for _, reply := range replies {
+				packet := make([]byte, 4, 4+len(reply))
+				binary.BigEndian.PutUint32(packet, uint32(len(reply)))
+				conn.Write(append(packet, reply...))
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return listener
+}
+
+func TestSMTPMilter(t *testing.T) {
+
+	filter := FakeMilter(t, func(code byte, data string) []string {
+		switch {
+		case code == 'R' && strings.HasPrefix(data, "<blocked@"):
+			return []string{"y550 5.7.1 Blocked by policy\x00"}
+		case code == 'E':
+			return []string{
+				"hX-Filtered\x00yes\x00",
+				"m\x00\x00\x00\x01Subject\x00[filtered] hello\x00",
+				"+<extra@example.net>\x00",
+				"c",
+			}
+		}
+		return nil
+	})
+	defer filter.Close()
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.Resolver = &FakeResolver{}
+	server.Milters = []*milter.Client{milter.NewClient("tcp", filter.Addr().String())}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	conn.PrintfLine("RCPT TO:<user@example.net>")
+	conn.PrintfLine("RCPT TO:<blocked@example.net>")
+	expectReplies(t, conn, 250, 250, 250)
+	if _, msg, err := conn.ReadResponse(250); err == nil || err.Error() != `550 "5.7.1 Blocked by policy"` {
+		t.Errorf("The recipient should be refused with the filter's reply, got: %v %v", msg, err)
+	}
+
+	conn.PrintfLine("DATA")
+	conn.ReadResponse(354)
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\nhi\r\n.")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("Message should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	m := recorder.Messages[0]
+	if m.Headers["X-Filtered"] != "yes" || m.Subject != "[filtered] hello" {
+		t.Errorf("The filter's header changes should be made, got: %v", m.Headers)
+	}
+	if to := m.Envelope.To; len(to) != 2 || to[1] != "extra@example.net" {
+		t.Errorf("The filter's recipient should be added, got: %v", to)
+	}
+}
+
+func TestSMTPMilterVerdicts(t *testing.T) {
+
+	filter := FakeMilter(t, func(code byte, data string) []string {
+		switch {
+		case code == 'M' && strings.HasPrefix(data, "<spammer@"):
+			return []string{"r"}
+		case code == 'B' && strings.Contains(data, "discard me"):
+			return []string{"d"}
+		}
+		return nil
+	})
+	defer filter.Close()
+
+	delivered := 0
+	server := smtpd.NewServer(func(*email.Message) error {
+		delivered++
+		return nil
+	})
+	server.Milters = []*milter.Client{milter.NewClient("tcp", filter.Addr().String())}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	conn.ReadResponse(250)
+
+	conn.PrintfLine("MAIL FROM:<spammer@example.org>")
+	if _, _, err := conn.ReadResponse(250); err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("The sender should be rejected, got: %v", err)
+	}
+
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	conn.PrintfLine("RCPT TO:<user@example.net>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 354)
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\ndiscard me\r\n.")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("A discarded message should look accepted: %v", err)
+	}
+	if delivered != 0 {
+		t.Errorf("A discarded message shouldn't be delivered")
+	}
+}
+
+func TestSMTPMilterUnavailable(t *testing.T) {
+
+	// nothing listens here once it's closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	listener.Close()
+
+	server := smtpd.NewServer(func(*email.Message) error { return nil })
+	server.Milters = []*milter.Client{milter.NewClient("tcp", listener.Addr().String())}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	conn.ReadResponse(250)
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	if _, _, err := conn.ReadResponse(250); err == nil || !strings.HasPrefix(err.Error(), `451 "4.7.1`) {
+		t.Errorf("Mail should be tempfailed while the filter is down, got: %v", err)
+	}
+}
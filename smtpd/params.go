@@ -0,0 +1,230 @@
+package smtpd
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/hownowstephen/email"
+)
+
+// splitParams separates the address of a MAIL or RCPT argument from the ESMTP
+// parameters that follow it, see https://tools.ietf.org/html/rfc5321#section-4.1.2
+func splitParams(args string) (string, map[string]string) {
+	end := strings.LastIndex(args, ">") + 1
+	if end == 0 {
+		// no brackets, the address is the first word after the colon
+		rest := strings.TrimLeft(args[strings.Index(args, ":")+1:], " ")
+		end = len(args) - len(rest)
+		if space := strings.IndexByte(rest, ' '); space >= 0 {
+			end += space
+		} else {
+			end = len(args)
+		}
+	}
+
+	params := make(map[string]string)
+	for _, param := range strings.Fields(args[end:]) {
+		kv := strings.SplitN(param, "=", 2)
+		key := strings.ToUpper(kv[0])
+		params[key] = ""
+		if len(kv) == 2 {
+			params[key] = kv[1]
+		}
+	}
+
+	return args[:end], params
+}
+
+// mailParams checks the parameters of a MAIL command, applying them to the new transaction
+func (s *Server) mailParams(conn *Conn, params map[string]string) *SMTPError {
+	for key, value := range params {
+		switch key {
+		// https://tools.ietf.org/html/rfc1870#section-6
+		case "SIZE":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return &SMTPError{501, "5.5.4", fmt.Errorf("Invalid SIZE parameter")}
+			} else if s.MaxSize > 0 && size > s.MaxSize {
+				return &SMTPError{552, "5.3.4", fmt.Errorf("Message size exceeds fixed maximum message size")}
+			}
+		// https://tools.ietf.org/html/rfc3030#section-3
+		case "BODY":
+			switch strings.ToUpper(value) {
+			case "7BIT":
+			// https://tools.ietf.org/html/rfc6152#section-2
+			case "8BITMIME":
+				if s.Disabled["8BITMIME"] {
+					return &SMTPError{555, "5.5.4", fmt.Errorf("BODY=8BITMIME is not supported")}
+				}
+			case "BINARYMIME":
+				if !s.BinaryMIME || s.Disabled["BDAT"] {
+					return &SMTPError{555, "5.5.4", fmt.Errorf("BODY=BINARYMIME is not supported")}
+				}
+			default:
+				return &SMTPError{555, "5.5.4", fmt.Errorf("Unsupported BODY type %v", value)}
+			}
+			conn.Body = strings.ToUpper(value)
+		// https://tools.ietf.org/html/rfc6531#section-3.4
+		case "SMTPUTF8":
+			if s.Disabled["SMTPUTF8"] || value != "" {
+				return &SMTPError{555, "5.5.4", fmt.Errorf("SMTPUTF8 is not supported")}
+			}
+			conn.SMTPUTF8 = true
+		// https://tools.ietf.org/html/rfc3461#section-4.3
+		case "RET":
+			if s.Disabled["DSN"] {
+				return &SMTPError{555, "5.5.4", fmt.Errorf("DSN is not supported")}
+			}
+			switch strings.ToUpper(value) {
+			case "FULL", "HDRS":
+				conn.Return = strings.ToUpper(value)
+			default:
+				return &SMTPError{501, "5.5.4", fmt.Errorf("Invalid RET parameter %v", value)}
+			}
+		// https://tools.ietf.org/html/rfc3461#section-4.4
+		case "ENVID":
+			if s.Disabled["DSN"] {
+				return &SMTPError{555, "5.5.4", fmt.Errorf("DSN is not supported")}
+			}
+			id, err := decodeXtext(value)
+			if err != nil || id == "" || len(value) > 100 {
+				return &SMTPError{501, "5.5.4", fmt.Errorf("Invalid ENVID parameter")}
+			}
+			conn.EnvelopeID = id
+		default:
+			return &SMTPError{555, "5.5.4", fmt.Errorf("MAIL FROM parameter %v not recognized or not implemented", key)}
+		}
+	}
+
+	return normalizeAddress(conn.FromAddr, conn.SMTPUTF8)
+}
+
+// normalizeAddress checks that an envelope address is allowed in the transaction, and puts its
+// domain in the form that goes with it: U-labels for SMTPUTF8 transactions, A-labels otherwise
+func normalizeAddress(addr *mail.Address, smtputf8 bool) *SMTPError {
+	at := strings.LastIndex(addr.Address, "@")
+	if at < 0 {
+		return nil
+	}
+	local, domain := addr.Address[:at], addr.Address[at+1:]
+
+	if !smtputf8 && !isASCII(addr.Address) {
+		// https://tools.ietf.org/html/rfc6531#section-3.5
+		return &SMTPError{553, "5.6.7", fmt.Errorf("Non-ASCII address %v requires SMTPUTF8", addr.Address)}
+	}
+
+	var err error
+	if smtputf8 {
+		domain, err = email.ToUnicode(domain)
+	} else {
+		domain, err = email.ToASCII(domain)
+	}
+	if err != nil {
+		return &SMTPError{553, "5.1.3", err}
+	}
+
+	addr.Address = local + "@" + domain
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// rcptParams checks the parameters of a RCPT command, returning the recipient with its DSN settings
+func (s *Server) rcptParams(to *mail.Address, params map[string]string) (*email.Recipient, *SMTPError) {
+	recipient := &email.Recipient{Address: to.Address}
+
+	for key, value := range params {
+		if (key == "NOTIFY" || key == "ORCPT") && s.Disabled["DSN"] {
+			return nil, &SMTPError{555, "5.5.4", fmt.Errorf("DSN is not supported")}
+		}
+
+		switch key {
+		// https://tools.ietf.org/html/rfc3461#section-4.1
+		case "NOTIFY":
+			for _, notify := range strings.Split(strings.ToUpper(value), ",") {
+				switch notify {
+				case email.NotifySuccess, email.NotifyFailure, email.NotifyDelay:
+				case email.NotifyNever:
+					if strings.Contains(value, ",") {
+						return nil, &SMTPError{501, "5.5.4", fmt.Errorf("NOTIFY=NEVER can't be combined with other values")}
+					}
+				default:
+					return nil, &SMTPError{501, "5.5.4", fmt.Errorf("Invalid NOTIFY parameter %v", value)}
+				}
+				recipient.Notify = append(recipient.Notify, notify)
+			}
+		// https://tools.ietf.org/html/rfc3461#section-4.2
+		case "ORCPT":
+			semicolon := strings.IndexByte(value, ';')
+			if semicolon <= 0 {
+				return nil, &SMTPError{501, "5.5.4", fmt.Errorf("Invalid ORCPT parameter")}
+			}
+			original, err := decodeXtext(value[semicolon+1:])
+			if err != nil || original == "" || len(value) > 500 {
+				return nil, &SMTPError{501, "5.5.4", fmt.Errorf("Invalid ORCPT parameter")}
+			}
+			recipient.Original = strings.ToLower(value[:semicolon]) + ";" + original
+		default:
+			return nil, &SMTPError{555, "5.5.4", fmt.Errorf("RCPT TO parameter %v not recognized or not implemented", key)}
+		}
+	}
+
+	return recipient, nil
+}
+
+// decodeXtext undoes the "+XX" hex escaping used in DSN parameters, see https://tools.ietf.org/html/rfc3461#section-4
+func decodeXtext(xtext string) (string, error) {
+	var decoded strings.Builder
+	for i := 0; i < len(xtext); i++ {
+		c := xtext[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(xtext) {
+				return "", fmt.Errorf("Truncated xtext escape")
+			}
+			b, err := strconv.ParseUint(xtext[i+1:i+3], 16, 8)
+			if err != nil || strings.ToUpper(xtext[i+1:i+3]) != xtext[i+1:i+3] {
+				return "", fmt.Errorf("Invalid xtext escape %q", xtext[i:i+3])
+			}
+			decoded.WriteByte(byte(b))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("Invalid xtext character %q", c)
+		default:
+			decoded.WriteByte(c)
+		}
+	}
+	return decoded.String(), nil
+}
+
+// parseBDAT reads the arguments of a BDAT command, see https://tools.ietf.org/html/rfc3030#section-2
+func parseBDAT(args string) (int64, bool, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, false, fmt.Errorf("Syntax: BDAT <size> [LAST]")
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, fmt.Errorf("Invalid chunk size %v", fields[0])
+	}
+
+	last := false
+	if len(fields) == 2 {
+		if strings.ToUpper(fields[1]) != "LAST" {
+			return 0, false, fmt.Errorf("Syntax: BDAT <size> [LAST]")
+		}
+		last = true
+	}
+
+	return size, last, nil
+}
@@ -0,0 +1,86 @@
+package smtpd_test
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPPipelining(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	conn.PrintfLine("EHLO client.example.net")
+	_, msg, err := conn.ReadResponse(250)
+	if err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	}
+	if !strings.Contains(msg, "\nPIPELINING\n") {
+		t.Errorf("PIPELINING should be advertised, got: %v", msg)
+	}
+
+	// the whole envelope goes out in one write, the replies come back in order
+	conn.W.WriteString("MAIL FROM:<sender@example.net>\r\nRCPT TO:<one@example.org>\r\nRCPT TO:bogus\r\nRCPT TO:<two@example.org>\r\nDATA\r\n")
+	conn.W.Flush()
+
+	expectReplies(t, conn, 250, 250, 501, 250, 354)
+
+	conn.W.WriteString("From: sender@example.net\r\nTo: one@example.org\r\nContent-Type: text/plain\r\n\r\nbody\r\n.\r\nRSET\r\nQUIT\r\n")
+	conn.W.Flush()
+
+	expectReplies(t, conn, 250, 250, 221)
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPEarlyTalker(t *testing.T) {
+
+	server := smtpd.NewServer(func(m *email.Message) error { return nil })
+	server.GreetingDelay = 200 * time.Millisecond
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	polite, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer polite.Close()
+
+	rude, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer rude.Close()
+
+	rude.PrintfLine("EHLO spammer.example")
+	if _, _, err := rude.ReadResponse(220); err == nil || !strings.HasPrefix(err.Error(), "554") {
+		t.Errorf("Client talking before the greeting should be refused, got: %v", err)
+	}
+
+	if _, _, err := polite.ReadResponse(220); err != nil {
+		t.Errorf("Client waiting for the greeting should get it: %v", err)
+	}
+}
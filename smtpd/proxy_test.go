@@ -0,0 +1,49 @@
+package smtpd_test
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPProxyProtocol(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.Resolver = &FakeResolver{}
+	server.ProxyProtocol, _ = email.ParseNetworks("127.0.0.1", "::1")
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	// the balancer sends the header first thing, before the greeting
+	conn.PrintfLine("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25")
+
+	conn.PrintfLine("EHLO client.example.net")
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	conn.PrintfLine("RCPT TO:<user@example.net>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 220, 250, 250, 250, 354)
+
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\nhi\r\n.")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("Message should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	if received := recorder.Messages[0].Headers["Received"]; !strings.Contains(received, "[192.0.2.1]") {
+		t.Errorf("Received header should show the real client, got: %v", received)
+	}
+}
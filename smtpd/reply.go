@@ -0,0 +1,66 @@
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Reply is a response to an SMTP command, see https://tools.ietf.org/html/rfc5321#section-4.2
+type Reply struct {
+	// Code is the basic three digit reply code
+	Code int
+
+	// Enhanced is the status code from https://tools.ietf.org/html/rfc3463 (e.g. "5.1.1"),
+	// sent to clients that used EHLO. When empty, the generic code for the class is sent
+	Enhanced string
+
+	// Lines of text, a reply spanning several lines repeats the codes on each of them
+	Lines []string
+}
+
+// NewReply creates a reply with one or more lines of text
+func NewReply(code int, enhanced string, lines ...string) *Reply {
+	return &Reply{Code: code, Enhanced: enhanced, Lines: lines}
+}
+
+// lineBreaks are folded out of reply text, so it can't end the reply early or forge another
+var lineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// String renders the reply as sent on the wire, with the enhanced status code if withEnhanced
+// is set, see https://tools.ietf.org/html/rfc2034#section-4
+func (r *Reply) String(withEnhanced bool) string {
+	prefix := ""
+	if withEnhanced {
+		if enhanced := r.enhancedCode(); enhanced != "" {
+			prefix = enhanced + " "
+		}
+	}
+
+	lines := r.Lines
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+
+	var b strings.Builder
+	for i, line := range lines {
+		separator := " "
+		if i < len(lines)-1 {
+			separator = "-"
+		}
+		fmt.Fprintf(&b, "%v%v%v%v\r\n", r.Code, separator, prefix, lineBreaks.Replace(line))
+	}
+	return b.String()
+}
+
+// enhancedCode falls back to the generic code for the reply's class, only success
+// & failure replies carry one
+func (r *Reply) enhancedCode() string {
+	class := r.Code / 100
+	if class != 2 && class != 4 && class != 5 {
+		return ""
+	}
+	if r.Enhanced != "" {
+		return r.Enhanced
+	}
+	return fmt.Sprintf("%v.0.0", class)
+}
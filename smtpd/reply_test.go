@@ -0,0 +1,81 @@
+package smtpd_test
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestReplyString(t *testing.T) {
+	for _, test := range []struct {
+		reply    *smtpd.Reply
+		enhanced bool
+		want     string
+	}{
+		{smtpd.NewReply(250, "2.1.5", "Accepted"), true, "250 2.1.5 Accepted\r\n"},
+		{smtpd.NewReply(250, "2.1.5", "Accepted"), false, "250 Accepted\r\n"},
+		{smtpd.NewReply(550, "", "first", "second"), true, "550-5.0.0 first\r\n550 5.0.0 second\r\n"},
+		{smtpd.NewReply(354, "", "Go ahead"), true, "354 Go ahead\r\n"},
+		{smtpd.ErrAuthFailed.Reply(), true, "535 5.7.8 Authentication credentials invalid\r\n"},
+		{smtpd.NewReply(550, "5.7.1", "Blocked\r\n250 OK\nreally"), true, "550 5.7.1 Blocked 250 OK really\r\n"},
+	} {
+		if got := test.reply.String(test.enhanced); got != test.want {
+			t.Errorf("Wrong reply, want: %q, got: %q", test.want, got)
+		}
+	}
+}
+
+func TestSMTPEnhancedStatusCodes(t *testing.T) {
+
+	server := smtpd.NewServer(nil)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	reply := func(command string, code int) string {
+		conn.PrintfLine("%s", command)
+		_, msg, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("Expected a %v reply to %v: %v", code, command, err)
+		}
+		return msg
+	}
+
+	conn.ReadResponse(220)
+
+	// HELO clients don't get enhanced codes
+	reply("HELO client.example.net", 250)
+	if msg := reply("NOOP", 250); msg != "OK" {
+		t.Errorf("HELO client shouldn't get enhanced codes, got: %v", msg)
+	}
+
+	if msg := reply("EHLO client.example.net", 250); !strings.Contains(msg, "\nENHANCEDSTATUSCODES\n") || strings.Contains(msg, "2.0.0") {
+		t.Errorf("ENHANCEDSTATUSCODES should be advertised, without an enhanced code on the EHLO reply itself, got: %v", msg)
+	}
+
+	for _, test := range []struct {
+		command string
+		code    int
+		want    string
+	}{
+		{"NOOP", 250, "2.0.0 OK"},
+		{"MAIL FROM:<sender@example.net>", 250, "2.1.0 Accepted"},
+		{"RCPT TO:<recipient@example.org>", 250, "2.1.5 Accepted"},
+		{"MAIL FROM:<sender@example.net>", 501, "5.5.1 Transaction unsuccessful"},
+		{"RSET", 250, "2.0.0 OK"},
+		{"BOGUS", 500, "5.5.2 Syntax error, command unrecognised"},
+	} {
+		if msg := reply(test.command, test.code); msg != test.want {
+			t.Errorf("Wrong reply to %v, want: %v, got: %v", test.command, test.want, msg)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
     "crypto/tls"
     "fmt"
     "io"
+    "io/ioutil"
     "log"
     "net"
     "net/mail"
@@ -13,6 +14,9 @@ import (
     "time"
 
     "github.com/hownowstephen/email"
+    "github.com/hownowstephen/email/greylist"
+    "github.com/hownowstephen/email/milter"
+    "github.com/hownowstephen/email/proxyproto"
 )
 
 // MessageHandler functions handle application of business logic to the inbound message
@@ -35,12 +39,118 @@ type Server struct {
     // from a single client before terminating the session
     MaxCommands int
 
+    // ProxyProtocol lists the load balancers allowed to send a PROXY protocol header, so
+    // that Conn.RemoteAddr is the real client's address rather than the balancer's. Empty disables it
+    ProxyProtocol email.Networks
+
+    // XClient lists the front-end proxies allowed to pass on the details of the client they're
+    // serving with XCLIENT, which then apply to the session (RemoteAddr, Helo, User...) in
+    // place of the proxy's own, see http://www.postfix.org/XCLIENT_README.html. The
+    // connect-time checks (Allow & Deny, DNSBL, reverse DNS, OnConnect & Milters) are run
+    // again for that client
+    XClient email.Networks
+
+    // XForward lists the proxies allowed to send XFORWARD, passing on the client details of
+    // the next message for the Received header, see http://www.postfix.org/XFORWARD_README.html
+    XForward email.Networks
+
+    // GreetingDelay holds back the greeting for this long, refusing clients that start
+    // talking before it's sent (a common trait of spam bots). Zero sends it right away
+    GreetingDelay time.Duration
+
+    // Allow & Deny are connect-time access control lists: clients in Deny are refused with
+    // a 554 before the banner, unless they're also in Allow. Deny everything ("0.0.0.0/0"
+    // & "::/0") to only accept the clients in Allow. Clients in Allow skip the DNSBL checks
+    Allow email.Networks
+    Deny  email.Networks
+
+    // OnConnect is called when a client connects, after the Allow & Deny lists. Return an
+    // error to refuse the connection with a 554 (or an *SMTPError for another reply). It can
+    // attach values to the session with Conn.SetValue
+    OnConnect func(*Conn) error
+
+    // Banner builds the text of the 220 reply that opens a session, the default is the
+    // server's Name & the time
+    Banner func(*Conn) string
+
+    // HeloPolicy checks the HELO/EHLO names & reverse DNS of clients, nil skips the checks
+    HeloPolicy *HeloPolicy
+
+    // OnHelo is called with every HELO/EHLO, once Conn.Helo is set. Return an error to
+    // refuse the greeting with a 550 (or an *SMTPError for another reply)
+    OnHelo func(*Conn) error
+
+    // OnCommand is called with every command the client sends, before it's handled, for
+    // auditing & metrics. The credentials sent with AUTH are left out
+    OnCommand func(conn *Conn, verb, args string)
+
+    // OnDisconnect is called when a session ends, before the connection is closed
+    OnDisconnect func(*Conn)
+
     // RateLimiter gets called before proceeding through to message handling
     RateLimiter func(*Conn) bool
 
-    // Handler is the handoff function for messages
+    // LMTP switches the server to the Local Mail Transfer Protocol, for final delivery
+    // behind an MTA: clients greet with LHLO and get a reply for each recipient after
+    // the message, see https://tools.ietf.org/html/rfc2033. The Handler can return
+    // RecipientErrors to turn down some of the recipients
+    LMTP bool
+
+    // BinaryMIME advertises BINARYMIME, accepting binary message content sent with BDAT,
+    // see https://tools.ietf.org/html/rfc3030#section-3
+    BinaryMIME bool
+
+    // Handler is the handoff function for messages. Return an *SMTPError (see NewSMTPError)
+    // to pick the reply; other errors are sent as a 451 so the client retries, unless
+    // they're marked with Permanent
     Handler MessageHandler
 
+    // middleware wraps the Handler, see Use
+    middleware []Middleware
+
+    // Received builds the Received header added to every accepted message, return ""
+    // to leave it out. When nil, ReceivedHeader is used
+    Received func(*Conn) string
+
+    // ReturnPath adds a Return-Path header with the envelope sender, set this when
+    // the Handler performs final delivery, see https://tools.ietf.org/html/rfc5321#section-4.4
+    ReturnPath bool
+
+    // Resolver is used for DNS lookups, like the client's reverse DNS name
+    Resolver email.Resolver
+
+    // SPF enables sender policy checks on MAIL FROM, nil disables them
+    SPF *SPFPolicy
+
+    // VerifyDKIM checks the DKIM signatures of every accepted message, the results
+    // end up in Message.AuthResults and an Authentication-Results header
+    VerifyDKIM bool
+
+    // VerifyARC validates the ARC chain of every accepted message, for mail that was
+    // forwarded through lists or relays. Use dkim.Sealer.Wrap on the handler to add
+    // an ARC set to messages that are modified & forwarded
+    VerifyARC bool
+
+    // DNSBL looks clients up in DNS blocklists & allowlists, scoring them or refusing
+    // those that score too high. Nil disables the checks
+    DNSBL *DNSBLPolicy
+
+    // Greylist turns away recipients the first time they're sent mail from a client network
+    // & sender, with a 451, see greylist.NewGreylister. Nil disables greylisting
+    Greylist *greylist.Greylister
+
+    // DMARC enables author domain policy checks on every accepted message, nil disables them
+    DMARC *DMARCPolicy
+
+    // Milters are mail filters (like OpenDKIM, rspamd or SpamAssassin's spamass-milter) that
+    // every connection & message is run past, in order. They can reject, discard or change
+    // messages. Mail is tempfailed while a filter can't be reached
+    Milters []*milter.Client
+
+    // Lenient parses inbound messages with email.NewLenientMessage, so that
+    // messages with missing or broken To/From/Content-Type headers are still accepted
+    Lenient bool
+
     // Auth is an authentication-handling extension
     Auth Extension
 
@@ -72,6 +182,7 @@ func NewServer(handler func(*email.Message) error) *Server {
         MaxSize:     131072,
         MaxCommands: 100,
         Handler:     handler,
+        Resolver:    &email.NetResolver{},
         Extensions:  make(map[string]Extension),
         Disabled:    make(map[string]bool),
         Logger:      &email.QuietLogger{},
@@ -151,6 +262,29 @@ func (s *Server) ListenAndServe(addr string) error {
         return err
     }
 
+    return s.Serve(listener)
+}
+
+// ListenAndServeUnix starts listening for commands on a Unix domain socket at path,
+// which is how LMTP servers are usually reached. The socket file is removed on Close
+func (s *Server) ListenAndServeUnix(path string) error {
+
+    listener, err := net.Listen("unix", path)
+    if err != nil {
+        s.Logger.Printf("Cannot listen on %v (%v)", path, err)
+        return err
+    }
+
+    return s.Serve(listener)
+}
+
+// Serve handles the connections coming in on listener until it's closed
+func (s *Server) Serve(listener net.Listener) error {
+
+    if len(s.ProxyProtocol) > 0 {
+        listener = proxyproto.NewListener(listener, s.ProxyProtocol)
+    }
+
     var clientID int64
     clientID = 1
 
@@ -196,13 +330,126 @@ func (s *Server) Address() string {
     return ""
 }
 
+// handleMessage runs the message through the middleware & Handler. A panic in there
+// tempfails the message, rather than taking the whole server down
 func (s *Server) handleMessage(m *email.Message) error {
-    return s.Handler(m)
+    return Chain(s.Handler, append([]Middleware{Recover(s.Logger)}, s.middleware...)...)(m)
+}
+
+// RecipientErrors is returned by the Handler of an LMTP server to turn down some of the
+// recipients of a message, keyed by their envelope address. Recipients that aren't listed
+// were delivered. On an SMTP server, where there is a single reply for the whole message,
+// any RecipientErrors fails the message
+type RecipientErrors map[string]error
+
+func (e RecipientErrors) Error() string {
+    var errs []string
+    for recipient, err := range e {
+        errs = append(errs, fmt.Sprintf("%v: %v", recipient, err))
+    }
+    return strings.Join(errs, "; ")
+}
+
+// deliver runs a received message through the checks & the handler, and replies with the outcome
+func (s *Server) deliver(conn *Conn, data []byte) {
+    // XFORWARD attributes only apply to a single message
+    defer func() { conn.Forwarded = nil }()
+
+    message, err := s.parseMessage(data)
+    if err == nil {
+        err = conn.EndTX()
+    } else {
+        // the end of the data ends the transaction, whatever came in it
+        conn.abortTX()
+    }
+    if err != nil {
+        s.replyAll(conn, NewReply(554, "5.6.0", fmt.Sprintf("Error: I blame you. %v", err)))
+        return
+    }
+    message.Envelope = conn.Envelope()
+
+    if serr := s.authenticate(conn, message); serr != nil {
+        s.replyAll(conn, serr.Reply())
+        return
+    }
+    s.trace(conn, message)
+
+    message, serr := s.milterMessage(conn, message)
+    if serr != nil {
+        s.replyAll(conn, serr.Reply())
+        return
+    }
+    if conn.discard {
+        // a filter dropped the message, the client is told it went through
+        s.Logger.Printf("Discarded message %v from %v", message.ID(), conn.RemoteAddr())
+        s.replyAll(conn, s.handlerReply(message, nil))
+        return
+    }
+
+    err = s.handleMessage(message)
+
+    // LMTP has a reply for each recipient, see https://tools.ietf.org/html/rfc2033#section-4.2
+    if errs, ok := err.(RecipientErrors); ok && s.LMTP {
+        for _, to := range conn.ToAddr {
+            conn.WriteReply(s.handlerReply(message, errs[to.Address]))
+        }
+        return
+    }
+    s.replyAll(conn, s.handlerReply(message, err))
+}
+
+// replyAll sends the outcome of the message, once per recipient in LMTP mode
+func (s *Server) replyAll(conn *Conn, reply *Reply) {
+    // without recipients there's still a reply owed, or the client loses track
+    if !s.LMTP || len(conn.ToAddr) == 0 {
+        conn.WriteReply(reply)
+        return
+    }
+    for range conn.ToAddr {
+        conn.WriteReply(reply)
+    }
+}
+
+// handlerReply converts the result of the Handler into a reply
+func (s *Server) handlerReply(m *email.Message, err error) *Reply {
+    if err == nil {
+        return NewReply(250, "2.0.0", fmt.Sprintf("OK : queued as %v", m.ID()))
+    }
+    return s.handlerError(m, err).Reply()
+}
+
+func (s *Server) parseMessage(data []byte) (*email.Message, error) {
+    if s.Lenient {
+        return email.NewLenientMessage(data)
+    }
+    return email.NewMessage(data)
 }
 
 func (s *Server) HandleSMTP(conn *Conn) error {
     defer conn.Close()
-    conn.WriteSMTP(220, fmt.Sprintf("%v %v", s.Name, time.Now().Format(time.RFC1123Z)))
+    if s.OnDisconnect != nil {
+        defer s.OnDisconnect(conn)
+    }
+    defer s.milterClose(conn)
+
+    if serr := s.checkConnect(conn); serr != nil {
+        s.Logger.Printf("Refused connection from %v: %v", conn.RemoteAddr(), serr)
+        conn.WriteReply(serr.Reply())
+        return nil
+    }
+
+    if s.earlyTalker(conn) {
+        s.Logger.Printf("Client %v talked before the greeting", conn.RemoteAddr())
+        conn.WriteSMTP(554, "SMTP synchronization error")
+        return nil
+    }
+
+    if serr := s.milterConnect(conn); serr != nil {
+        conn.WriteReply(serr.Reply())
+        return nil
+    }
+
+    conn.WriteSMTP(220, s.banner(conn))
 
 ReadLoop:
     for i := 0; i < s.MaxCommands; i++ {
@@ -224,12 +471,26 @@ ReadLoop:
             return err
         }
 
+        s.command(conn, verb, args)
+
+        // LMTP replaces HELO & EHLO with LHLO, which otherwise works like EHLO
+        // see: https://tools.ietf.org/html/rfc2033#section-4.1
+        if s.LMTP {
+            switch verb {
+            case "LHLO":
+                verb = "EHLO"
+            case "HELO", "EHLO":
+                conn.WriteReply(NewReply(500, "5.5.1", "Use LHLO to greet an LMTP server"))
+                continue
+            }
+        }
+
         // Always check for disabled features first
         if s.Disabled[verb] {
             if verb == "EHLO" {
                 conn.WriteSMTP(550, "Not implemented")
             } else {
-                conn.WriteSMTP(502, "Command not implemented")
+                conn.WriteReply(NewReply(502, "5.5.1", "Command not implemented"))
             }
             continue
         }
@@ -237,13 +498,13 @@ ReadLoop:
         // Auth overrides
         if s.Auth != nil && conn.User == nil {
             switch verb {
-            case "AUTH", "EHLO", "HELO", "NOOP", "RSET", "QUIT", "STARTTLS":
+            case "AUTH", "EHLO", "HELO", "NOOP", "RSET", "QUIT", "STARTTLS", "XCLIENT", "XFORWARD":
                 // these are okay to call without authentication on an Auth-enabled server
             case "*":
-                conn.WriteSMTP(501, "Cancelled")
+                conn.WriteReply(NewReply(501, "5.0.0", "Cancelled"))
                 continue
             default:
-                conn.WriteSMTP(530, "Authentication required")
+                conn.WriteReply(NewReply(530, "5.7.0", "Authentication required"))
                 continue
             }
         }
@@ -260,69 +521,184 @@ ReadLoop:
         switch verb {
         // https://tools.ietf.org/html/rfc2821#section-4.1.1.1
         case "HELO":
+            conn.Helo = args
+            conn.ESMTP = false
+            conn.enhancedCodes = false
+            if serr := s.checkHelo(conn); serr != nil {
+                conn.Helo = ""
+                conn.HeloCheck = ""
+                conn.WriteReply(serr.Reply())
+                break
+            }
             conn.WriteSMTP(250, fmt.Sprintf("%v Hello", s.ServerName))
         case "EHLO":
             // see: https://tools.ietf.org/html/rfc2821#section-4.1.4
             conn.Reset()
+            conn.Helo = args
+            conn.ESMTP = true
+
+            // the EHLO reply itself never carries an enhanced code
+            conn.enhancedCodes = false
+
+            if serr := s.checkHelo(conn); serr != nil {
+                conn.Helo = ""
+                conn.HeloCheck = ""
+                conn.ESMTP = false
+                conn.WriteReply(serr.Reply())
+                break
+            }
 
-            conn.WriteEHLO(fmt.Sprintf("%v %v", s.ServerName, s.Greeting(conn)))
-            conn.WriteEHLO(fmt.Sprintf("SIZE %v", s.MaxSize))
+            reply := NewReply(250, "", fmt.Sprintf("%v %v", s.ServerName, s.Greeting(conn)))
+            reply.Lines = append(reply.Lines, fmt.Sprintf("SIZE %v", s.MaxSize))
             if !conn.IsTLS && s.TLSConfig != nil {
-                conn.WriteEHLO("STARTTLS")
+                reply.Lines = append(reply.Lines, "STARTTLS")
             }
             if conn.User == nil && s.Auth != nil {
-                conn.WriteEHLO(fmt.Sprintf("AUTH %v", s.Auth.EHLO()))
+                reply.Lines = append(reply.Lines, fmt.Sprintf("AUTH %v", s.Auth.EHLO()))
+            }
+            if !s.Disabled["PIPELINING"] {
+                reply.Lines = append(reply.Lines, "PIPELINING")
+            }
+            if !s.Disabled["ENHANCEDSTATUSCODES"] {
+                reply.Lines = append(reply.Lines, "ENHANCEDSTATUSCODES")
+            }
+            if !s.Disabled["8BITMIME"] {
+                reply.Lines = append(reply.Lines, "8BITMIME")
+            }
+            if !s.Disabled["SMTPUTF8"] {
+                reply.Lines = append(reply.Lines, "SMTPUTF8")
+            }
+            if !s.Disabled["DSN"] {
+                reply.Lines = append(reply.Lines, "DSN")
+            }
+            if !s.Disabled["BDAT"] {
+                reply.Lines = append(reply.Lines, "CHUNKING")
+                if s.BinaryMIME {
+                    reply.Lines = append(reply.Lines, "BINARYMIME")
+                }
+            }
+            if s.XClient.Contains(conn.peerIP()) {
+                reply.Lines = append(reply.Lines, "XCLIENT "+strings.Join(xclientAttributes, " "))
+            }
+            if s.XForward.Contains(conn.peerIP()) {
+                reply.Lines = append(reply.Lines, "XFORWARD "+strings.Join(xforwardAttributes, " "))
             }
             for verb, extension := range s.Extensions {
-                conn.WriteEHLO(fmt.Sprintf("%v %v", verb, extension.EHLO()))
+                reply.Lines = append(reply.Lines, fmt.Sprintf("%v %v", verb, extension.EHLO()))
             }
-            conn.WriteSMTP(250, "HELP")
+            reply.Lines = append(reply.Lines, "HELP")
+
+            conn.WriteReply(reply)
+            conn.Flush()
+
+            conn.enhancedCodes = !s.Disabled["ENHANCEDSTATUSCODES"]
         // The MAIL command starts off a new mail transaction
         // see: https://tools.ietf.org/html/rfc2821#section-4.1.1.2
         // This doesn't implement the RFC4594 addition of an AUTH param to the MAIL command
         // see: http://tools.ietf.org/html/rfc4954#section-3 for details
         case "MAIL":
-            if from, err := s.GetAddressArg("FROM", args); err == nil {
+            address, params := splitParams(args)
+            if from, err := s.GetAddressArg("FROM", address); err == nil {
                 if conn.User == nil || conn.User.IsUser(from.Address) {
-                    if err := conn.StartTX(from); err == nil {
-                        conn.WriteSMTP(250, "Accepted")
+                    if err := conn.StartTX(from); err != nil {
+                        conn.WriteReply(NewReply(501, "5.5.1", err.Error()))
+                    } else if serr := s.mailParams(conn, params); serr != nil {
+                        conn.abortTX()
+                        conn.WriteReply(serr.Reply())
+                    } else if serr := s.checkSPF(conn); serr != nil {
+                        conn.abortTX()
+                        conn.WriteReply(serr.Reply())
+                    } else if serr := s.checkDNSBLDomains(conn); serr != nil {
+                        conn.abortTX()
+                        conn.WriteReply(serr.Reply())
+                    } else if serr := s.milterMail(conn, params); serr != nil {
+                        conn.abortTX()
+                        conn.WriteReply(serr.Reply())
                     } else {
-                        conn.WriteSMTP(501, err.Error())
+                        conn.WriteReply(NewReply(250, "2.1.0", "Accepted"))
                     }
                 } else {
-                    conn.WriteSMTP(501, fmt.Sprintf("Cannot send mail as %v", from))
+                    conn.WriteReply(NewReply(501, "5.7.1", fmt.Sprintf("Cannot send mail as %v", from)))
                 }
             } else {
-                conn.WriteSMTP(501, err.Error())
+                conn.WriteReply(NewReply(501, "5.1.7", err.Error()))
             }
         // https://tools.ietf.org/html/rfc2821#section-4.1.1.3
         case "RCPT":
-            if to, err := s.GetAddressArg("TO", args); err == nil {
-                conn.ToAddr = append(conn.ToAddr, to)
-                conn.WriteSMTP(250, "Accepted")
+            address, params := splitParams(args)
+            if to, err := s.GetAddressArg("TO", address); err == nil {
+                if serr := normalizeAddress(to, conn.SMTPUTF8); serr != nil {
+                    conn.WriteReply(serr.Reply())
+                } else if recipient, serr := s.rcptParams(to, params); serr != nil {
+                    conn.WriteReply(serr.Reply())
+                } else if serr := s.checkGreylist(conn, to); serr != nil {
+                    conn.WriteReply(serr.Reply())
+                } else if serr := s.milterRcpt(conn, to, params); serr != nil {
+                    conn.WriteReply(serr.Reply())
+                } else {
+                    conn.ToAddr = append(conn.ToAddr, to)
+                    conn.Recipients = append(conn.Recipients, recipient)
+                    conn.WriteReply(NewReply(250, "2.1.5", "Accepted"))
+                }
             } else {
-                conn.WriteSMTP(501, err.Error())
+                conn.WriteReply(NewReply(501, "5.1.3", err.Error()))
             }
         // https://tools.ietf.org/html/rfc2821#section-4.1.1.4
         case "DATA":
+            // see: https://tools.ietf.org/html/rfc5321#section-3.3 & https://tools.ietf.org/html/rfc2033#section-4.2
+            if conn.transaction == 0 || len(conn.ToAddr) == 0 {
+                conn.WriteReply(NewReply(503, "5.5.1", "Need MAIL and RCPT before DATA"))
+                break
+            }
+            if conn.Body == "BINARYMIME" || conn.chunks.Len() > 0 {
+                conn.WriteReply(NewReply(503, "5.5.1", "Use BDAT for the rest of this message"))
+                break
+            }
+
             conn.WriteSMTP(354, "Enter message, ending with \".\" on a line by itself")
 
             if data, err := conn.ReadData(); err == nil {
+                s.deliver(conn, []byte(data))
+            } else {
+                s.Logger.Println("DATA read error: %v", err)
+            }
+        // BDAT sends the message in chunks of a given size, without dot-stuffing
+        // see: https://tools.ietf.org/html/rfc3030
+        case "BDAT":
+            size, last, err := parseBDAT(args)
+            if err != nil {
+                // without a size there's no telling where the next command starts
+                conn.WriteReply(NewReply(501, "5.5.4", err.Error()))
+                break ReadLoop
+            }
 
-                if message, err := email.NewMessage([]byte(data)); err == nil && (conn.EndTX() == nil) {
-
-                    if err := s.handleMessage(message); err == nil {
-                        conn.WriteSMTP(250, fmt.Sprintf("OK : queued as %v", message.ID()))
-                    } else {
-                        conn.WriteSMTP(554, fmt.Sprintf("Error: I blame me. %v", err))
-                    }
+            if conn.transaction == 0 || len(conn.ToAddr) == 0 {
+                if err := conn.ReadChunk(ioutil.Discard, size); err != nil {
+                    break ReadLoop
+                }
+                conn.WriteReply(NewReply(503, "5.5.1", "Need MAIL and RCPT before BDAT"))
+                break
+            }
 
-                } else {
-                    conn.WriteSMTP(554, fmt.Sprintf("Error: I blame you. %v", err))
+            if s.MaxSize > 0 && int64(conn.chunks.Len())+size > int64(s.MaxSize) {
+                if err := conn.ReadChunk(ioutil.Discard, size); err != nil {
+                    break ReadLoop
                 }
+                conn.abortTX()
+                conn.WriteReply(NewReply(552, "5.3.4", "Message size exceeds fixed maximum message size"))
+                break
+            }
 
+            if err := conn.ReadChunk(&conn.chunks, size); err != nil {
+                s.Logger.Printf("BDAT read error: %v", err)
+                break ReadLoop
+            }
+
+            if last {
+                // the buffer gets reused by the next transaction, the message keeps its own copy
+                s.deliver(conn, append([]byte(nil), conn.chunks.Bytes()...))
             } else {
-                s.Logger.Println("DATA read error: %v", err)
+                conn.WriteReply(NewReply(250, "2.0.0", fmt.Sprintf("%v octets received", size)))
             }
         // Reset the connection
         // see: https://tools.ietf.org/html/rfc2821#section-4.1.1.5
@@ -335,11 +711,11 @@ ReadLoop:
         // the full `params` value will be the address to verify, respond with `conn.WriteOK()`
         // see: https://tools.ietf.org/html/rfc2821#section-4.1.1.6
         case "VRFY":
-            conn.WriteSMTP(252, "But it was worth a shot, right?")
+            conn.WriteReply(NewReply(252, "2.5.0", "But it was worth a shot, right?"))
 
         // see: https://tools.ietf.org/html/rfc2821#section-4.1.1.7
         case "EXPN":
-            conn.WriteSMTP(252, "Maybe, maybe not")
+            conn.WriteReply(NewReply(252, "2.5.0", "Maybe, maybe not"))
 
         // see: https://tools.ietf.org/html/rfc2821#section-4.1.1.8
         case "HELP":
@@ -347,7 +723,7 @@ ReadLoop:
             if s.Help != "" {
                 msg = s.Help
             }
-            conn.WriteSMTP(214, msg)
+            conn.WriteReply(NewReply(214, "2.0.0", msg))
 
         // NOOP doesn't do anything. Big surprise
         // see: https://tools.ietf.org/html/rfc2821#section-4.1.1.9
@@ -357,15 +733,17 @@ ReadLoop:
         // Say goodbye and close the connection
         // see: https://tools.ietf.org/html/rfc2821#section-4.1.1.10
         case "QUIT":
-            conn.WriteSMTP(221, "Bye")
+            conn.WriteReply(NewReply(221, "2.0.0", "Bye"))
+            conn.Flush()
             break ReadLoop
 
         // https://tools.ietf.org/html/rfc2487
         case "STARTTLS":
-            conn.WriteSMTP(220, "Ready to start TLS")
+            conn.WriteReply(NewReply(220, "2.0.0", "Ready to start TLS"))
+            conn.Flush()
 
             // upgrade to TLS
-            tlsConn := tls.Server(conn, s.TLSConfig)
+            tlsConn := tls.Server(conn.Conn, s.TLSConfig)
             if tlsConn == nil {
                 s.Logger.Printf("Couldn't upgrade to TLS")
                 break ReadLoop
@@ -373,15 +751,7 @@ ReadLoop:
 
             tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
             if err := tlsConn.Handshake(); err == nil {
-                conn = &Conn{
-                    Conn:         tlsConn,
-                    IsTLS:        true,
-                    User:         conn.User,
-                    Errors:       conn.Errors,
-                    MaxSize:      conn.MaxSize,
-                    WriteTimeout: conn.WriteTimeout,
-                    ReadTimeout:  conn.ReadTimeout,
-                }
+                conn.upgradeTLS(tlsConn)
             } else {
                 s.Logger.Printf("Could not TLS handshake:%v", err)
                 break ReadLoop
@@ -392,25 +762,45 @@ ReadLoop:
         // see: http://tools.ietf.org/html/rfc4954
         case "AUTH":
             if conn.User != nil {
-                conn.WriteSMTP(503, "You are already authenticated")
+                conn.WriteReply(NewReply(503, "5.5.1", "You are already authenticated"))
             } else if s.Auth != nil {
                 if err := s.Auth.Handle(conn, args); err != nil {
                     if serr, ok := err.(*SMTPError); ok {
-                        conn.WriteSMTP(serr.Code(), serr.Error())
+                        conn.WriteReply(serr.Reply())
                     } else {
-                        conn.WriteSMTP(500, "Authentication failed")
+                        conn.WriteReply(NewReply(535, "5.7.8", "Authentication failed"))
                     }
                 } else {
-                    conn.WriteSMTP(235, "Authentication succeeded")
+                    conn.WriteReply(NewReply(235, "2.7.0", "Authentication succeeded"))
                 }
             } else {
-                conn.WriteSMTP(502, "Command not implemented")
+                conn.WriteReply(NewReply(502, "5.5.1", "Command not implemented"))
+            }
+        // XCLIENT starts the session over as the client a trusted proxy is serving
+        // see: http://www.postfix.org/XCLIENT_README.html
+        case "XCLIENT":
+            if serr := s.xclient(conn, args); serr != nil {
+                conn.WriteReply(serr.Reply())
+                break
+            }
+            if serr := s.xclientConnect(conn); serr != nil {
+                s.Logger.Printf("Refused connection from %v: %v", conn.RemoteAddr(), serr)
+                conn.WriteReply(serr.Reply())
+                break ReadLoop
+            }
+            conn.WriteSMTP(220, s.banner(conn))
+        // see: http://www.postfix.org/XFORWARD_README.html
+        case "XFORWARD":
+            if serr := s.xforward(conn, args); serr != nil {
+                conn.WriteReply(serr.Reply())
+            } else {
+                conn.WriteOK()
             }
         default:
-            conn.WriteSMTP(500, "Syntax error, command unrecognised")
+            conn.WriteReply(NewReply(500, "5.5.2", "Syntax error, command unrecognised"))
             conn.Errors = append(conn.Errors, fmt.Errorf("bad input: %v %v", verb, args))
             if len(conn.Errors) > 3 {
-                conn.WriteSMTP(500, "Too many unrecognized commands")
+                conn.WriteReply(NewReply(500, "5.5.2", "Too many unrecognized commands"))
                 break ReadLoop
             }
 
@@ -421,9 +811,29 @@ ReadLoop:
     return nil
 }
 
+// earlyTalker waits out the GreetingDelay, reporting whether the client sent anything
+// in the meantime, see https://tools.ietf.org/html/rfc5321#section-4.3.1
+func (s *Server) earlyTalker(conn *Conn) bool {
+    if s.GreetingDelay <= 0 {
+        return false
+    }
+
+    conn.SetReadDeadline(time.Now().Add(s.GreetingDelay))
+    defer conn.SetReadDeadline(time.Time{})
+
+    // a timeout means the client waited its turn
+    _, err := conn.tp().R.Peek(1)
+    return err == nil
+}
+
 func (s *Server) GetAddressArg(argName string, args string) (*mail.Address, error) {
     argSplit := strings.SplitN(args, ":", 2)
     if len(argSplit) == 2 && strings.ToUpper(argSplit[0]) == argName {
+        // the null reverse-path, used for bounces & other notifications
+        // see: https://tools.ietf.org/html/rfc5321#section-4.5.5
+        if argName == "FROM" && strings.TrimSpace(argSplit[1]) == "<>" {
+            return &mail.Address{}, nil
+        }
         return mail.ParseAddress(argSplit[1])
     }
 
@@ -1,11 +1,19 @@
 package smtpd_test
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"strings"
 	"testing"
 
 	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/dkim"
 	"github.com/hownowstephen/email/smtpd"
 )
 
@@ -66,3 +74,283 @@ This is the email body`)
 	}
 
 }
+
+func TestSMTPLenient(t *testing.T) {
+
+	send := func(lenient bool) error {
+		server := smtpd.NewServer(func(*email.Message) error { return nil })
+		server.Lenient = lenient
+		go server.ListenAndServe("localhost:0")
+		defer server.Close()
+
+		WaitUntilAlive(server)
+
+		c, err := smtp.Dial(server.Address())
+		if err != nil {
+			t.Fatalf("Should be able to dial localhost: %v", err)
+		}
+		defer c.Close()
+
+		c.Mail("sender@example.org")
+		c.Rcpt("recipient@example.net")
+		wc, err := c.Data()
+		if err != nil {
+			t.Fatalf("Error creating the data body: %v", err)
+		}
+		// no From, To or Content-Type
+		fmt.Fprintf(wc, "Subject: hello\r\n\r\nhi\r\n")
+		return wc.Close()
+	}
+
+	if err := send(false); err == nil {
+		t.Errorf("A message without a From header should be refused by default")
+	}
+	if err := send(true); err != nil {
+		t.Errorf("A lenient server should accept the message, got: %v", err)
+	}
+}
+
+func TestSMTPStartTLSReset(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.TLSConfig = TestingTLSConfig()
+	go server.ListenAndServe("127.0.0.1:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	raw, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer raw.Close()
+
+	conn := textproto.NewConn(raw)
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	conn.PrintfLine("MAIL FROM:<sender@example.org>")
+	conn.PrintfLine("RCPT TO:<recipient@example.net>")
+	conn.PrintfLine("STARTTLS")
+	expectReplies(t, conn, 250, 250, 250, 220)
+
+	tlsConn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	conn = textproto.NewConn(tlsConn)
+
+	// the transaction started in the clear is gone, even without a new EHLO to reset it
+	conn.PrintfLine("DATA")
+	if _, _, err := conn.ReadResponse(354); err == nil || !strings.HasPrefix(err.Error(), "503") {
+		t.Errorf("DATA should be refused after STARTTLS, got: %v", err)
+	}
+}
+
+func TestSMTPRawMessage(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	raw := "To: recipient@example.net\r\nFrom: sender@example.org\r\nContent-Type: text/plain\r\n\r\n.leading dot\r\n\r\nand a blank line\r\n"
+
+	if err := smtp.SendMail(server.Address(), nil, "sender@example.org", []string{"recipient@example.net"}, []byte(raw)); err != nil {
+		t.Fatalf("Should be able to send mail: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected exactly one message, got: %v", len(recorder.Messages))
+	}
+
+	// the only change should be the trace header on top
+	if got := string(recorder.Messages[0].Raw); !strings.HasPrefix(got, "Received: ") || !strings.HasSuffix(got, "\r\n"+raw) {
+		t.Errorf("Message wasn't preserved byte for byte, want: %q, got: %q", raw, got)
+	}
+}
+
+func TestSMTPTraceHeaders(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.ServerName = "mx.example.org"
+	server.ReturnPath = true
+	server.Resolver = &FakeResolver{PTR: map[string][]string{"127.0.0.1": {"client.example.net."}}}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	raw := "To: recipient@example.net\r\nFrom: sender@example.org\r\nContent-Type: text/plain\r\n\r\nbody\r\n"
+
+	if err := smtp.SendMail(server.Address(), nil, "sender@example.org", []string{"recipient@example.net"}, []byte(raw)); err != nil {
+		t.Fatalf("Should be able to send mail: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected exactly one message, got: %v", len(recorder.Messages))
+	}
+
+	m := recorder.Messages[0]
+
+	if got := m.Headers["Return-Path"]; got != "<sender@example.org>" {
+		t.Errorf("Wrong Return-Path, got: %v", got)
+	}
+
+	received := m.Headers["Received"]
+	for _, want := range []string{"from localhost (client.example.net [127.0.0.1])", "by mx.example.org with ESMTP id ", "for <recipient@example.net>;"} {
+		if !strings.Contains(received, want) {
+			t.Errorf("Received header should contain %q, got: %v", want, received)
+		}
+	}
+
+	if !strings.HasPrefix(string(m.Raw), "Return-Path: <sender@example.org>\r\nReceived: from") {
+		t.Errorf("Trace headers should be prepended, got: %q", m.Raw)
+	}
+
+	// the hook can suppress the header entirely
+	server.Received = func(*smtpd.Conn) string { return "" }
+	server.ReturnPath = false
+
+	if err := smtp.SendMail(server.Address(), nil, "sender@example.org", []string{"recipient@example.net"}, []byte(raw)); err != nil {
+		t.Fatalf("Should be able to send mail: %v", err)
+	}
+
+	if got := string(recorder.Messages[1].Raw); got != raw {
+		t.Errorf("Received header should have been suppressed, got: %q", got)
+	}
+}
+
+func TestSMTPVerifyDKIM(t *testing.T) {
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.ServerName = "mx.example.org"
+	server.VerifyDKIM = true
+	server.Resolver = &FakeResolver{TXT: map[string][]string{
+		"test._domainkey.example.net": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))},
+	}}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	raw := "To: recipient@example.org\r\nFrom: sender@example.net\r\nSubject: signed\r\nContent-Type: text/plain\r\n\r\nbody\r\n"
+
+	signer := &dkim.Signer{Domain: "example.net", Selector: "test", Key: key}
+	signature, err := signer.Sign(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Couldn't sign message: %v", err)
+	}
+
+	for _, message := range []string{raw, "DKIM-Signature: " + signature + "\r\n" + raw} {
+		if err := smtp.SendMail(server.Address(), nil, "sender@example.net", []string{"recipient@example.org"}, []byte(message)); err != nil {
+			t.Fatalf("Should be able to send mail: %v", err)
+		}
+	}
+
+	if len(recorder.Messages) != 2 {
+		t.Fatalf("Expected two messages, got: %v", len(recorder.Messages))
+	}
+
+	for i, want := range []string{"none", "pass"} {
+		m := recorder.Messages[i]
+		if len(m.AuthResults) != 1 || m.AuthResults[0].Result != want {
+			t.Errorf("Expected dkim=%v, got: %v", want, m.AuthResults)
+		}
+		if header := strings.Join(strings.Fields(m.Headers["Authentication-Results"]), " "); !strings.HasPrefix(header, "mx.example.org; dkim="+want) {
+			t.Errorf("Wrong Authentication-Results header: %v", m.Headers["Authentication-Results"])
+		}
+	}
+}
+
+func TestSMTPForgedAuthResults(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.ServerName = "mx.example.org"
+	server.VerifyDKIM = true
+	server.Resolver = &FakeResolver{}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	raw := "Authentication-Results: MX.example.org 1 (forged);\r\n\tdkim=pass header.d=example.net\r\n" +
+		"Authentication-Results: relay.example.com; spf=pass smtp.mailfrom=example.net\r\n" +
+		"To: recipient@example.org\r\nFrom: sender@example.net\r\nSubject: forged\r\nContent-Type: text/plain\r\n\r\nbody\r\n"
+
+	if err := smtp.SendMail(server.Address(), nil, "sender@example.net", []string{"recipient@example.org"}, []byte(raw)); err != nil {
+		t.Fatalf("Should be able to send mail: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+
+	m := string(recorder.Messages[0].Raw)
+	if strings.Contains(m, "dkim=pass") {
+		t.Errorf("The forged results should be removed, got: %q", m)
+	}
+	if !strings.Contains(m, "relay.example.com; spf=pass") {
+		t.Errorf("Other servers' results should be kept, got: %q", m)
+	}
+	if n := strings.Count(m, "Authentication-Results: mx.example.org;"); n != 1 {
+		t.Errorf("Expected only our own results, got %v in: %q", n, m)
+	}
+}
+
+func TestSMTPVerifyARC(t *testing.T) {
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %v", err)
+	}
+
+	recorder := &MessageRecorder{}
+	sealer := &dkim.Sealer{Domain: "example.org", Selector: "arc", Key: key}
+
+	server := smtpd.NewServer(sealer.Wrap(recorder.Record))
+	server.ServerName = "mx.example.org"
+	server.VerifyARC = true
+	server.Resolver = &FakeResolver{TXT: map[string][]string{
+		"arc._domainkey.example.org": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))},
+	}}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	raw := "To: recipient@example.org\r\nFrom: sender@example.net\r\nSubject: forwarded\r\nContent-Type: text/plain\r\n\r\nbody\r\n"
+
+	if err := smtp.SendMail(server.Address(), nil, "sender@example.net", []string{"recipient@example.org"}, []byte(raw)); err != nil {
+		t.Fatalf("Should be able to send mail: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	first := recorder.Messages[0]
+
+	if len(first.AuthResults) != 1 || first.AuthResults[0].String() != "arc=none" {
+		t.Errorf("Expected arc=none, got: %v", first.AuthResults)
+	}
+
+	// relay the sealed message back through the server, which extends the chain
+	if err := smtp.SendMail(server.Address(), nil, "sender@example.net", []string{"recipient@example.org"}, first.Raw); err != nil {
+		t.Fatalf("Should be able to send mail: %v", err)
+	}
+
+	second := recorder.Messages[1]
+	if len(second.AuthResults) != 1 || second.AuthResults[0].Result != "pass" {
+		t.Errorf("Expected arc=pass, got: %v", second.AuthResults)
+	}
+	if !strings.HasPrefix(string(second.Raw), "ARC-Seal: i=2; ") {
+		t.Errorf("Relayed message should have a second ARC set, got: %v", string(second.Raw))
+	}
+}
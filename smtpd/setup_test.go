@@ -8,6 +8,7 @@ import (
     "crypto/x509/pkix"
     "math/big"
     "net"
+    "net/textproto"
     "sync"
     "testing"
     "time"
@@ -73,6 +74,16 @@ func WaitUntilAlive(s *smtpd.Server) {
     }
 }
 
+// expectReplies reads one reply per code, failing the test unless each has the expected code
+func expectReplies(t *testing.T, conn *textproto.Conn, codes ...int) {
+    t.Helper()
+    for _, code := range codes {
+        if _, _, err := conn.ReadResponse(code); err != nil {
+            t.Fatalf("Expected a %v reply: %v", code, err)
+        }
+    }
+}
+
 // TestLogger sends all log messages to the testing.T object, to be displayed as it sees fit
 type TestLogger struct {
     t *testing.T
@@ -89,3 +100,34 @@ func (t *TestLogger) Println(v ...interface{}) {
 func (t *TestLogger) Printf(format string, v ...interface{}) {
     t.t.Logf(format, v)
 }
+
+// FakeResolver answers DNS lookups from static maps, so that tests never touch the network
+type FakeResolver struct {
+    PTR map[string][]string
+    IP  map[string][]net.IP
+    MX  map[string][]*net.MX
+    TXT map[string][]string
+}
+
+func (r *FakeResolver) LookupAddr(addr string) ([]string, error) {
+    return r.PTR[addr], fakeErr(len(r.PTR[addr]), addr)
+}
+
+func (r *FakeResolver) LookupIP(host string) ([]net.IP, error) {
+    return r.IP[host], fakeErr(len(r.IP[host]), host)
+}
+
+func (r *FakeResolver) LookupMX(name string) ([]*net.MX, error) {
+    return r.MX[name], fakeErr(len(r.MX[name]), name)
+}
+
+func (r *FakeResolver) LookupTXT(name string) ([]string, error) {
+    return r.TXT[name], fakeErr(len(r.TXT[name]), name)
+}
+
+func fakeErr(found int, name string) error {
+    if found == 0 {
+        return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+    }
+    return nil
+}
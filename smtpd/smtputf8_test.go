@@ -0,0 +1,70 @@
+package smtpd_test
+
+import (
+	"net/smtp"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPUTF8(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	raw := "To: =?utf-8?q?=E7=94=A8=E6=88=B7?= <用户@例子.测试>\r\nFrom: josé@bücher.example\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nça marche\r\n"
+
+	// net/smtp asks for SMTPUTF8 & 8BITMIME whenever they're advertised
+	if err := smtp.SendMail(server.Address(), nil, "josé@xn--bcher-kva.example", []string{"用户@例子.测试", "user@XN--BCHER-KVA.example"}, []byte(raw)); err != nil {
+		t.Fatalf("Internationalized mail should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+
+	want := &email.Envelope{
+		From:     "josé@bücher.example",
+		To:       []string{"用户@例子.测试", "user@bücher.example"},
+		Body:     "8BITMIME",
+		SMTPUTF8: true,
+		Recipients: []*email.Recipient{
+			{Address: "用户@例子.测试"},
+			{Address: "user@bücher.example"},
+		},
+	}
+	if got := recorder.Messages[0].Envelope; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong envelope, want: %+v, got: %+v", want, got)
+	}
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	if _, msg, _ := conn.ReadResponse(250); !strings.Contains(msg, "\n8BITMIME\n") || !strings.Contains(msg, "\nSMTPUTF8\n") {
+		t.Errorf("8BITMIME & SMTPUTF8 should be advertised, got: %v", msg)
+	}
+
+	// without SMTPUTF8 only ASCII addresses are allowed, with IDNs as A-labels
+	conn.PrintfLine("MAIL FROM:<josé@example.net>")
+	if _, _, err := conn.ReadResponse(250); err == nil || !strings.HasPrefix(err.Error(), "553") {
+		t.Errorf("Non-ASCII address without SMTPUTF8 should be refused with a 553, got: %v", err)
+	}
+
+	conn.PrintfLine("MAIL FROM:<user@Example.NET> BODY=8BITMIME")
+	conn.PrintfLine("RCPT TO:<user@bücher.example>")
+	conn.PrintfLine("RCPT TO:<user@xn--bcher-kva.example>")
+	expectReplies(t, conn, 250, 553, 250)
+}
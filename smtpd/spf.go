@@ -0,0 +1,63 @@
+package smtpd
+
+import (
+	"fmt"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/spf"
+)
+
+// SPFPolicy configures the sender policy checks done at MAIL FROM time,
+// see https://tools.ietf.org/html/rfc7208
+type SPFPolicy struct {
+	// RejectFail refuses senders whose policy fails, instead of just recording the result
+	RejectFail bool
+
+	// TagSoftFail adds a Received-SPF header to messages whose sender soft-failed
+	TagSoftFail bool
+}
+
+// checkSPF evaluates the envelope sender's policy for the client, recording the result
+// on the connection and returning an error if the sender should be refused
+func (s *Server) checkSPF(c *Conn) *SMTPError {
+	if s.SPF == nil {
+		return nil
+	}
+
+	sender := ""
+	if c.FromAddr != nil {
+		sender = c.FromAddr.Address
+	}
+
+	// clients on a unix socket have no address to check
+	ip := c.RemoteIP()
+	if ip == nil {
+		c.AuthResults = append(c.AuthResults, spf.AuthResult(spf.None, fmt.Errorf("No client IP address"), c.Helo, sender))
+		return nil
+	}
+
+	checker := spf.NewChecker(s.Resolver)
+	checker.Hostname = s.ServerName
+
+	result, err := checker.Check(ip, c.Helo, sender)
+	c.AuthResults = append(c.AuthResults, spf.AuthResult(result, err, c.Helo, sender))
+
+	if result == spf.Fail && s.SPF.RejectFail {
+		return &SMTPError{550, "5.7.23", fmt.Errorf("SPF check failed: %v", err)}
+	}
+	return nil
+}
+
+// tagSPF adds the Received-SPF header for soft-failed senders, see https://tools.ietf.org/html/rfc7208#section-9.1
+func (s *Server) tagSPF(c *Conn, m *email.Message) {
+	if s.SPF == nil || !s.SPF.TagSoftFail {
+		return
+	}
+
+	for _, r := range c.AuthResults {
+		if r.Method == "spf" && r.Result == spf.SoftFail {
+			m.Prepend("Received-SPF", fmt.Sprintf("softfail (%v) client-ip=%v; envelope-from=%q; helo=%v; receiver=%v;",
+				r.Reason, c.RemoteIP(), r.Properties["smtp.mailfrom"], heloOrUnknown(c.Helo), s.ServerName))
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package smtpd_test
+
+import (
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPSPF(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.ServerName = "mx.example.org"
+	server.SPF = &smtpd.SPFPolicy{RejectFail: true, TagSoftFail: true}
+	server.Resolver = &FakeResolver{TXT: map[string][]string{
+		"pass.example":     {"v=spf1 ip4:127.0.0.0/8 -all"},
+		"fail.example":     {"v=spf1 -all"},
+		"softfail.example": {"v=spf1 ~all"},
+	}}
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	raw := "To: recipient@example.org\r\nFrom: sender@example.net\r\nContent-Type: text/plain\r\n\r\nbody\r\n"
+
+	for _, sender := range []string{"user@pass.example", "user@softfail.example"} {
+		if err := smtp.SendMail(server.Address(), nil, sender, []string{"recipient@example.org"}, []byte(raw)); err != nil {
+			t.Fatalf("Mail from %v should be accepted: %v", sender, err)
+		}
+	}
+
+	err := smtp.SendMail(server.Address(), nil, "user@fail.example", []string{"recipient@example.org"}, []byte(raw))
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("Mail from a failing sender should be refused with a 550, got: %v", err)
+	}
+
+	if len(recorder.Messages) != 2 {
+		t.Fatalf("Expected two messages, got: %v", len(recorder.Messages))
+	}
+
+	pass, softfail := recorder.Messages[0], recorder.Messages[1]
+
+	if len(pass.AuthResults) != 1 || pass.AuthResults[0].String() != "spf=pass smtp.mailfrom=user@pass.example" {
+		t.Errorf("Wrong SPF result, got: %v", pass.AuthResults)
+	}
+	if _, ok := pass.Headers["Received-Spf"]; ok {
+		t.Errorf("Only softfails should be tagged")
+	}
+
+	if len(softfail.AuthResults) != 1 || softfail.AuthResults[0].Result != "softfail" {
+		t.Errorf("Wrong SPF result, got: %v", softfail.AuthResults)
+	}
+	if !strings.HasPrefix(softfail.Headers["Received-Spf"], "softfail (") {
+		t.Errorf("Softfail should be tagged with Received-SPF, got: %v", softfail.Headers)
+	}
+}
+
+func TestSMTPSPFUnixSocket(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.SPF = &smtpd.SPFPolicy{RejectFail: true}
+	server.Resolver = &FakeResolver{TXT: map[string][]string{
+		"fail.example": {"v=spf1 -all"},
+	}}
+
+	socket := filepath.Join(t.TempDir(), "smtp.sock")
+	go server.ListenAndServeUnix(socket)
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	// there's no client address to check the policy against
+	conn.ReadResponse(220)
+	conn.PrintfLine("HELO client.example.net")
+	conn.PrintfLine("MAIL FROM:<user@fail.example>")
+	conn.PrintfLine("RCPT TO:<recipient@example.org>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 250, 250, 354)
+	conn.PrintfLine("To: recipient@example.org\r\nFrom: user@fail.example\r\nContent-Type: text/plain\r\n\r\nbody\r\n.")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("Message should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	if results := recorder.Messages[0].AuthResults; len(results) != 1 || results[0].Result != "none" {
+		t.Errorf("Expected spf=none, got: %v", results)
+	}
+}
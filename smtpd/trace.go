@@ -0,0 +1,151 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hownowstephen/email"
+)
+
+// ReceivedHeader builds the default value for the Received trace header,
+// see https://tools.ietf.org/html/rfc5321#section-4.4
+func (s *Server) ReceivedHeader(c *Conn) string {
+	var clauses []string
+
+	if addr := c.Forwarded["ADDR"]; addr != "" {
+		// the client of the proxy that passed the message on with XFORWARD
+		clauses = append(clauses, fmt.Sprintf("from %v (%v)", heloOrUnknown(c.Forwarded["HELO"]), forwardedInfo(c.Forwarded)))
+	} else {
+		clauses = append(clauses, fmt.Sprintf("from %v (%v)", heloOrUnknown(c.Helo), s.remoteInfo(c)))
+		if verdicts := heloVerdicts(c); verdicts != "" {
+			clauses = append(clauses, verdicts)
+		}
+	}
+
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		clauses = append(clauses, fmt.Sprintf("(using %v with cipher %v)",
+			tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)))
+	}
+
+	by := fmt.Sprintf("by %v with %v", s.ServerName, protocolName(c, s.LMTP))
+	if c.QueueID() != "" {
+		by += " id " + c.QueueID()
+	}
+	clauses = append(clauses, by)
+
+	if len(c.ToAddr) == 1 {
+		clauses = append(clauses, fmt.Sprintf("for <%v>", c.ToAddr[0].Address))
+	}
+
+	return strings.Join(clauses, "\n\t") + "; " + time.Now().Format(time.RFC1123Z)
+}
+
+// trace adds the Received & Return-Path headers to an accepted message
+func (s *Server) trace(c *Conn, m *email.Message) {
+	received := s.Received
+	if received == nil {
+		received = s.ReceivedHeader
+	}
+
+	if value := received(c); value != "" {
+		m.Prepend("Received", value)
+	}
+
+	if s.ReturnPath {
+		from := ""
+		if c.FromAddr != nil {
+			from = c.FromAddr.Address
+		}
+		m.Prepend("Return-Path", fmt.Sprintf("<%v>", from))
+	}
+}
+
+// remoteInfo describes the client by its reverse DNS name & address literal
+func (s *Server) remoteInfo(c *Conn) string {
+	ip := c.RemoteIP()
+	if ip == nil {
+		return c.RemoteAddr().String()
+	}
+
+	// the reverse DNS check has the final say, a name that didn't check out is unknown
+	if c.FCrDNS != "" && c.FCrDNS != FCrDNSPass && c.RemoteName == "" {
+		return "unknown " + addressLiteral(ip)
+	}
+	if c.RemoteName == "" && c.FCrDNS == "" && s.Resolver != nil {
+		if names, err := s.Resolver.LookupAddr(ip.String()); err == nil && len(names) > 0 {
+			c.RemoteName = strings.TrimSuffix(names[0], ".")
+		}
+	}
+
+	literal := addressLiteral(ip)
+	if c.RemoteName == "" {
+		return literal
+	}
+	return c.RemoteName + " " + literal
+}
+
+// heloVerdicts is a comment with the verdicts of the HeloPolicy checks, if there were any
+func heloVerdicts(c *Conn) string {
+	var verdicts []string
+	if c.HeloCheck != "" {
+		verdicts = append(verdicts, "helo="+c.HeloCheck)
+	}
+	if c.FCrDNS != "" {
+		verdicts = append(verdicts, "fcrdns="+c.FCrDNS)
+	}
+
+	if len(verdicts) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(verdicts, ", ") + ")"
+}
+
+// addressLiteral writes ip the way it goes in brackets, see https://tools.ietf.org/html/rfc5321#section-4.1.3
+func addressLiteral(ip net.IP) string {
+	if ip.To4() == nil {
+		return fmt.Sprintf("[IPv6:%v]", ip)
+	}
+	return fmt.Sprintf("[%v]", ip)
+}
+
+// forwardedInfo describes the client from its XFORWARD attributes, like remoteInfo
+func forwardedInfo(forwarded map[string]string) string {
+	literal := addressLiteral(net.ParseIP(forwarded["ADDR"]))
+
+	if name := forwarded["NAME"]; name != "" {
+		return name + " " + literal
+	}
+	return literal
+}
+
+// protocolName is the "with" keyword for the session, see https://tools.ietf.org/html/rfc3848
+func protocolName(c *Conn, lmtp bool) string {
+	protocol := "SMTP"
+	switch {
+	case lmtp:
+		protocol = "LMTP"
+	case c.ESMTP:
+		protocol = "ESMTP"
+	default:
+		return protocol
+	}
+
+	if c.IsTLS {
+		protocol += "S"
+	}
+	if c.User != nil {
+		protocol += "A"
+	}
+	return protocol
+}
+
+func heloOrUnknown(helo string) string {
+	if helo == "" {
+		return "unknown"
+	}
+	return helo
+}
@@ -0,0 +1,212 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Attributes of the XCLIENT & XFORWARD commands, see http://www.postfix.org/XCLIENT_README.html
+// and http://www.postfix.org/XFORWARD_README.html
+var (
+	xclientAttributes  = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN"}
+	xforwardAttributes = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE"}
+)
+
+// Values a proxy sends for attributes it doesn't know
+const (
+	xUnavailable     = "[UNAVAILABLE]"
+	xTempUnavailable = "[TEMPUNAVAIL]"
+)
+
+// XClientUser is the user a trusted proxy logged in with XCLIENT LOGIN. The proxy is
+// responsible for checking who the user may send as, so any sender is accepted
+type XClientUser struct {
+	Login string
+}
+
+func (u *XClientUser) IsUser(value string) bool {
+	return true
+}
+
+func (u *XClientUser) Password() string {
+	return ""
+}
+
+// parseXAttributes reads the NAME=value pairs of an XCLIENT or XFORWARD command
+func parseXAttributes(args string, allowed []string) (map[string]string, *SMTPError) {
+	attributes := make(map[string]string)
+
+	for _, field := range strings.Fields(args) {
+		kv := strings.SplitN(field, "=", 2)
+		name := strings.ToUpper(kv[0])
+		if len(kv) != 2 || !contains(allowed, name) {
+			return nil, &SMTPError{501, "5.5.4", fmt.Errorf("Bad attribute %v", field)}
+		}
+
+		value, err := decodeXtext(kv[1])
+		if err != nil {
+			return nil, &SMTPError{501, "5.5.4", fmt.Errorf("Bad %v value: %v", name, err)}
+		}
+
+		switch name {
+		case "ADDR":
+			if value != xUnavailable && value != xTempUnavailable {
+				value = strings.TrimPrefix(strings.ToUpper(value), "IPV6:")
+				if net.ParseIP(value) == nil {
+					return nil, &SMTPError{501, "5.5.4", fmt.Errorf("Bad ADDR value %v", kv[1])}
+				}
+			}
+		case "PORT":
+			if value != xUnavailable && value != xTempUnavailable {
+				if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+					return nil, &SMTPError{501, "5.5.4", fmt.Errorf("Bad PORT value %v", kv[1])}
+				}
+			}
+		case "PROTO":
+			value = strings.ToUpper(value)
+			if value != "SMTP" && value != "ESMTP" && value != xUnavailable {
+				return nil, &SMTPError{501, "5.5.4", fmt.Errorf("Bad PROTO value %v", kv[1])}
+			}
+		}
+
+		attributes[name] = value
+	}
+
+	if len(attributes) == 0 {
+		return nil, &SMTPError{501, "5.5.4", fmt.Errorf("Syntax: %v attribute=value...", allowed[0])}
+	}
+	return attributes, nil
+}
+
+// xclient replaces the client details of the session with those of the client a trusted
+// proxy is talking to, and starts the session over
+func (s *Server) xclient(conn *Conn, args string) *SMTPError {
+	// trust goes by the address the connection really comes from, not one passed on before
+	if !s.XClient.Contains(conn.peerIP()) {
+		return &SMTPError{550, "5.7.0", fmt.Errorf("Insufficient authorization")}
+	}
+	if conn.transaction != 0 {
+		return &SMTPError{503, "5.5.1", fmt.Errorf("Mail transaction in progress")}
+	}
+
+	attributes, serr := parseXAttributes(args, xclientAttributes)
+	if serr != nil {
+		return serr
+	}
+
+	conn.Reset()
+	conn.Helo = ""
+	conn.HeloCheck = ""
+	conn.ESMTP = false
+	conn.enhancedCodes = false
+
+	addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if addr == nil {
+		addr = &net.TCPAddr{}
+	}
+	addr = &net.TCPAddr{IP: addr.IP, Port: addr.Port}
+
+	for name, value := range attributes {
+		unavailable := value == xUnavailable || value == xTempUnavailable
+
+		switch name {
+		case "NAME":
+			conn.RemoteName = value
+			if unavailable {
+				conn.RemoteName = "unknown"
+			}
+		case "ADDR":
+			if !unavailable {
+				addr.IP = net.ParseIP(value)
+			}
+		case "PORT":
+			if !unavailable {
+				port, _ := strconv.Atoi(value)
+				addr.Port = port
+			}
+		case "PROTO":
+			conn.ESMTP = value == "ESMTP"
+		case "HELO":
+			if !unavailable {
+				conn.Helo = value
+			}
+		case "LOGIN":
+			conn.clientUser = nil
+			if !unavailable {
+				conn.clientUser = &XClientUser{Login: value}
+			}
+			conn.User = conn.clientUser
+		}
+	}
+
+	if addr.IP != nil {
+		conn.clientAddr = addr
+	}
+	if _, ok := attributes["ADDR"]; ok {
+		if _, named := attributes["NAME"]; !named {
+			// the old name belonged to the old address
+			conn.RemoteName = ""
+		}
+	}
+
+	// what was learned at connect time was about the proxy
+	s.milterClose(conn)
+	conn.milterFailed = false
+	conn.discard = false
+	conn.dnsblClient = nil
+	conn.DNSBL = nil
+	conn.FCrDNS = ""
+	conn.lock.Lock()
+	conn.values = nil
+	conn.lock.Unlock()
+
+	return nil
+}
+
+// xclientConnect runs the connect-time checks again once XCLIENT has replaced the client,
+// returning the error to close the connection with if the client is refused
+func (s *Server) xclientConnect(conn *Conn) *SMTPError {
+	if serr := s.checkConnect(conn); serr != nil {
+		return serr
+	}
+	return s.milterConnect(conn)
+}
+
+// xforward records the details of the client a trusted proxy received the next message
+// from, for the Received header & logging
+func (s *Server) xforward(conn *Conn, args string) *SMTPError {
+	if !s.XForward.Contains(conn.peerIP()) {
+		return &SMTPError{550, "5.7.0", fmt.Errorf("Insufficient authorization")}
+	}
+	if conn.transaction != 0 {
+		return &SMTPError{503, "5.5.1", fmt.Errorf("Mail transaction in progress")}
+	}
+
+	attributes, serr := parseXAttributes(args, xforwardAttributes)
+	if serr != nil {
+		return serr
+	}
+
+	if conn.Forwarded == nil {
+		conn.Forwarded = make(map[string]string)
+	}
+	for name, value := range attributes {
+		if value == xUnavailable || value == xTempUnavailable {
+			delete(conn.Forwarded, name)
+		} else {
+			conn.Forwarded[name] = value
+		}
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package smtpd_test
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/hownowstephen/email"
+	"github.com/hownowstephen/email/smtpd"
+)
+
+func TestSMTPXClient(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.ServerName = "mx.example.org"
+	server.Resolver = &FakeResolver{}
+	server.XClient, _ = email.ParseNetworks("127.0.0.1", "::1")
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO proxy.example.org")
+	if _, msg, _ := conn.ReadResponse(250); !strings.Contains(msg, "\nXCLIENT NAME ADDR PORT PROTO HELO LOGIN\n") {
+		t.Errorf("XCLIENT should be advertised to a trusted proxy, got: %v", msg)
+	}
+
+	conn.PrintfLine("XCLIENT ADDR=not-an-ip")
+	conn.PrintfLine("XCLIENT COLOR=blue")
+	conn.PrintfLine("XCLIENT NAME=client.example.net ADDR=192.0.2.7 PORT=4321 LOGIN=alice")
+	expectReplies(t, conn, 501, 501, 220)
+
+	// the session starts over as the original client, whose login survives EHLO
+	conn.PrintfLine("EHLO client.example.net")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	}
+
+	conn.PrintfLine("MAIL FROM:<alice@example.org>")
+	conn.PrintfLine("XCLIENT NAME=other.example.net")
+	conn.PrintfLine("RCPT TO:<user@example.net>")
+	conn.PrintfLine("DATA")
+	expectReplies(t, conn, 250, 503, 250, 354)
+	conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\nhi\r\n.")
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatalf("Message should be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected one message, got: %v", len(recorder.Messages))
+	}
+	received := recorder.Messages[0].Headers["Received"]
+	for _, want := range []string{"from client.example.net (client.example.net [192.0.2.7])", "with ESMTPA"} {
+		if !strings.Contains(received, want) {
+			t.Errorf("Received header should contain %q, got: %v", want, received)
+		}
+	}
+}
+
+func TestSMTPXClientDenied(t *testing.T) {
+
+	var connected []string
+	server := smtpd.NewServer(func(*email.Message) error { return nil })
+	server.XClient, _ = email.ParseNetworks("127.0.0.1", "::1")
+	server.Deny, _ = email.ParseNetworks("192.0.2.0/24")
+	server.OnConnect = func(conn *smtpd.Conn) error {
+		connected = append(connected, conn.RemoteIP().String())
+		return nil
+	}
+	go server.ListenAndServe("127.0.0.1:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("XCLIENT ADDR=198.51.100.1")
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("An allowed client should be greeted: %v", err)
+	}
+
+	// the proxy itself isn't denied, the client behind it is
+	conn.PrintfLine("XCLIENT ADDR=192.0.2.7")
+	if _, _, err := conn.ReadResponse(220); err == nil || err.Error() != `554 "Access denied"` {
+		t.Errorf("A denied client should be refused, got: %v", err)
+	}
+	if _, err := conn.ReadLine(); err == nil {
+		t.Errorf("The connection should be closed")
+	}
+
+	if strings.Join(connected, " ") != "127.0.0.1 198.51.100.1" {
+		t.Errorf("OnConnect should see each client, got: %v", connected)
+	}
+}
+
+func TestSMTPXClientUntrusted(t *testing.T) {
+
+	server := smtpd.NewServer(func(*email.Message) error { return nil })
+	server.XClient, _ = email.ParseNetworks("192.0.2.0/24")
+	server.XForward, _ = email.ParseNetworks("192.0.2.0/24")
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO client.example.net")
+	if _, msg, _ := conn.ReadResponse(250); strings.Contains(msg, "XCLIENT") || strings.Contains(msg, "XFORWARD") {
+		t.Errorf("XCLIENT & XFORWARD shouldn't be advertised to untrusted clients, got: %v", msg)
+	}
+
+	for _, command := range []string{"XCLIENT ADDR=192.0.2.7", "XFORWARD ADDR=192.0.2.7"} {
+		conn.PrintfLine("%s", command)
+		if _, _, err := conn.ReadResponse(250); err == nil || !strings.HasPrefix(err.Error(), "550") {
+			t.Errorf("%v should be refused with a 550, got: %v", command, err)
+		}
+	}
+}
+
+func TestSMTPXForward(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.Resolver = &FakeResolver{}
+	server.XForward, _ = email.ParseNetworks("127.0.0.1", "::1")
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.ReadResponse(220)
+	conn.PrintfLine("EHLO proxy.example.org")
+	if _, msg, _ := conn.ReadResponse(250); !strings.Contains(msg, "\nXFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE\n") {
+		t.Errorf("XFORWARD should be advertised to a trusted proxy, got: %v", msg)
+	}
+
+	send := func() {
+		conn.PrintfLine("MAIL FROM:<sender@example.org>")
+		conn.PrintfLine("RCPT TO:<user@example.net>")
+		conn.PrintfLine("DATA")
+		expectReplies(t, conn, 250, 250, 354)
+		conn.PrintfLine("From: sender@example.org\r\nTo: user@example.net\r\nContent-Type: text/plain\r\nSubject: hello\r\n\r\nhi\r\n.")
+		if _, _, err := conn.ReadResponse(250); err != nil {
+			t.Fatalf("Message should be accepted: %v", err)
+		}
+	}
+
+	conn.PrintfLine("XFORWARD NAME=client.example.net ADDR=IPV6:2001:db8::7 HELO=client.example.net")
+	conn.PrintfLine("XFORWARD IDENT=QQ123 SOURCE=REMOTE")
+	expectReplies(t, conn, 250, 250)
+	send()
+
+	// the attributes only last for one message
+	send()
+
+	if len(recorder.Messages) != 2 {
+		t.Fatalf("Expected two messages, got: %v", len(recorder.Messages))
+	}
+	if received := recorder.Messages[0].Headers["Received"]; !strings.Contains(received, "from client.example.net (client.example.net [IPv6:2001:db8::7])") {
+		t.Errorf("Received header should show the forwarded client, got: %v", received)
+	}
+	if received := recorder.Messages[1].Headers["Received"]; !strings.Contains(received, "from proxy.example.org") {
+		t.Errorf("Received header should show the proxy, got: %v", received)
+	}
+}
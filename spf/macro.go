@@ -0,0 +1,171 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expand performs macro expansion on a domain-spec or explanation string,
+// see https://tools.ietf.org/html/rfc7208#section-7
+func (e *evaluation) expand(spec, domain string, explanation bool) (string, error) {
+	var out strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+
+		if i+1 >= len(spec) {
+			return "", permError("Malformed macro in %q", spec)
+		}
+		i++
+
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", permError("Malformed macro in %q", spec)
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", permError("Malformed macro in %q", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		value, err := e.macro(macro, domain, explanation)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(value)
+	}
+
+	expanded := out.String()
+	if !explanation {
+		expanded = truncateDomain(expanded)
+	}
+	return expanded, nil
+}
+
+// macro expands the contents of a single %{...}
+func (e *evaluation) macro(macro, domain string, explanation bool) (string, error) {
+	letter := macro[0]
+	transformers := macro[1:]
+
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = e.sender
+	case 'l':
+		value = senderLocal(e.sender)
+	case 'o':
+		value = senderDomain(e.sender)
+	case 'd':
+		value = domain
+	case 'i':
+		value = dottedIP(e.ip)
+	case 'p':
+		value = "unknown"
+		if names := e.validatedNames(); len(names) > 0 {
+			value = names[0]
+		}
+	case 'v':
+		value = "in-addr"
+		if e.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = e.helo
+	case 'c', 'r', 't':
+		if !explanation {
+			return "", permError("Macro %%{%c} is only allowed in explanations", letter)
+		}
+		switch letter | 0x20 {
+		case 'c':
+			value = e.ip.String()
+		case 'r':
+			value = e.checker.Hostname
+		case 't':
+			value = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	default:
+		return "", permError("Unknown macro %%{%c}", letter)
+	}
+
+	// digits, then an optional "r", then the delimiters
+	digits := 0
+	for len(transformers) > 0 && transformers[0] >= '0' && transformers[0] <= '9' {
+		digits = digits*10 + int(transformers[0]-'0')
+		transformers = transformers[1:]
+	}
+	reverse := false
+	if len(transformers) > 0 && (transformers[0] == 'r' || transformers[0] == 'R') {
+		reverse = true
+		transformers = transformers[1:]
+	}
+	delimiters := "."
+	if transformers != "" {
+		if strings.Trim(transformers, ".-+,/_=") != "" {
+			return "", permError("Invalid delimiters in macro %%{%v}", macro)
+		}
+		delimiters = transformers
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	value = strings.Join(parts, ".")
+
+	if letter >= 'A' && letter <= 'Z' {
+		value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	}
+
+	return value, nil
+}
+
+// dottedIP formats the client address for %{i}, with IPv6 in dotted nibble format
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	var nibbles []string
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// truncateDomain drops labels from the left until the name fits in 253 characters
+func truncateDomain(domain string) string {
+	for len(domain) > 253 {
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return domain[len(domain)-253:]
+		}
+		domain = domain[i+1:]
+	}
+	return domain
+}
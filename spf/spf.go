@@ -0,0 +1,535 @@
+// Package spf evaluates Sender Policy Framework records as defined in RFC 7208.
+package spf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hownowstephen/email"
+)
+
+// Results of a check, see https://tools.ietf.org/html/rfc7208#section-2.6
+const (
+	None      = "none"
+	Neutral   = "neutral"
+	Pass      = "pass"
+	Fail      = "fail"
+	SoftFail  = "softfail"
+	TempError = "temperror"
+	PermError = "permerror"
+)
+
+var qualifiers = map[byte]string{
+	'+': Pass,
+	'-': Fail,
+	'~': SoftFail,
+	'?': Neutral,
+}
+
+// Checker evaluates SPF policies
+type Checker struct {
+	// Resolver performs all of the DNS lookups
+	Resolver email.Resolver
+
+	// Hostname of the receiving server, used in explanations (the %{r} macro)
+	Hostname string
+
+	// MaxLookups & MaxVoidLookups limit the DNS queries per check, see https://tools.ietf.org/html/rfc7208#section-4.6.4
+	MaxLookups     int
+	MaxVoidLookups int
+}
+
+// NewChecker creates a checker with the RFC limits
+func NewChecker(resolver email.Resolver) *Checker {
+	return &Checker{
+		Resolver:       resolver,
+		Hostname:       "unknown",
+		MaxLookups:     10,
+		MaxVoidLookups: 2,
+	}
+}
+
+// Check evaluates the policy for a client at ip, which said HELO helo and MAIL FROM sender.
+// An empty sender (a bounce) is checked as postmaster@helo. The error explains anything
+// but a Pass, using the domain's explanation for a Fail where it has one
+func (c *Checker) Check(ip net.IP, helo, sender string) (string, error) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	} else if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+
+	e := &evaluation{
+		checker: c,
+		ip:      ip,
+		helo:    helo,
+		sender:  sender,
+	}
+
+	return e.checkHost(senderDomain(sender), 0)
+}
+
+// AuthResult formats the outcome of a check for Authentication-Results
+func AuthResult(result string, err error, helo, sender string) *email.AuthResult {
+	r := &email.AuthResult{Method: "spf", Result: result, Properties: make(map[string]string)}
+	if err != nil && result != Pass {
+		r.Reason = err.Error()
+	}
+	if sender != "" {
+		r.Properties["smtp.mailfrom"] = sender
+	} else {
+		r.Properties["smtp.helo"] = helo
+	}
+	return r
+}
+
+// evaluation is the state of a single check, shared across include: and redirect=
+type evaluation struct {
+	checker *Checker
+	ip      net.IP
+	helo    string
+	sender  string
+
+	lookups     int
+	voidLookups int
+}
+
+// spfError carries the result a failed evaluation should produce
+type spfError struct {
+	result string
+	msg    string
+}
+
+func (e *spfError) Error() string {
+	return e.msg
+}
+
+func permError(format string, args ...interface{}) error {
+	return &spfError{PermError, fmt.Sprintf(format, args...)}
+}
+
+// checkHost implements check_host(), see https://tools.ietf.org/html/rfc7208#section-4
+func (e *evaluation) checkHost(domain string, depth int) (string, error) {
+	if depth > e.checker.MaxLookups {
+		return PermError, permError("Too many nested policies")
+	}
+
+	if !validDomain(domain) {
+		return None, fmt.Errorf("%v is not a valid domain", domain)
+	}
+
+	record, err := e.record(domain)
+	if err != nil {
+		return errorResult(err), err
+	} else if record == "" {
+		return None, fmt.Errorf("No SPF record for %v", domain)
+	}
+
+	terms := strings.Fields(record)[1:]
+
+	var redirect, explanation string
+	for _, term := range terms {
+		name, value, isModifier := splitModifier(term)
+		if !isModifier {
+			continue
+		}
+		switch name {
+		case "redirect":
+			if redirect != "" {
+				return PermError, permError("Duplicate redirect modifier")
+			}
+			redirect = value
+		case "exp":
+			if explanation != "" {
+				return PermError, permError("Duplicate exp modifier")
+			}
+			explanation = value
+		}
+	}
+
+	for _, term := range terms {
+		if _, _, isModifier := splitModifier(term); isModifier {
+			continue
+		}
+
+		result := Pass
+		if q, ok := qualifiers[term[0]]; ok {
+			result = q
+			term = term[1:]
+		}
+
+		matched, err := e.mechanism(term, domain, depth)
+		if err != nil {
+			return errorResult(err), err
+		}
+
+		if matched {
+			if result == Fail {
+				return Fail, e.explain(explanation, domain)
+			}
+			return result, resultError(result, domain)
+		}
+	}
+
+	if redirect != "" {
+		target, err := e.expand(redirect, domain, false)
+		if err != nil {
+			return PermError, err
+		}
+		if err := e.countLookup(); err != nil {
+			return PermError, err
+		}
+		result, err := e.checkHost(target, depth+1)
+		if result == None {
+			return PermError, permError("Redirect to %v, which has no SPF record", target)
+		}
+		return result, err
+	}
+
+	return Neutral, resultError(Neutral, domain)
+}
+
+// record fetches the single SPF record of a domain, "" if there isn't one
+func (e *evaluation) record(domain string) (string, error) {
+	txts, err := e.checker.Resolver.LookupTXT(domain)
+	if err != nil && !isNotFound(err) {
+		return "", &spfError{TempError, fmt.Sprintf("DNS error looking up %v: %v", domain, err)}
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	if len(records) > 1 {
+		return "", permError("Multiple SPF records for %v", domain)
+	} else if len(records) == 0 {
+		return "", nil
+	}
+	return records[0], nil
+}
+
+// mechanism evaluates a single mechanism, see https://tools.ietf.org/html/rfc7208#section-5
+func (e *evaluation) mechanism(term, domain string, depth int) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		if arg != "" {
+			return false, permError("Invalid mechanism %q", term)
+		}
+		return true, nil
+
+	case "include":
+		target, err := e.domainArg(arg, domain, true)
+		if err != nil {
+			return false, err
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		result, err := e.checkHost(target, depth+1)
+		switch result {
+		case Pass:
+			return true, nil
+		case TempError:
+			return false, err
+		case PermError, None:
+			return false, permError("Included policy %v: %v", target, err)
+		}
+		return false, nil
+
+	case "a", "mx":
+		spec, ip4bits, ip6bits, err := splitCIDR(arg)
+		if err != nil {
+			return false, permError("Invalid mechanism %q: %v", term, err)
+		}
+		target, err := e.domainArg(spec, domain, false)
+		if err != nil {
+			return false, err
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := e.checker.Resolver.LookupMX(target)
+			if err := e.lookupError(err, len(mxs)); err != nil {
+				return false, err
+			}
+			if len(mxs) > 10 {
+				return false, permError("Too many MX records for %v", target)
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+
+		for _, host := range hosts {
+			ips, err := e.checker.Resolver.LookupIP(host)
+			if err := e.lookupError(err, len(ips)); err != nil {
+				return false, err
+			}
+			for _, ip := range ips {
+				if e.matchIP(ip, ip4bits, ip6bits) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		target, err := e.domainArg(arg, domain, false)
+		if err != nil {
+			return false, err
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		for _, name := range e.validatedNames() {
+			if isSubdomain(name, target) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError("Invalid mechanism %q", term)
+		}
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil || (name == "ip4") != (ipnet.IP.To4() != nil) {
+			return false, permError("Invalid mechanism %q", term)
+		}
+		return ipnet.Contains(e.ip), nil
+
+	case "exists":
+		target, err := e.domainArg(arg, domain, true)
+		if err != nil {
+			return false, err
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		ips, err := e.checker.Resolver.LookupIP(target)
+		if err := e.lookupError(err, len(ips)); err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, permError("Unknown mechanism %q", term)
+}
+
+// domainArg expands the ":domain-spec" argument of a mechanism, falling back to the current domain
+func (e *evaluation) domainArg(arg, domain string, required bool) (string, error) {
+	if arg == "" {
+		if required {
+			return "", permError("Missing domain")
+		}
+		return domain, nil
+	}
+	if !strings.HasPrefix(arg, ":") {
+		return "", permError("Invalid domain %q", arg)
+	}
+	return e.expand(arg[1:], domain, false)
+}
+
+// matchIP compares the client's address to ip, using the prefix length for its family
+func (e *evaluation) matchIP(ip net.IP, ip4bits, ip6bits int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		if e.ip.To4() == nil {
+			return false
+		}
+		return ip4.Mask(net.CIDRMask(ip4bits, 32)).Equal(e.ip.To4().Mask(net.CIDRMask(ip4bits, 32)))
+	}
+	if e.ip.To4() != nil {
+		return false
+	}
+	return ip.Mask(net.CIDRMask(ip6bits, 128)).Equal(e.ip.Mask(net.CIDRMask(ip6bits, 128)))
+}
+
+// validatedNames returns the client's reverse DNS names that resolve back to its address,
+// see https://tools.ietf.org/html/rfc7208#section-5.5
+func (e *evaluation) validatedNames() []string {
+	names, err := e.checker.Resolver.LookupAddr(e.ip.String())
+	if err != nil {
+		return nil
+	}
+	if len(names) > 10 {
+		names = names[:10]
+	}
+
+	var validated []string
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		ips, err := e.checker.Resolver.LookupIP(name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(e.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+	return validated
+}
+
+// countLookup enforces the limit on DNS-querying terms
+func (e *evaluation) countLookup() error {
+	e.lookups++
+	if e.lookups > e.checker.MaxLookups {
+		return permError("Too many DNS lookups")
+	}
+	return nil
+}
+
+// lookupError classifies the outcome of a DNS query made by a mechanism, counting void lookups
+func (e *evaluation) lookupError(err error, answers int) error {
+	if err != nil && !isNotFound(err) {
+		return &spfError{TempError, fmt.Sprintf("DNS error: %v", err)}
+	}
+	if answers == 0 {
+		e.voidLookups++
+		if e.voidLookups > e.checker.MaxVoidLookups {
+			return permError("Too many void DNS lookups")
+		}
+	}
+	return nil
+}
+
+// explain fetches the domain's explanation for a failure, see https://tools.ietf.org/html/rfc7208#section-6.2
+func (e *evaluation) explain(exp, domain string) error {
+	fallback := resultError(Fail, domain)
+	if exp == "" {
+		return fallback
+	}
+
+	target, err := e.expand(exp, domain, false)
+	if err != nil {
+		return fallback
+	}
+
+	txts, err := e.checker.Resolver.LookupTXT(target)
+	if err != nil || len(txts) != 1 {
+		return fallback
+	}
+
+	explanation, err := e.expand(txts[0], domain, true)
+	if err != nil {
+		return fallback
+	}
+	return fmt.Errorf("%v", explanation)
+}
+
+// splitModifier tells modifiers (name=value) apart from mechanisms
+func splitModifier(term string) (string, string, bool) {
+	i := strings.Index(term, "=")
+	if i <= 0 || strings.ContainsAny(term[:i], ":/") {
+		return "", "", false
+	}
+	return strings.ToLower(term[:i]), term[i+1:], true
+}
+
+// splitCIDR splits "domain/24//64" style arguments into the domain and both prefix lengths
+func splitCIDR(arg string) (string, int, int, error) {
+	ip4bits, ip6bits := 32, 128
+
+	if i := strings.Index(arg, "//"); i >= 0 {
+		bits, err := strconv.Atoi(arg[i+2:])
+		if err != nil || bits < 0 || bits > 128 {
+			return "", 0, 0, fmt.Errorf("bad ip6 prefix length")
+		}
+		ip6bits = bits
+		arg = arg[:i]
+	}
+
+	if i := strings.LastIndex(arg, "/"); i >= 0 {
+		bits, err := strconv.Atoi(arg[i+1:])
+		if err != nil || bits < 0 || bits > 32 {
+			return "", 0, 0, fmt.Errorf("bad ip4 prefix length")
+		}
+		ip4bits = bits
+		arg = arg[:i]
+	}
+
+	return arg, ip4bits, ip6bits, nil
+}
+
+// resultError gives a default explanation for a result
+func resultError(result, domain string) error {
+	switch result {
+	case Pass:
+		return nil
+	case Fail:
+		return fmt.Errorf("%v does not designate this host as a permitted sender", domain)
+	case SoftFail:
+		return fmt.Errorf("%v does not designate this host as a permitted sender (softfail)", domain)
+	}
+	return fmt.Errorf("%v neither permits nor denies this host", domain)
+}
+
+// errorResult pulls the result out of an evaluation error
+func errorResult(err error) string {
+	if e, ok := err.(*spfError); ok {
+		return e.result
+	}
+	return PermError
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func senderDomain(sender string) string {
+	return sender[strings.LastIndex(sender, "@")+1:]
+}
+
+func senderLocal(sender string) string {
+	return sender[:strings.LastIndex(sender, "@")]
+}
+
+// validDomain checks that a domain is a multi-label FQDN, see https://tools.ietf.org/html/rfc7208#section-4.3
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+func isSubdomain(child, parent string) bool {
+	child, parent = strings.ToLower(strings.TrimSuffix(child, ".")), strings.ToLower(strings.TrimSuffix(parent, "."))
+	return child == parent || strings.HasSuffix(child, "."+parent)
+}
@@ -0,0 +1,185 @@
+package spf
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeResolver answers from static maps, so that tests never touch the network
+type fakeResolver struct {
+	txt map[string][]string
+	ip  map[string][]net.IP
+	mx  map[string][]*net.MX
+	ptr map[string][]string
+}
+
+func (r *fakeResolver) LookupAddr(addr string) ([]string, error) {
+	return r.ptr[addr], r.err(len(r.ptr[addr]), addr)
+}
+
+func (r *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	return r.ip[host], r.err(len(r.ip[host]), host)
+}
+
+func (r *fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	return r.mx[name], r.err(len(r.mx[name]), name)
+}
+
+func (r *fakeResolver) LookupTXT(name string) ([]string, error) {
+	if name == "timeout.example" {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+	return r.txt[name], r.err(len(r.txt[name]), name)
+}
+
+func (r *fakeResolver) err(found int, name string) error {
+	if found == 0 {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil
+}
+
+func testResolver() *fakeResolver {
+	return &fakeResolver{
+		txt: map[string][]string{
+			"example.com":              {"v=spf1 ip4:192.0.2.0/24 a:mail.example.com mx include:_spf.example.net -all", "unrelated"},
+			"_spf.example.net":         {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"soft.example":             {"v=spf1 ~all"},
+			"neutral.example":          {"v=spf1 ?all"},
+			"redirect.example":         {"v=spf1 redirect=example.com"},
+			"double.example":           {"v=spf1 -all", "v=spf1 +all"},
+			"broken.example":           {"v=spf1 bogus:example.com -all"},
+			"include.example":          {"v=spf1 include:timeout.example -all"},
+			"void.example":             {"v=spf1 a:none1.example a:none2.example a:none3.example -all"},
+			"loop.example":             {"v=spf1 include:loop.example -all"},
+			"ptr.example":              {"v=spf1 ptr -all"},
+			"exists.example":           {"v=spf1 exists:%{ir}.%{l1r+}._spf.%{d} -all"},
+			"exp.example":              {"v=spf1 -all exp=explain._spf.%{d}"},
+			"explain._spf.exp.example": {"%{i} is not one of %{d}'s designated mail servers"},
+		},
+		ip: map[string][]net.IP{
+			"mail.example.com":                   {net.ParseIP("198.51.100.10")},
+			"mx.example.com":                     {net.ParseIP("203.0.113.5")},
+			"host.ptr.example":                   {net.ParseIP("198.51.100.99")},
+			"3.2.0.192.user._spf.exists.example": {net.ParseIP("127.0.0.2")},
+		},
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com", Pref: 10}},
+		},
+		ptr: map[string][]string{
+			"198.51.100.99": {"host.ptr.example."},
+		},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	checker := NewChecker(testResolver())
+
+	for _, test := range []struct {
+		ip     string
+		sender string
+		result string
+	}{
+		{"192.0.2.1", "user@example.com", Pass},
+		{"198.51.100.10", "user@example.com", Pass},
+		{"203.0.113.5", "user@example.com", Pass},
+		{"2001:db8::1", "user@example.com", Pass},
+		{"203.0.113.99", "user@example.com", Fail},
+		{"203.0.113.99", "user@soft.example", SoftFail},
+		{"203.0.113.99", "user@neutral.example", Neutral},
+		{"192.0.2.1", "user@redirect.example", Pass},
+		{"203.0.113.99", "user@redirect.example", Fail},
+		{"192.0.2.1", "user@nothing.example", None},
+		{"192.0.2.1", "user@double.example", PermError},
+		{"192.0.2.1", "user@broken.example", PermError},
+		{"192.0.2.1", "user@include.example", TempError},
+		{"192.0.2.1", "user@void.example", PermError},
+		{"192.0.2.1", "user@loop.example", PermError},
+		{"198.51.100.99", "user@ptr.example", Pass},
+		{"192.0.2.1", "user@ptr.example", Fail},
+		{"192.0.2.3", "user@exists.example", Pass},
+		{"192.0.2.4", "user@exists.example", Fail},
+		{"192.0.2.1", "", Pass},
+	} {
+		result, err := checker.Check(net.ParseIP(test.ip), "example.com", test.sender)
+		if result != test.result {
+			t.Errorf("Check(%v, %v) want: %v, got: %v (%v)", test.ip, test.sender, test.result, result, err)
+		}
+	}
+}
+
+func TestExplanation(t *testing.T) {
+	result, err := NewChecker(testResolver()).Check(net.ParseIP("192.0.2.1"), "example.com", "user@exp.example")
+	if result != Fail || err == nil || err.Error() != "192.0.2.1 is not one of exp.example's designated mail servers" {
+		t.Errorf("Expected a fail with the domain's explanation, got: %v (%v)", result, err)
+	}
+}
+
+func TestLookupLimit(t *testing.T) {
+	resolver := testResolver()
+	resolver.txt["many.example"] = []string{"v=spf1 a a a a a a a a a a a -all"}
+	resolver.ip["many.example"] = []net.IP{net.ParseIP("198.51.100.1")}
+
+	if result, _ := NewChecker(resolver).Check(net.ParseIP("192.0.2.1"), "example.com", "user@many.example"); result != PermError {
+		t.Errorf("More than 10 lookups should be a permerror, got: %v", result)
+	}
+}
+
+// examples from https://tools.ietf.org/html/rfc7208#section-7.4
+func TestMacros(t *testing.T) {
+	e := &evaluation{
+		checker: NewChecker(testResolver()),
+		ip:      net.ParseIP("192.0.2.3"),
+		sender:  "strong-bad@email.example.com",
+		helo:    "mx.example.org",
+	}
+
+	for spec, want := range map[string]string{
+		"%{s}":                              "strong-bad@email.example.com",
+		"%{o}":                              "email.example.com",
+		"%{d}":                              "email.example.com",
+		"%{d4}":                             "email.example.com",
+		"%{d3}":                             "email.example.com",
+		"%{d2}":                             "example.com",
+		"%{d1}":                             "com",
+		"%{dr}":                             "com.example.email",
+		"%{d2r}":                            "example.email",
+		"%{l}":                              "strong-bad",
+		"%{l-}":                             "strong.bad",
+		"%{lr}":                             "strong-bad",
+		"%{lr-}":                            "bad.strong",
+		"%{l1r-}":                           "strong",
+		"%{ir}.%{v}._spf.%{d2}":             "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":              "bad.strong.lp._spf.example.com",
+		"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}":   "bad.strong.lp.3.2.0.192.in-addr._spf.example.com",
+		"%{d2}.trusted-domains.example.net": "example.com.trusted-domains.example.net",
+		"%%%_%-":                            "% %20",
+	} {
+		got, err := e.expand(spec, "email.example.com", false)
+		if err != nil || got != want {
+			t.Errorf("expand(%q) want: %v, got: %v (%v)", spec, want, got, err)
+		}
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if got, _ := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com", false); got != want {
+		t.Errorf("IPv6 expansion want: %v, got: %v", want, got)
+	}
+
+	if _, err := e.expand("%{c}", "email.example.com", false); errorResult(err) != PermError {
+		t.Errorf("%%{c} outside of an explanation should be a permerror")
+	}
+
+	if _, err := e.expand("%{x}", "email.example.com", false); err == nil {
+		t.Errorf("Unknown macros should be rejected")
+	}
+}
+
+func TestAuthResult(t *testing.T) {
+	r := AuthResult(Fail, errors.New("nope"), "mx.example.org", "user@example.com")
+	if r.String() != `spf=fail reason="nope" smtp.mailfrom=user@example.com` {
+		t.Errorf("Wrong Authentication-Results entry, got: %v", r)
+	}
+}